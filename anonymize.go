@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+// anonymizeKey is the key client addresses are hashed with, it's picked at
+// startup so that the hashes can't be reversed by hashing every address
+var anonymizeKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// anonymizeClient returns the form of a client address that is kept in the
+// question cache, "truncate" zeros the last octet of ipv4 and the last 80 bits
+// of ipv6 addresses, "hash" replaces the address with a keyed hash of it
+func anonymizeClient(ip net.IP, mode string) string {
+	switch mode {
+	case "truncate":
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, net.IPv4len*8)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, net.IPv6len*8)).String()
+	case "hash":
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		mac := hmac.New(sha256.New, anonymizeKey)
+		mac.Write(ip)
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return ip.String()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAnonymizeClient(t *testing.T) {
+	tests := []struct {
+		ip, mode, expected string
+	}{
+		{"192.168.1.10", "", "192.168.1.10"},
+		{"192.168.1.10", "truncate", "192.168.1.0"},
+		{"2001:db8:1234:5678::10", "truncate", "2001:db8:1234::"},
+		{"2001:db8:1234:5678::10", "", "2001:db8:1234:5678::10"},
+	}
+
+	for _, test := range tests {
+		if anonymized := anonymizeClient(net.ParseIP(test.ip), test.mode); anonymized != test.expected {
+			t.Errorf("%s with %q: expected %s, got %s", test.ip, test.mode, test.expected, anonymized)
+		}
+	}
+
+	hashed := anonymizeClient(net.ParseIP("192.168.1.10"), "hash")
+	if hashed == "192.168.1.10" || len(hashed) != 16 {
+		t.Errorf("expected a hash of the address, got %s", hashed)
+	}
+	if anonymizeClient(net.ParseIP("192.168.1.10"), "hash") != hashed {
+		t.Error("the hash of an address changed")
+	}
+	if anonymizeClient(net.ParseIP("192.168.1.11"), "hash") == hashed {
+		t.Error("different addresses have the same hash")
+	}
+
+	if err := (&config{AnonymizeClients: "mask"}).parse(); err == nil {
+		t.Error("expected an error for an unknown anonymization")
+	}
+}
@@ -1,23 +1,146 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// StartAPIServer launches the API server
-func StartAPIServer() error {
+// apiCertificate is the certificate of the API server, nil if it's served
+// over http
+var apiCertificate *certificate
+
+// certificate is a tls certificate that can be loaded again from its files
+type certificate struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	mu       sync.RWMutex
+}
+
+// loadCertificate loads a certificate from PEM files
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files of the certificate again, the current certificate
+// stays in use if they can't be loaded
+func (c *certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate %s: %s", c.certFile, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	return nil
+}
+
+// GetCertificate returns the certificate for a tls handshake
+func (c *certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// ReloadAPICertificate reads the certificate of the API server again, for
+// certificates that were renewed
+func ReloadAPICertificate() error {
+	if apiCertificate == nil {
+		return nil
+	}
+	return apiCertificate.Reload()
+}
+
+// StartAPIServer launches the API server, the returned server is shut down to
+// stop it. It's served over https when a certificate is configured.
+func StartAPIServer(handler *DNSHandler) (*http.Server, error) {
+	server := &http.Server{Handler: apiRouter(handler)}
+	if Config().APITLSCert != "" {
+		cert, err := loadCertificate(Config().APITLSCert, Config().APITLSKey)
+		if err != nil {
+			return nil, err
+		}
+		apiCertificate = cert
+		server.TLSConfig = &tls.Config{GetCertificate: cert.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+
+	listener, err := net.Listen("tcp", Config().API)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && Config().APIToken == "" && Config().APIUser == "" {
+		log.Printf("API server on %s is reachable from the network without authentication\n", Config().API)
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("API server failed: %s\n", err)
+		}
+	}()
+
+	log.Println("API server listening on", Config().API)
+
+	return server, nil
+}
+
+// apiRouter returns the routes of the API server
+func apiRouter(handler *DNSHandler) *gin.Engine {
 	router := gin.Default()
 
+	// other origins may read, but a page on another origin must not be able
+	// to change anything with the credentials of the browser
 	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		if !isMutating(c) {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		}
 		c.Next()
 	})
 
+	// liveness and readiness for service managers, they are kept apart from
+	// the data api
+	router.GET("/healthz", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, gin.H{"alive": true})
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		blockCache, upstreams := BlockCacheReady(), handler.resolver.Ready()
+		status := http.StatusOK
+		if !blockCache || !upstreams {
+			status = http.StatusServiceUnavailable
+		}
+		c.IndentedJSON(status, gin.H{"ready": status == http.StatusOK, "blockcache": blockCache, "upstreams": upstreams})
+	})
+
+	// only the routes added from here on require credentials
+	router.Use(apiAuth)
+
 	router.GET("/blockcache", func(c *gin.Context) {
-		c.IndentedJSON(http.StatusOK, gin.H{"length": BlockCache.Length(), "items": BlockCache.Backend})
+		c.IndentedJSON(http.StatusOK, gin.H{"length": BlockCache.Length(), "items": BlockCache.Items()})
 	})
 
 	router.GET("/blockcache/length", func(c *gin.Context) {
@@ -25,7 +148,7 @@ func StartAPIServer() error {
 	})
 
 	router.GET("/questioncache", func(c *gin.Context) {
-		c.IndentedJSON(http.StatusOK, gin.H{"length": QuestionCache.Length(), "items": QuestionCache.Backend})
+		c.IndentedJSON(http.StatusOK, gin.H{"length": QuestionCache.Length(), "items": QuestionCache.Entries()})
 	})
 
 	router.GET("/questioncache/length", func(c *gin.Context) {
@@ -38,24 +161,288 @@ func StartAPIServer() error {
 	})
 
 	router.GET("/questioncache/client/:client", func(c *gin.Context) {
-		var filteredCache []QuestionCacheEntry
+		filteredCache, _ := QuestionCache.Query(0, 0, func(entry QuestionCacheEntry) bool {
+			return entry.Remote == c.Param("client")
+		})
+
+		c.IndentedJSON(http.StatusOK, filteredCache)
+	})
+
+	router.GET("/questions", func(c *gin.Context) {
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
 
-		QuestionCache.mu.RLock()
-		for _, entry := range QuestionCache.Backend {
-			if entry.Remote == c.Param("client") {
-				filteredCache = append(filteredCache, entry)
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+		if err != nil || limit < 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+
+		var blocked *bool
+		if value, ok := c.GetQuery("blocked"); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid blocked"})
+				return
 			}
+			blocked = &b
 		}
-		QuestionCache.mu.RUnlock()
 
-		c.IndentedJSON(http.StatusOK, filteredCache)
+		var wouldBlock *bool
+		if value, ok := c.GetQuery("wouldblock"); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid wouldblock"})
+				return
+			}
+			wouldBlock = &b
+		}
+
+		client := c.Query("client")
+
+		entries, total := QuestionCache.Query(offset, limit, func(entry QuestionCacheEntry) bool {
+			if blocked != nil && entry.Blocked != *blocked {
+				return false
+			}
+			if wouldBlock != nil && entry.WouldBlock != *wouldBlock {
+				return false
+			}
+			return client == "" || entry.Remote == client
+		})
+
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		c.IndentedJSON(http.StatusOK, entries)
+	})
+
+	router.GET("/whitelist", func(c *gin.Context) {
+		items := WhitelistCache.Items()
+		c.IndentedJSON(http.StatusOK, gin.H{"length": len(items), "items": items})
+	})
+
+	router.POST("/whitelist", requireJSON, func(c *gin.Context) {
+		var body struct {
+			Domain string `json:"domain" binding:"required"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			return
+		}
+
+		WhitelistDomain(body.Domain)
+		handler.Evict(body.Domain)
+		c.IndentedJSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	router.DELETE("/whitelist/:domain", func(c *gin.Context) {
+		domain := c.Param("domain")
+		if !UnwhitelistDomain(domain) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"success": false})
+			return
+		}
+
+		handler.Evict(domain)
+		c.IndentedJSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	router.POST("/block", requireJSON, func(c *gin.Context) {
+		var body struct {
+			Domain string `json:"domain" binding:"required"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			return
+		}
+
+		BlockDomain(body.Domain)
+		handler.Evict(body.Domain)
+		c.IndentedJSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	router.GET("/block/stats", func(c *gin.Context) {
+		stats := BlockCacheStats()
+		if stats == nil {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"error": "block cache wasn't built from the lists yet"})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, stats)
+	})
+
+	router.GET("/block/:domain", func(c *gin.Context) {
+		domain := c.Param("domain")
+		c.IndentedJSON(http.StatusOK, gin.H{
+			"domain":      domain,
+			"blocked":     isBlocked(domain, c.Query("group")),
+			"source":      blockSource(domain),
+			"whitelisted": WhitelistCache.Match(domain),
+		})
+	})
+
+	router.DELETE("/block/:domain", func(c *gin.Context) {
+		domain := c.Param("domain")
+		if !UnblockDomain(domain) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"success": false})
+			return
+		}
+
+		handler.Evict(domain)
+		c.IndentedJSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	router.POST("/cache/flush", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, gin.H{"removed": handler.Flush()})
+	})
+
+	router.GET("/cache/stats", func(c *gin.Context) {
+		reset, err := strconv.ParseBool(c.DefaultQuery("reset", "false"))
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid reset"})
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, handler.CacheStats(reset))
+	})
+
+	router.DELETE("/cache/:domain", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, gin.H{"removed": handler.Evict(c.Param("domain"))})
+	})
+
+	router.GET("/stats/top", func(c *gin.Context) {
+		n, err := strconv.Atoi(c.DefaultQuery("n", "10"))
+		if err != nil || n < 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid n"})
+			return
+		}
+
+		var top *TopDomains
+		switch kind := c.DefaultQuery("kind", "queried"); kind {
+		case "queried":
+			top = TopQueried
+		case "blocked":
+			top = TopBlocked
+		default:
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid kind"})
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, top.Top(n))
+	})
+
+	router.GET("/upstreams", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, handler.resolver.Stats())
+	})
+
+	router.GET("/version", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, handler.Info())
 	})
 
-	if err := router.Run(Config.API); err != nil {
-		return err
+	if Config().Metrics {
+		path := Config().MetricsPath
+		if path == "" {
+			path = defaultMetricsPath
+		}
+		router.GET(path, gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})))
 	}
 
-	log.Println("API server listening on", Config.API)
+	return router
+}
 
-	return nil
+// apiAuth rejects requests without valid credentials with 401 once an api
+// token or user is configured, only requests that change something are checked
+// unless apiauthreads is set
+func apiAuth(c *gin.Context) {
+	cfg := Config()
+	if cfg.APIToken == "" && cfg.APIUser == "" {
+		return
+	}
+	if !cfg.APIAuthReads && !isMutating(c) {
+		return
+	}
+
+	if validCredentials(cfg, c.GetHeader("Authorization")) {
+		return
+	}
+
+	if cfg.APIUser != "" {
+		c.Header("WWW-Authenticate", `Basic realm="grimd"`)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+}
+
+// validCredentials returns whether or not an Authorization header carries the
+// token or the user and password of the API, for the web and the gRPC API
+func validCredentials(cfg *config, auth string) bool {
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok && cfg.APIToken != "" {
+		return secureEqual(token, cfg.APIToken)
+	}
+
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok || cfg.APIUser == "" {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && secureEqual(user, cfg.APIUser) && secureEqual(password, cfg.APIPassword)
+}
+
+// requireJSON rejects bodies that aren't json with 415, forms can be posted
+// from any page without a preflight request
+func requireJSON(c *gin.Context) {
+	if c.ContentType() != binding.MIMEJSON {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be " + binding.MIMEJSON})
+	}
+}
+
+// isMutating returns whether or not a request changes something, which
+// includes the GET requests that clear the question cache or reset stats
+func isMutating(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return true
+	}
+
+	switch c.FullPath() {
+	case "/questioncache/clear":
+		return true
+	case "/cache/stats":
+		// an invalid reset is rejected by the handler
+		reset, err := strconv.ParseBool(c.Query("reset"))
+		return err == nil && reset
+	}
+	return false
+}
+
+// secureEqual compares credentials in constant time
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// blockSource returns where the block of a domain comes from, "manual" for the
+// blocklist in the config and the API, "list" for the downloaded lists, "tld"
+// for the tlds in blockedtlds and "regex" for the regex blocklist, or "" if the
+// domain isn't in any of them
+func blockSource(domain string) string {
+	if ManualBlockCache.Exists(domain) {
+		return "manual"
+	}
+	for _, entry := range Config().Blocklist {
+		if entry == domain {
+			return "manual"
+		}
+	}
+
+	switch {
+	case BlockCache.Exists(domain), BlockCache.MatchWildcard(domain):
+		return "list"
+	case blockedTLD(normalizeDomain(domain)):
+		return "tld"
+	case RegexBlockCache.Match(domain):
+		return "regex"
+	}
+
+	return ""
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
+
+func TestAPIAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/healthz", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.Use(apiAuth)
+	router.GET("/blockcache", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/questioncache/clear", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/block", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/cache/stats", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		reads    bool
+		method   string
+		path     string
+		token    string
+		user     string
+		password string
+		status   int
+	}{
+		{false, http.MethodGet, "/blockcache", "", "", "", http.StatusOK},
+		{false, http.MethodPost, "/block", "", "", "", http.StatusUnauthorized},
+		{false, http.MethodGet, "/questioncache/clear", "", "", "", http.StatusUnauthorized},
+		{false, http.MethodGet, "/cache/stats?reset=true", "", "", "", http.StatusUnauthorized},
+		{false, http.MethodGet, "/cache/stats?reset=false", "", "", "", http.StatusOK},
+		{false, http.MethodGet, "/cache/stats?reset=0", "", "", "", http.StatusOK},
+		{false, http.MethodPost, "/block", "secret", "", "", http.StatusOK},
+		{false, http.MethodPost, "/block", "wrong", "", "", http.StatusUnauthorized},
+		{false, http.MethodPost, "/block", "", "admin", "hunter2", http.StatusOK},
+		{false, http.MethodPost, "/block", "", "admin", "wrong", http.StatusUnauthorized},
+		{true, http.MethodGet, "/blockcache", "", "", "", http.StatusUnauthorized},
+		{true, http.MethodGet, "/blockcache", "secret", "", "", http.StatusOK},
+		{true, http.MethodGet, "/healthz", "", "", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		withConfig(t, &config{APIToken: "secret", APIUser: "admin", APIPassword: "hunter2", APIAuthReads: test.reads})
+
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s %s (reads %v): expected %d, got %d", test.method, test.path, test.reads, test.status, w.Code)
+		}
+	}
+
+	withConfig(t, &config{})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/block", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected requests to be allowed without credentials configured, got %d", w.Code)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for name to dir and
+// returns the paths of the certificate and key files
+func writeTestCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "old.example.com")
+
+	c, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCertificate(t, dir, "new.example.com")
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := c.GetCertificate(nil)
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil || leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("expected the renewed certificate, got %v", leaf.Subject)
+	}
+
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Error("expected an error for an invalid certificate")
+	}
+	if current, _ := c.GetCertificate(nil); current != cert {
+		t.Error("the certificate in use was replaced by an invalid one")
+	}
+}
+
+func TestAPIRequiresJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10})
+	router := apiRouter(NewHandler())
+	t.Cleanup(func() { UnblockDomain("form.example.com") })
+
+	req := httptest.NewRequest(http.MethodPost, "/block", strings.NewReader("domain=form.example.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType || BlockCache.Has("form.example.com") {
+		t.Errorf("expected a form to be rejected with 415, got %d", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("expected no cors header on a route that changes something")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/block", strings.NewReader(`{"domain": "form.example.com"}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !BlockCache.Has("form.example.com") {
+		t.Errorf("expected a json body to be accepted, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/blockcache/length", nil))
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("expected reads to be allowed from other origins")
+	}
+}
+
+// serveAPI sends a request with a json body, if any, to router
+func serveAPI(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIBlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	inDir(t, dir)
+	if err := os.Mkdir("lists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10, Groups: map[string]group{"kids": {}}})
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler()
+	router := apiRouter(h)
+	const domain = "manual.example.com"
+	t.Cleanup(func() { UnblockDomain(domain) })
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	m.Answer = []dns.RR{testRR(dns.Fqdn(domain), 600)}
+	key := KeyGen(Question{domain, "A", "IN"})
+	h.cache.Set(key, m)
+
+	if w := serveAPI(router, http.MethodPost, "/block", `{"domain": "`+domain+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the domain to be blocked, got %d", w.Code)
+	}
+	if !isBlocked(domain, "") || !isBlocked(domain, "kids") {
+		t.Error("expected the domain to be blocked at once and in every group")
+	}
+	if h.cache.Exists(key) {
+		t.Error("expected the cached answer to be evicted")
+	}
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+	if !isBlocked(domain, "") || !isBlocked(domain, "kids") {
+		t.Error("expected the domain to stay blocked after a rebuild")
+	}
+
+	if w := serveAPI(router, http.MethodDelete, "/block/"+domain, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected the domain to be unblocked, got %d", w.Code)
+	}
+	if isBlocked(domain, "") || isBlocked(domain, "kids") || ManualBlockCache.Exists(domain) {
+		t.Error("expected the domain to be unblocked everywhere")
+	}
+	if w := serveAPI(router, http.MethodDelete, "/block/"+domain, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a domain that isn't blocked, got %d", w.Code)
+	}
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+	if isBlocked(domain, "") {
+		t.Error("expected the domain to stay unblocked after a rebuild")
+	}
+}
+
+func TestAPIBlockSource(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10, BlockedTLDs: []string{"zip"}})
+	emptyGlobalCaches(t)
+	BlockCache.Set("listed.example.com", true)
+	BlockDomain("manual.example.com")
+	router := apiRouter(NewHandler())
+
+	tests := []struct {
+		domain  string
+		blocked bool
+		source  string
+	}{
+		{"manual.example.com", true, "manual"},
+		{"listed.example.com", true, "list"},
+		{"foo.zip", true, "tld"},
+		{"Foo.ZIP", true, "tld"},
+		{"example.org", false, ""},
+	}
+
+	for _, test := range tests {
+		var body struct {
+			Blocked bool   `json:"blocked"`
+			Source  string `json:"source"`
+		}
+		w := serveAPI(router, http.MethodGet, "/block/"+test.domain, "")
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Blocked != test.blocked || body.Source != test.source {
+			t.Errorf("%s: expected blocked %v from %q, got %+v", test.domain, test.blocked, test.source, body)
+		}
+	}
+}
+
+func TestAPIWhitelist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10})
+	router := apiRouter(NewHandler())
+	t.Cleanup(func() {
+		UnwhitelistDomain("*.allowed.example.com")
+		UnwhitelistDomain("exact.example.com")
+	})
+
+	for _, domain := range []string{"*.allowed.example.com", "exact.example.com"} {
+		if w := serveAPI(router, http.MethodPost, "/whitelist", `{"domain": "`+domain+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("expected %s to be whitelisted, got %d", domain, w.Code)
+		}
+	}
+
+	var body struct {
+		Length int             `json:"length"`
+		Items  map[string]bool `json:"items"`
+	}
+	w := serveAPI(router, http.MethodGet, "/whitelist", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.Items["*.allowed.example.com"] || !body.Items["exact.example.com"] || body.Length != len(body.Items) {
+		t.Errorf("expected the wildcard and the exact entry, got %+v", body)
+	}
+}
+
+func TestAPIQuestions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10})
+	router := apiRouter(NewHandler())
+
+	QuestionCache.Clear()
+	t.Cleanup(QuestionCache.Clear)
+	for i := 0; i < 5; i++ {
+		QuestionCache.Add(QuestionCacheEntry{
+			Date:       int64(i),
+			Remote:     []string{"192.168.1.10", "192.168.1.11"}[i%2],
+			Blocked:    i == 0 || i == 2,
+			WouldBlock: i == 3,
+			Query:      Question{testDomain, "A", "IN"},
+		})
+	}
+
+	tests := []struct {
+		query string
+		dates []int64
+		total int
+	}{
+		{"", []int64{0, 1, 2, 3, 4}, 5},
+		{"?offset=1&limit=2", []int64{1, 2}, 5},
+		{"?offset=4&limit=2", []int64{4}, 5},
+		{"?client=192.168.1.10", []int64{0, 2, 4}, 3},
+		{"?client=192.168.1.10&blocked=true", []int64{0, 2}, 2},
+		{"?blocked=false&limit=1", []int64{1}, 3},
+		{"?wouldblock=true", []int64{3}, 1},
+	}
+
+	for _, test := range tests {
+		w := serveAPI(router, http.MethodGet, "/questions"+test.query, "")
+		var entries []QuestionCacheEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+
+		var dates []int64
+		for _, entry := range entries {
+			dates = append(dates, entry.Date)
+		}
+		if fmt.Sprint(dates) != fmt.Sprint(test.dates) {
+			t.Errorf("%q: expected the questions %v, got %v", test.query, test.dates, dates)
+		}
+		if total := w.Header().Get("X-Total-Count"); total != strconv.Itoa(test.total) {
+			t.Errorf("%q: expected X-Total-Count %d, got %s", test.query, test.total, total)
+		}
+	}
+
+	for _, query := range []string{"?offset=-1", "?limit=x", "?blocked=maybe", "?wouldblock=2"} {
+		if w := serveAPI(router, http.MethodGet, "/questions"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, w.Code)
+		}
+	}
+}
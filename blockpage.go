@@ -0,0 +1,88 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+)
+
+// defaultBlockPage is the block page when no blockpagefile is configured
+const defaultBlockPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Host}} is blocked</title></head>
+<body>
+<h1>{{.Host}} is blocked</h1>
+<p>This domain was blocked by grimd.</p>
+</body>
+</html>
+`
+
+// blockPage serves the block page for requests to any host
+type blockPage struct {
+	template *template.Template
+}
+
+// ServeHTTP writes the block page for the host of the request
+func (p *blockPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := p.template.Execute(w, struct{ Host string }{host}); err != nil {
+		log.Printf("could not write block page: %s\n", err)
+	}
+}
+
+// newBlockPage parses the block page in file, or the default block page if
+// file is empty
+func newBlockPage(file string) (*blockPage, error) {
+	var (
+		t   *template.Template
+		err error
+	)
+	if file == "" {
+		t, err = template.New("blockpage").Parse(defaultBlockPage)
+	} else {
+		t, err = template.ParseFiles(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockPage{template: t}, nil
+}
+
+// StartBlockPageServer launches the http listener of the block page, the
+// returned server is nil if blockpagebind is empty and is shut down to stop
+// it otherwise
+func StartBlockPageServer() (*http.Server, error) {
+	if Config().BlockPageBind == "" {
+		return nil, nil
+	}
+
+	page, err := newBlockPage(Config().BlockPageFile)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", Config().BlockPageBind)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: page}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("block page server failed: %s\n", err)
+		}
+	}()
+
+	log.Println("block page server listening on", Config().BlockPageBind)
+
+	return server, nil
+}
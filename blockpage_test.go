@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlockPage(t *testing.T) {
+	page, err := newBlockPage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	page.ServeHTTP(w, httptest.NewRequest("GET", "http://ads.example.com:8080/banner.gif", nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "ads.example.com is blocked") {
+		t.Errorf("expected the default block page for ads.example.com, got %d %q", w.Code, w.Body.String())
+	}
+
+	file := filepath.Join(t.TempDir(), "blocked.html")
+	if err := ioutil.WriteFile(file, []byte("<p>no {{.Host}} here</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if page, err = newBlockPage(file); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	page.ServeHTTP(w, httptest.NewRequest("GET", "http://<b>tracker.example.net/", nil))
+	if body := w.Body.String(); body != "<p>no &lt;b&gt;tracker.example.net here</p>" {
+		t.Errorf("expected the escaped host in the block page file, got %q", body)
+	}
+}
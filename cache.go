@@ -1,12 +1,19 @@
 package main
 
 import (
+	"container/list"
 	"crypto/md5"
 	"fmt"
+	"net"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
 // KeyNotFound type
@@ -50,7 +57,9 @@ func (e SerializerError) Error() string {
 // Mesg represents a cache entry
 type Mesg struct {
 	Msg    *dns.Msg
+	Stored time.Time
 	Expire time.Time
+	Hits   int
 }
 
 // Cache interface
@@ -59,20 +68,116 @@ type Cache interface {
 	Set(key string, Msg *dns.Msg) error
 	Exists(key string) bool
 	Remove(key string)
+	RemoveMatching(match func(key string) bool) int
+	Flush() int
 	Length() int
 }
 
-// MemoryCache type
+// MemoryCache type, entries live for the smallest TTL of their answer clamped
+// to MinTTL and MaxTTL, negative answers live for the negative TTL of their
+// SOA record and other entries without an answer live for Expire, unless
+// Lifetime is set, then every entry lives for Lifetime. Once Maxcount is
+// reached an entry that wasn't looked up recently is evicted.
+//
+// The entries are spread over Shards maps by the hash of their key, lookups
+// only take the read lock of one shard so that concurrent lookups don't wait
+// for each other. Writes take mu, which guards the recency list the entries
+// are evicted from, as well as the lock of the shard, so the shards only
+// change while mu is held.
+//
+// An entry that was hit at least PrefetchMinHits times is handed to Prefetch
+// once PrefetchThreshold of its lifetime has passed, so that it can be
+// refreshed before it expires.
+//
+// Expired entries are kept for StaleWindow, GetStale returns them when the
+// nameservers can't be reached and hands them to Prefetch to be refreshed.
 type MemoryCache struct {
-	Backend  map[string]Mesg
-	Expire   time.Duration
-	Maxcount int
-	mu       sync.RWMutex
+	// the counters come first so that they are 64-bit aligned for atomic
+	// access on 32-bit platforms
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	length    int64
+
+	Expire      time.Duration
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	Lifetime    time.Duration
+	StaleWindow time.Duration
+	Maxcount    int
+	Shards      int
+	mu          sync.Mutex
+
+	Prefetch          PrefetchFunc
+	PrefetchThreshold float64
+	PrefetchMinHits   int
+
+	shards []*cacheShard
+	once   sync.Once
+
+	// recency orders the entries from the most recently inserted to the
+	// least, entries that were looked up since get a second chance when they
+	// reach the back
+	recency *list.List
+
+	// prefetching holds the keys that are being refreshed
+	prefetching map[string]bool
+	prefetchMu  sync.Mutex
+}
+
+// cacheShards is the number of shards of a MemoryCache without Shards
+const cacheShards = 16
+
+// cacheShard holds the entries of a MemoryCache whose keys hash to it
+type cacheShard struct {
+	entries map[string]*cacheEntry
+	mu      sync.RWMutex
+}
+
+// cacheEntry is an entry of a MemoryCache, mesg is never changed once the
+// entry is in a shard, a new entry replaces it instead. hits and referenced
+// are changed by lookups with atomic operations, element by writes holding
+// the lock of the cache.
+type cacheEntry struct {
+	hits       int64
+	referenced int32
+	key        string
+	mesg       Mesg
+	element    *list.Element
+}
+
+// CacheStats counts the lookups and evictions of a MemoryCache
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
 }
 
-// MemoryBlockCache type
+// minCachedTTL is the lowest TTL a cached record with a TTL is handed out
+// with, clients would otherwise be told not to cache the last second of it
+const minCachedTTL = 1
+
+// PrefetchFunc refreshes the cache entry of key, msg is the cached answer and
+// must not be modified
+type PrefetchFunc func(key string, msg *dns.Msg)
+
+// MemoryBlockCache type, entries written as *.example.com are kept in
+// Wildcards and match every subdomain of example.com but not example.com itself
 type MemoryBlockCache struct {
-	Backend map[string]bool
+	Backend   map[string]bool
+	Wildcards map[string]bool
+	mu        sync.RWMutex
+}
+
+// MemoryRegexBlockCache type
+type MemoryRegexBlockCache struct {
+	Backend []*regexp.Regexp
+	mu      sync.RWMutex
+}
+
+// MemoryHostsCache type, holds the addresses that hosts files point domains at
+type MemoryHostsCache struct {
+	Backend map[string][]net.IP
 	mu      sync.RWMutex
 }
 
@@ -80,62 +185,451 @@ type MemoryBlockCache struct {
 type MemoryQuestionCache struct {
 	Backend  []QuestionCacheEntry `json:"entry"`
 	Maxcount int
-	mu       sync.RWMutex
+	// Backend is a ring buffer once it holds Maxcount entries, next is the
+	// index of the oldest entry, which the next entry overwrites
+	next int
+	mu   sync.RWMutex
 }
 
-// Get returns the entry for a key or an error
+// init creates the shards and the recency list on first use, so that the
+// zero value of the cache can be used
+func (c *MemoryCache) init() {
+	c.once.Do(func() {
+		n := c.Shards
+		if n <= 0 {
+			n = cacheShards
+		}
+		c.shards = make([]*cacheShard, n)
+		for i := range c.shards {
+			c.shards[i] = &cacheShard{entries: make(map[string]*cacheEntry)}
+		}
+		c.recency = list.New()
+	})
+}
+
+// shard returns the shard of a key
+func (c *MemoryCache) shard(key string) *cacheShard {
+	c.init()
+	return c.shards[fnv1a(key)%uint32(len(c.shards))]
+}
+
+// fnv1a returns the FNV-1a hash of a key, which spreads keys over shards
+func fnv1a(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// lookup returns the entry of a key
+func (c *MemoryCache) lookup(key string) (*cacheEntry, bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	e, ok := s.entries[key]
+	s.mu.RUnlock()
+	return e, ok
+}
+
+// entry returns the cached Mesg of a key with its hits
+func (c *MemoryCache) entry(key string) (Mesg, bool) {
+	e, ok := c.lookup(key)
+	if !ok {
+		return Mesg{}, false
+	}
+
+	mesg := e.mesg
+	mesg.Hits = int(atomic.LoadInt64(&e.hits))
+	return mesg, true
+}
+
+// Get returns the entry for a key or an error, entries that were set without
+// a message return a nil message
 func (c *MemoryCache) Get(key string) (*dns.Msg, error) {
-	c.mu.RLock()
-	mesg, ok := c.Backend[key]
-	c.mu.RUnlock()
+	now := time.Now()
 
+	e, ok := c.lookup(key)
 	if !ok {
+		atomic.AddUint64(&c.misses, 1)
 		return nil, KeyNotFound{key}
 	}
 
-	if mesg.Expire.Before(time.Now()) {
-		c.Remove(key)
+	mesg := e.mesg
+	if mesg.Expire.Before(now) {
+		atomic.AddUint64(&c.misses, 1)
+		if !now.Before(mesg.Expire.Add(c.StaleWindow)) {
+			c.Remove(key)
+		}
 		return nil, KeyExpired{key}
 	}
 
-	return mesg.Msg, nil
+	// the flag is only written when it changes, so that lookups of a popular
+	// entry don't fight over its cache line
+	if atomic.LoadInt32(&e.referenced) == 0 {
+		atomic.StoreInt32(&e.referenced, 1)
+	}
+	mesg.Hits = int(atomic.AddInt64(&e.hits, 1))
+	c.prefetch(key, mesg, now)
+
+	atomic.AddUint64(&c.hits, 1)
+
+	if mesg.Msg == nil {
+		return nil, nil
+	}
+
+	// hand out a copy with the time spent in the cache taken off the TTLs,
+	// records that were cached with a TTL of 0 keep it
+	elapsed := uint32(now.Sub(mesg.Stored) / time.Second)
+	msg := mesg.Msg.Copy()
+	for _, rr := range rrs(msg) {
+		switch hdr := rr.Header(); {
+		case hdr.Ttl > elapsed+minCachedTTL:
+			hdr.Ttl -= elapsed
+		case hdr.Ttl > 0:
+			hdr.Ttl = minCachedTTL
+		}
+	}
+
+	return msg, nil
 }
 
-// Set sets a keys value to a Mesg
-func (c *MemoryCache) Set(key string, msg *dns.Msg) error {
-	if c.Full() && !c.Exists(key) {
-		return CacheIsFull{}
+// staleTTL is the TTL of the records of stale answers, RFC 8767 recommends 30
+// seconds
+const staleTTL = 30
+
+// GetStale returns an entry that expired less than StaleWindow ago, with the
+// TTLs of its records set to staleTTL, and has Prefetch refresh it. ok is
+// false if there is no such entry.
+func (c *MemoryCache) GetStale(key string) (msg *dns.Msg, ok bool) {
+	now := time.Now()
+
+	mesg, found := c.entry(key)
+	if !found || mesg.Msg == nil || !mesg.Expire.Before(now) || !now.Before(mesg.Expire.Add(c.StaleWindow)) {
+		return nil, false
 	}
+	c.refresh(key, mesg)
+
+	msg = mesg.Msg.Copy()
+	for _, rr := range rrs(msg) {
+		rr.Header().Ttl = staleTTL
+	}
+
+	return msg, true
+}
 
-	expire := time.Now().Add(c.Expire)
-	mesg := Mesg{msg, expire}
+// Set sets a keys value to a Mesg, evicting an entry if the cache is full
+func (c *MemoryCache) Set(key string, msg *dns.Msg) error {
+	msg = c.clamp(negativeSOA(normalizeEdns(msg)))
+
+	now := time.Now()
+	mesg := Mesg{Msg: msg, Stored: now, Expire: now.Add(c.lifetime(msg))}
 	c.mu.Lock()
-	c.Backend[key] = mesg
+	c.insert(key, mesg)
 	c.mu.Unlock()
 
 	return nil
 }
 
+// prefetch starts a refresh of a popular entry that is about to expire, at
+// most one refresh runs per key
+func (c *MemoryCache) prefetch(key string, mesg Mesg, now time.Time) {
+	if c.Prefetch == nil || c.PrefetchThreshold <= 0 || mesg.Msg == nil || mesg.Hits < c.PrefetchMinHits {
+		return
+	}
+
+	lifetime := mesg.Expire.Sub(mesg.Stored)
+	if now.Sub(mesg.Stored) < time.Duration(float64(lifetime)*c.PrefetchThreshold) {
+		return
+	}
+
+	c.refresh(key, mesg)
+}
+
+// refresh hands an entry to Prefetch, unless a refresh of the entry is still
+// running
+func (c *MemoryCache) refresh(key string, mesg Mesg) {
+	if c.Prefetch == nil {
+		return
+	}
+
+	c.prefetchMu.Lock()
+	defer c.prefetchMu.Unlock()
+
+	if c.prefetching[key] {
+		return
+	}
+	if c.prefetching == nil {
+		c.prefetching = make(map[string]bool)
+	}
+	c.prefetching[key] = true
+
+	go func() {
+		c.Prefetch(key, mesg.Msg)
+
+		c.prefetchMu.Lock()
+		delete(c.prefetching, key)
+		c.prefetchMu.Unlock()
+	}()
+}
+
+// insert adds or replaces an entry and moves it to the front of the recency
+// list, the caller must hold the lock
+func (c *MemoryCache) insert(key string, mesg Mesg) {
+	s := c.shard(key)
+	e := &cacheEntry{key: key, mesg: mesg}
+
+	if old, ok := s.entries[key]; ok {
+		e.element = old.element
+		e.element.Value = e
+		c.recency.MoveToFront(e.element)
+	} else {
+		for c.Maxcount != 0 && atomic.LoadInt64(&c.length) >= int64(c.Maxcount) && c.recency.Len() > 0 {
+			c.evict()
+		}
+		e.element = c.recency.PushFront(e)
+		atomic.AddInt64(&c.length, 1)
+	}
+
+	s.mu.Lock()
+	s.entries[key] = e
+	s.mu.Unlock()
+}
+
+// evict removes the entry at the back of the recency list, entries that were
+// looked up since they were inserted are moved to the front instead, which
+// approximates evicting the least recently used entry. The caller must hold
+// the lock.
+func (c *MemoryCache) evict() {
+	for {
+		e := c.recency.Back().Value.(*cacheEntry)
+		if atomic.SwapInt32(&e.referenced, 0) == 0 {
+			c.delete(e)
+			atomic.AddUint64(&c.evictions, 1)
+			return
+		}
+		c.recency.MoveToFront(e.element)
+	}
+}
+
+// delete removes an entry from its shard and the recency list, the caller
+// must hold the lock
+func (c *MemoryCache) delete(e *cacheEntry) {
+	s := c.shard(e.key)
+	s.mu.Lock()
+	delete(s.entries, e.key)
+	s.mu.Unlock()
+
+	c.recency.Remove(e.element)
+	atomic.AddInt64(&c.length, -1)
+}
+
+// clamp returns the message with the TTLs of its records moved within MinTTL
+// and MaxTTL, so that the TTLs handed out by Get count down to zero when the
+// entry expires. The message is copied before it is changed.
+func (c *MemoryCache) clamp(msg *dns.Msg) *dns.Msg {
+	if msg == nil {
+		return nil
+	}
+
+	min, max := uint32(c.MinTTL/time.Second), uint32(c.MaxTTL/time.Second)
+	outside := func(ttl uint32) bool {
+		return ttl < min || (max > 0 && ttl > max)
+	}
+
+	clamped := msg
+	for _, rr := range rrs(msg) {
+		if outside(rr.Header().Ttl) {
+			clamped = msg.Copy()
+			break
+		}
+	}
+	if clamped == msg {
+		return msg
+	}
+
+	for _, rr := range rrs(clamped) {
+		if ttl := rr.Header().Ttl; ttl < min {
+			rr.Header().Ttl = min
+		} else if outside(ttl) {
+			rr.Header().Ttl = max
+		}
+	}
+
+	return clamped
+}
+
+// negativeSOA returns the message with the TTL of the SOA record of a
+// negative answer lowered to the SOA minimum, RFC 2308 caches negative answers
+// for the lower of the two. The message is copied before it is changed.
+func negativeSOA(msg *dns.Msg) *dns.Msg {
+	if msg == nil || len(msg.Answer) > 0 {
+		return msg
+	}
+
+	for i, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < soa.Hdr.Ttl {
+			msg = msg.Copy()
+			msg.Ns[i].Header().Ttl = soa.Minttl
+			break
+		}
+	}
+
+	return msg
+}
+
+// negativeTTL returns the TTL of the SOA record of a negative answer
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
+
+// rrs returns the records of all sections of a message, except for the OPT
+// record which has no TTL
+func rrs(msg *dns.Msg) []dns.RR {
+	var all []dns.RR
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				all = append(all, rr)
+			}
+		}
+	}
+	return all
+}
+
+// lifetime returns how long a message may be cached for
+func (c *MemoryCache) lifetime(msg *dns.Msg) time.Duration {
+	if c.Lifetime > 0 {
+		return c.Lifetime
+	}
+	if msg == nil {
+		return c.Expire
+	}
+
+	var ttl uint32
+	if len(msg.Answer) == 0 {
+		negative, ok := negativeTTL(msg)
+		if !ok {
+			return c.Expire
+		}
+		ttl = negative
+	} else {
+		ttl = msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d < c.MinTTL {
+		d = c.MinTTL
+	}
+	if c.MaxTTL > 0 && d > c.MaxTTL {
+		d = c.MaxTTL
+	}
+
+	return d
+}
+
 // Remove removes an entry from the cache
 func (c *MemoryCache) Remove(key string) {
 	c.mu.Lock()
-	delete(c.Backend, key)
+	if e, ok := c.shard(key).entries[key]; ok {
+		c.delete(e)
+	}
 	c.mu.Unlock()
 }
 
+// RemovePrefix removes the entries with a key that starts with prefix, which
+// includes the entries for every client subnet of a key, and returns how many
+// were removed
+func (c *MemoryCache) RemovePrefix(prefix string) int {
+	return c.RemoveMatching(func(key string) bool { return strings.HasPrefix(key, prefix) })
+}
+
+// RemoveMatching removes the entries with a key that match reports true for
+// in a single pass over the cache, and returns how many were removed
+func (c *MemoryCache) RemoveMatching(match func(key string) bool) int {
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var matches []*cacheEntry
+	for e := c.recency.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cacheEntry); match(entry.key) {
+			matches = append(matches, entry)
+		}
+	}
+	for _, e := range matches {
+		c.delete(e)
+	}
+
+	return len(matches)
+}
+
+// Flush removes all entries from the cache and returns how many were removed
+func (c *MemoryCache) Flush() int {
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := c.Length()
+	for e := c.recency.Front(); e != nil; {
+		next := e.Next()
+		c.delete(e.Value.(*cacheEntry))
+		e = next
+	}
+
+	return removed
+}
+
 // Exists returns whether or not a key exists in the cache
 func (c *MemoryCache) Exists(key string) bool {
-	c.mu.RLock()
-	_, ok := c.Backend[key]
-	c.mu.RUnlock()
+	_, ok := c.lookup(key)
 	return ok
 }
 
 // Length returns the caches length
 func (c *MemoryCache) Length() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return len(c.Backend)
+	return int(atomic.LoadInt64(&c.length))
+}
+
+// entries returns a copy of every entry of the cache by key
+func (c *MemoryCache) entries() map[string]Mesg {
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make(map[string]Mesg, c.Length())
+	for e := c.recency.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*cacheEntry)
+		entries[entry.key] = entry.mesg
+	}
+	return entries
+}
+
+// Stats returns the counters of the cache, reset starts them over from zero
+func (c *MemoryCache) Stats(reset bool) CacheStats {
+	if reset {
+		return CacheStats{
+			Hits:      atomic.SwapUint64(&c.hits, 0),
+			Misses:    atomic.SwapUint64(&c.misses, 0),
+			Evictions: atomic.SwapUint64(&c.evictions, 0),
+		}
+	}
+
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
 }
 
 // Full returns whether or not the cache is full
@@ -146,17 +640,50 @@ func (c *MemoryCache) Full() bool {
 	return c.Length() >= c.Maxcount
 }
 
-// KeyGen generates a key for the hash from a question
+// keyGenLen is the length of the keys of KeyGen, which the keys of the caches
+// start with
+const keyGenLen = 2 * md5.Size
+
+// KeyGen generates a key for the hash from the name, class and type of a
+// question, so that the answers for the types of a name are kept apart. The
+// fields are separated by a space, which a name can't contain, and are
+// hashed in the order of Question.String so that persisted keys stay valid.
 func KeyGen(q Question) string {
 	h := md5.New()
-	h.Write([]byte(q.String()))
+	h.Write([]byte(q.Qname + " " + q.Qclass + " " + q.Qtype))
 	x := h.Sum(nil)
 	key := fmt.Sprintf("%x", x)
 	return key
 }
 
+// normalizeDomain returns a domain in the form it's matched in, in lowercase
+// with internationalized labels in punycode, names that aren't valid IDNs are
+// only lowercased
+func normalizeDomain(domain string) string {
+	upper := false
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if c >= utf8.RuneSelf {
+			if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+				return ascii
+			}
+			return strings.ToLower(domain)
+		}
+		if 'A' <= c && c <= 'Z' {
+			upper = true
+		}
+	}
+
+	if upper {
+		return strings.ToLower(domain)
+	}
+	return domain
+}
+
 // Get returns the entry for a key or an error
 func (c *MemoryBlockCache) Get(key string) (bool, error) {
+	key = normalizeDomain(key)
+
 	c.mu.RLock()
 	val, ok := c.Backend[key]
 	c.mu.RUnlock()
@@ -168,44 +695,274 @@ func (c *MemoryBlockCache) Get(key string) (bool, error) {
 	return val, nil
 }
 
-// Set sets a value in the BlockCache
+// Set sets a value in the BlockCache, keys of the BlockCache are normalized
+// so that they match whatever the case or encoding of a domain
 func (c *MemoryBlockCache) Set(key string, value bool) error {
 	c.mu.Lock()
-	c.Backend[key] = value
+	if strings.HasPrefix(key, "*.") {
+		if c.Wildcards == nil {
+			c.Wildcards = make(map[string]bool)
+		}
+		c.Wildcards[normalizeDomain(key[2:])] = value
+	} else {
+		c.Backend[normalizeDomain(key)] = value
+	}
 	c.mu.Unlock()
 
 	return nil
 }
 
+// Remove removes an entry from the BlockCache
+func (c *MemoryBlockCache) Remove(key string) {
+	c.mu.Lock()
+	if strings.HasPrefix(key, "*.") {
+		delete(c.Wildcards, normalizeDomain(key[2:]))
+	} else {
+		delete(c.Backend, normalizeDomain(key))
+	}
+	c.mu.Unlock()
+}
+
+// Replace swaps the entries of the cache for those of other
+func (c *MemoryBlockCache) Replace(other *MemoryBlockCache) {
+	c.mu.Lock()
+	c.Backend, c.Wildcards = other.Backend, other.Wildcards
+	c.mu.Unlock()
+}
+
+// MatchWildcard returns whether or not a parent domain of key has a wildcard
+// entry in the cache
+func (c *MemoryBlockCache) MatchWildcard(key string) bool {
+	key = normalizeDomain(key)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.Wildcards) == 0 {
+		return false
+	}
+
+	// strip a label at a time, starting with the parent so the apex of a
+	// wildcard entry never matches the entry itself
+	for i := strings.IndexByte(key, '.'); i >= 0; i = strings.IndexByte(key, '.') {
+		key = key[i+1:]
+		if c.Wildcards[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Exists returns whether or not a key exists in the cache
 func (c *MemoryBlockCache) Exists(key string) bool {
+	key = normalizeDomain(key)
+
 	c.mu.RLock()
 	_, ok := c.Backend[key]
 	c.mu.RUnlock()
 	return ok
 }
 
+// Match returns whether or not key exists in the cache or a parent domain of
+// key has a wildcard entry
+func (c *MemoryBlockCache) Match(key string) bool {
+	return c.Exists(key) || c.MatchWildcard(key)
+}
+
+// Has returns whether or not the cache has an entry, which is written as
+// *.example.com for a wildcard entry like it's set
+func (c *MemoryBlockCache) Has(key string) bool {
+	if !strings.HasPrefix(key, "*.") {
+		return c.Exists(key)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Wildcards[normalizeDomain(key[2:])]
+}
+
+// Items returns a copy of the entries of the cache, which unlike Backend can
+// be read while the cache is changed, wildcard entries are written as
+// *.example.com like they are set
+func (c *MemoryBlockCache) Items() map[string]bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	items := make(map[string]bool, len(c.Backend)+len(c.Wildcards))
+	for key, value := range c.Backend {
+		items[key] = value
+	}
+	for key := range c.Wildcards {
+		items["*."+key] = true
+	}
+
+	return items
+}
+
+// Keys returns all entries of the cache, wildcard entries are written as
+// *.example.com like they are set
+func (c *MemoryBlockCache) Keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(c.Backend)+len(c.Wildcards))
+	for key := range c.Backend {
+		keys = append(keys, key)
+	}
+	for key := range c.Wildcards {
+		keys = append(keys, "*."+key)
+	}
+
+	return keys
+}
+
+// Add adds an address of a domain
+func (c *MemoryHostsCache) Add(domain string, ip net.IP) {
+	domain = strings.ToLower(domain)
+
+	c.mu.Lock()
+	for _, existing := range c.Backend[domain] {
+		if existing.Equal(ip) {
+			c.mu.Unlock()
+			return
+		}
+	}
+	c.Backend[domain] = append(c.Backend[domain], ip)
+	c.mu.Unlock()
+}
+
+// Get returns the addresses of a domain
+func (c *MemoryHostsCache) Get(domain string) ([]net.IP, bool) {
+	c.mu.RLock()
+	ips, ok := c.Backend[strings.ToLower(domain)]
+	c.mu.RUnlock()
+	return ips, ok
+}
+
+// Replace swaps in the addresses of a rebuild
+func (c *MemoryHostsCache) Replace(other *MemoryHostsCache) {
+	c.mu.Lock()
+	c.Backend = other.Backend
+	c.mu.Unlock()
+}
+
+// Length returns the number of domains with addresses
+func (c *MemoryHostsCache) Length() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.Backend)
+}
+
 // Length returns the caches length
 func (c *MemoryBlockCache) Length() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.Backend) + len(c.Wildcards)
+}
+
+// Add adds a compiled pattern to the RegexBlockCache
+func (c *MemoryRegexBlockCache) Add(re *regexp.Regexp) {
+	c.mu.Lock()
+	c.Backend = append(c.Backend, re)
+	c.mu.Unlock()
+}
+
+// Replace swaps the patterns of the cache for those of other
+func (c *MemoryRegexBlockCache) Replace(other *MemoryRegexBlockCache) {
+	c.mu.Lock()
+	c.Backend = other.Backend
+	c.mu.Unlock()
+}
+
+// Match returns whether or not any pattern matches the key
+func (c *MemoryRegexBlockCache) Match(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, re := range c.Backend {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Length returns the caches length
+func (c *MemoryRegexBlockCache) Length() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return len(c.Backend)
 }
 
-// Add adds a question to the cache
+// Add adds a question to the cache, replacing the oldest question once the
+// cache holds Maxcount of them
 func (c *MemoryQuestionCache) Add(q QuestionCacheEntry) {
 	c.mu.Lock()
-	if c.Maxcount != 0 && len(c.Backend) >= c.Maxcount {
-		c.Backend = nil
+	if c.Maxcount == 0 || len(c.Backend) < c.Maxcount {
+		c.Backend = append(c.Backend, q)
+	} else {
+		c.Backend[c.next] = q
+		c.next = (c.next + 1) % len(c.Backend)
 	}
-	c.Backend = append(c.Backend, q)
 	c.mu.Unlock()
 }
 
+// SetMaxcount changes the number of questions the cache holds, dropping the
+// oldest ones if it holds more than that
+func (c *MemoryQuestionCache) SetMaxcount(maxcount int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.entries()
+	if maxcount != 0 && len(entries) > maxcount {
+		entries = entries[len(entries)-maxcount:]
+	}
+	c.Backend, c.next, c.Maxcount = entries, 0, maxcount
+}
+
+// Entries returns a copy of the questions in the cache from the oldest to the
+// newest
+func (c *MemoryQuestionCache) Entries() []QuestionCacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries()
+}
+
+// entries returns a copy of the questions in the cache in order, the caller
+// must hold the lock
+func (c *MemoryQuestionCache) entries() []QuestionCacheEntry {
+	entries := make([]QuestionCacheEntry, 0, len(c.Backend))
+	entries = append(entries, c.Backend[c.next:]...)
+	return append(entries, c.Backend[:c.next]...)
+}
+
+// Query returns the entries accepted by filter, skipping the first offset
+// matches and returning at most limit of them, or all of them if limit is 0,
+// along with the total number of matches
+func (c *MemoryQuestionCache) Query(offset, limit int, filter func(QuestionCacheEntry) bool) ([]QuestionCacheEntry, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := []QuestionCacheEntry{}
+	total := 0
+	for i := range c.Backend {
+		entry := c.Backend[(c.next+i)%len(c.Backend)]
+		if filter != nil && !filter(entry) {
+			continue
+		}
+		if total >= offset && (limit == 0 || len(entries) < limit) {
+			entries = append(entries, entry)
+		}
+		total++
+	}
+
+	return entries, total
+}
+
 // Clear clears the contents of the cache
 func (c *MemoryQuestionCache) Clear() {
 	c.mu.Lock()
-	c.Backend = nil
+	c.Backend, c.next = nil, 0
 	c.mu.Unlock()
 }
 
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,13 +16,13 @@ func TestCache(t *testing.T) {
 	)
 
 	cache := &MemoryCache{
-		Backend:  make(map[string]Mesg, Config.Maxcount),
-		Expire:   time.Duration(Config.Expire) * time.Second,
-		Maxcount: Config.Maxcount,
+		Expire:   time.Duration(Config().Expire) * time.Second,
+		Maxcount: Config().Maxcount,
 	}
 
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, testRR(testDomain, 300))
 
 	if err := cache.Set(testDomain, m); err != nil {
 		t.Error(err)
@@ -37,6 +39,398 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestCacheTTL(t *testing.T) {
+	const (
+		testDomain = "www.google.com"
+	)
+
+	cache := &MemoryCache{
+		Expire: 600 * time.Second,
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, testRR(testDomain, 300), testRR(testDomain, 30))
+
+	if err := cache.Set(testDomain, m); err != nil {
+		t.Fatal(err)
+	}
+
+	mesg, _ := cache.entry(testDomain)
+	if lifetime := mesg.Expire.Sub(mesg.Stored); lifetime != 30*time.Second {
+		t.Errorf("expected entry to live for the smallest ttl, got %s", lifetime)
+	}
+
+	// pretend the entry was stored ten seconds ago
+	mesg.Stored = mesg.Stored.Add(-10 * time.Second)
+	mesg.Expire = mesg.Expire.Add(-10 * time.Second)
+	setTestEntry(cache, testDomain, mesg)
+
+	msg, err := cache.Get(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 290 {
+		t.Errorf("expected ttl to count down to 290, got %d", ttl)
+	}
+	if ttl := msg.Answer[1].Header().Ttl; ttl != 20 {
+		t.Errorf("expected ttl to count down to 20, got %d", ttl)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("cached message was modified, ttl is %d", ttl)
+	}
+
+	// records that outlive their TTL until the entry expires are floored
+	mesg, _ = cache.entry(testDomain)
+	mesg.Stored = mesg.Stored.Add(-25 * time.Second)
+	setTestEntry(cache, testDomain, mesg)
+
+	if msg, err = cache.Get(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := msg.Answer[1].Header().Ttl; ttl != minCachedTTL {
+		t.Errorf("expected ttl to be floored at %d, got %d", minCachedTTL, ttl)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	cache := &MemoryCache{
+		Expire: 600 * time.Second,
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("missing.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 300,
+	})
+
+	if err := cache.Set("missing", m); err != nil {
+		t.Fatal(err)
+	}
+
+	mesg, _ := cache.entry("missing")
+	if lifetime := mesg.Expire.Sub(mesg.Stored); lifetime != 300*time.Second {
+		t.Errorf("expected negative answer to live for the SOA minimum, got %s", lifetime)
+	}
+
+	msg, err := cache.Get("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		t.Errorf("expected the cached rcode to be NXDOMAIN, got %s", dns.RcodeToString[msg.Rcode])
+	}
+	if ttl := msg.Ns[0].Header().Ttl; ttl != 300 {
+		t.Errorf("expected the SOA ttl to be lowered to 300, got %d", ttl)
+	}
+	if ttl := m.Ns[0].Header().Ttl; ttl != 3600 {
+		t.Errorf("cached message was modified, ttl is %d", ttl)
+	}
+
+	// failures without a message are still cached for Expire
+	if err := cache.Set("failed", nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := cache.Get("failed"); err != nil || msg != nil {
+		t.Errorf("expected a nil message for a failure, got %v, %v", msg, err)
+	}
+	mesg, _ = cache.entry("failed")
+	if lifetime := mesg.Expire.Sub(mesg.Stored); lifetime != 600*time.Second {
+		t.Errorf("expected failure to live for expire, got %s", lifetime)
+	}
+}
+
+func TestCacheTTLClamp(t *testing.T) {
+	cache := &MemoryCache{
+		Expire: 600 * time.Second,
+		MinTTL: 60 * time.Second,
+		MaxTTL: 3600 * time.Second,
+	}
+
+	tests := []struct {
+		name     string
+		ttl      uint32
+		expected uint32
+	}{
+		{"below.example.com", 1, 60},
+		{"above.example.com", 86400, 3600},
+		{"within.example.com", 300, 300},
+	}
+
+	for _, test := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(test.name), dns.TypeA)
+		m.Answer = append(m.Answer, testRR(test.name, test.ttl))
+
+		if err := cache.Set(test.name, m); err != nil {
+			t.Fatal(err)
+		}
+
+		mesg, _ := cache.entry(test.name)
+		if lifetime := mesg.Expire.Sub(mesg.Stored); lifetime != time.Duration(test.expected)*time.Second {
+			t.Errorf("%s: expected entry to live for %ds, got %s", test.name, test.expected, lifetime)
+		}
+		if ttl := m.Answer[0].Header().Ttl; ttl != test.ttl {
+			t.Errorf("%s: cached message was modified, ttl is %d", test.name, ttl)
+		}
+
+		// pretend the entry was stored ten seconds ago, the ttl handed out
+		// counts down from the clamped ttl
+		mesg.Stored = mesg.Stored.Add(-10 * time.Second)
+		mesg.Expire = mesg.Expire.Add(-10 * time.Second)
+		setTestEntry(cache, test.name, mesg)
+
+		msg, err := cache.Get(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := msg.Answer[0].Header().Ttl; ttl != test.expected-10 {
+			t.Errorf("%s: expected ttl to count down to %d, got %d", test.name, test.expected-10, ttl)
+		}
+	}
+}
+
+func TestCacheNormalizeEdns(t *testing.T) {
+	cache := &MemoryCache{Expire: 600 * time.Second}
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, testRR(testDomain, 300))
+	m.SetEdns0(1232, true)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}, subnet, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+
+	if err := cache.Set(testDomain, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(opt.Option) != 3 || opt.UDPSize() != 1232 {
+		t.Error("cached message was modified")
+	}
+
+	msg, err := cache.Get(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := msg.IsEdns0()
+	if cached == nil || !cached.Do() {
+		t.Fatalf("expected the OPT record to be kept, got %v", msg.Extra)
+	}
+	if len(cached.Option) != 1 || cached.Option[0].Option() != dns.EDNS0SUBNET {
+		t.Errorf("expected only the client subnet to be kept, got %v", cached.Option)
+	}
+	if cached.UDPSize() != dns.DefaultMsgSize {
+		t.Errorf("expected the default buffer size, got %d", cached.UDPSize())
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	const (
+		testDomain = "www.google.com"
+	)
+
+	prefetched := make(chan string, 10)
+	release := make(chan struct{})
+
+	cache := &MemoryCache{
+		Expire:            600 * time.Second,
+		PrefetchThreshold: 0.9,
+		PrefetchMinHits:   3,
+		Prefetch: func(key string, msg *dns.Msg) {
+			prefetched <- key
+			<-release
+		},
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, testRR(testDomain, 100))
+
+	if err := cache.Set(testDomain, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend the entry was stored 95 seconds ago
+	mesg, _ := cache.entry(testDomain)
+	mesg.Stored = mesg.Stored.Add(-95 * time.Second)
+	mesg.Expire = mesg.Expire.Add(-95 * time.Second)
+	setTestEntry(cache, testDomain, mesg)
+
+	for i := 0; i < 2; i++ {
+		cache.Get(testDomain)
+	}
+	select {
+	case <-prefetched:
+		t.Fatal("entry was prefetched before reaching the minimum hits")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// only one refresh may run at a time
+	for i := 0; i < 5; i++ {
+		cache.Get(testDomain)
+	}
+	if key := <-prefetched; key != testDomain {
+		t.Errorf("expected %s to be prefetched, got %s", testDomain, key)
+	}
+	select {
+	case <-prefetched:
+		t.Error("entry was prefetched while a refresh was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := &MemoryCache{
+		Expire:   600 * time.Second,
+		Maxcount: 2,
+	}
+
+	m := new(dns.Msg)
+	cache.Set("a", m)
+	cache.Set("b", m)
+
+	// touch a so that b becomes the least recently used entry
+	if _, err := cache.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Set("c", m)
+
+	if cache.Length() != 2 {
+		t.Errorf("expected cache to hold 2 entries, got %d", cache.Length())
+	}
+	if cache.Exists("b") {
+		t.Error("least recently used entry was not evicted")
+	}
+	if !cache.Exists("a") || !cache.Exists("c") {
+		t.Error("recently used entries were evicted")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	cache := &MemoryCache{Expire: 600 * time.Second, Maxcount: 50}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, testRR(testDomain, 300))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("%d.example.com", (i*1000+j)%100)
+				cache.Set(key, m)
+				cache.Get(key)
+				cache.Exists(key)
+				switch {
+				case j%250 == 0:
+					cache.Flush()
+				case j%50 == 0:
+					cache.RemovePrefix("1")
+				case j%10 == 0:
+					cache.Remove(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if length := cache.Length(); length > 50 || length != len(cache.entries()) {
+		t.Errorf("expected at most 50 entries to be counted, got %d of %d", length, len(cache.entries()))
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	cache := &MemoryCache{
+		Expire:   600 * time.Second,
+		Maxcount: 1,
+	}
+
+	m := new(dns.Msg)
+	cache.Set("a", m)
+	cache.Get("a")
+	cache.Get("b")
+	cache.Set("b", m)
+
+	expected := CacheStats{Hits: 1, Misses: 1, Evictions: 1}
+	if stats := cache.Stats(true); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+	if stats := cache.Stats(false); stats != (CacheStats{}) {
+		t.Errorf("expected the counters to be reset, got %+v", stats)
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	cache := &MemoryCache{
+		Expire: 600 * time.Second,
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.google.com.", dns.TypeA)
+	m.Answer = append(m.Answer, testRR("www.google.com", 300))
+
+	for _, key := range []string{"a", "a/192.0.2.0/24", "a/198.51.100.0/24", "b"} {
+		if err := cache.Set(key, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed := cache.RemovePrefix("a"); removed != 3 {
+		t.Errorf("expected 3 entries to be removed, got %d", removed)
+	}
+	if !cache.Exists("b") {
+		t.Error("entry without the prefix was removed")
+	}
+
+	if removed := cache.Flush(); removed != 1 {
+		t.Errorf("expected 1 entry to be flushed, got %d", removed)
+	}
+	if cache.Length() != 0 {
+		t.Errorf("cache has %d entries after a flush", cache.Length())
+	}
+
+	if err := cache.Set("c", m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get("c"); err != nil {
+		t.Errorf("cache doesn't work after a flush: %s", err)
+	}
+}
+
+func TestKeyGen(t *testing.T) {
+	questions := []Question{
+		{"example.com", "A", "IN"},
+		{"example.com", "AAAA", "IN"},
+		{"example.com", "TXT", "IN"},
+		{"example.com", "A", "CH"},
+		{"www.example.com", "A", "IN"},
+	}
+
+	keys := make(map[string]Question)
+	for _, q := range questions {
+		key := KeyGen(q)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%s and %s have the same key %s", q.String(), other.String(), key)
+		}
+		keys[key] = q
+	}
+
+	// keys must not change between versions, persisted caches use them
+	if key := KeyGen(questions[0]); key != "cda2a637b6f5ee0faf4e170cf9565011" {
+		t.Errorf("key of %s changed to %s", questions[0].String(), key)
+	}
+}
+
 func TestBlockCache(t *testing.T) {
 	const (
 		testDomain = "www.google.com"
@@ -62,3 +456,331 @@ func TestBlockCache(t *testing.T) {
 		t.Error("fuzz existed in block cache")
 	}
 }
+
+func testRR(name string, ttl uint32) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("127.0.0.1"),
+	}
+}
+
+// setTestEntry replaces the entry of a key, so that tests can pretend it was
+// stored a while ago
+func setTestEntry(c *MemoryCache, key string, mesg Mesg) {
+	c.mu.Lock()
+	c.insert(key, mesg)
+	c.mu.Unlock()
+}
+
+func benchmarkCache(maxcount, shards int) (*MemoryCache, []string) {
+	cache := &MemoryCache{
+		Expire:   600 * time.Second,
+		Maxcount: maxcount,
+		Shards:   shards,
+	}
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%d.example.com", i)
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(keys[i]), dns.TypeA)
+		m.Answer = append(m.Answer, testRR(keys[i], 300))
+		cache.Set(keys[i], m)
+	}
+
+	return cache, keys
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	cache, keys := benchmarkCache(0, 0)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cache.Get(keys[i%len(keys)])
+		}
+	})
+}
+
+func BenchmarkCacheSetEvict(b *testing.B) {
+	cache, keys := benchmarkCache(512, 0)
+	m := new(dns.Msg)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cache.Set(keys[i%len(keys)], m)
+		}
+	})
+}
+
+// BenchmarkCacheGetContention compares lookups from a number of goroutines in
+// the cache with a single shard, which is the baseline of one lock for every
+// entry, and in the sharded cache
+func BenchmarkCacheGetContention(b *testing.B) {
+	single, keys := benchmarkCache(0, 1)
+	sharded, _ := benchmarkCache(0, cacheShards)
+
+	caches := []struct {
+		name string
+		get  func(key string)
+	}{
+		{"shards=1", func(key string) { single.Get(key) }},
+		{fmt.Sprintf("shards=%d", cacheShards), func(key string) { sharded.Get(key) }},
+	}
+
+	for _, cache := range caches {
+		for _, goroutines := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", cache.name, goroutines), func(b *testing.B) {
+				var wg sync.WaitGroup
+				for g := 0; g < goroutines; g++ {
+					wg.Add(1)
+					go func(g int) {
+						defer wg.Done()
+						for i := g; i < b.N; i += goroutines {
+							cache.get(keys[i%len(keys)])
+						}
+					}(g)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+func TestBlockCacheWildcard(t *testing.T) {
+	cache := &MemoryBlockCache{
+		Backend: make(map[string]bool),
+	}
+
+	cache.Set("*.doubleclick.net", true)
+
+	if !cache.MatchWildcard("ads.doubleclick.net") {
+		t.Error("subdomain wasn't matched by wildcard")
+	}
+
+	if !cache.MatchWildcard("a.b.doubleclick.net") {
+		t.Error("nested subdomain wasn't matched by wildcard")
+	}
+
+	if cache.MatchWildcard("doubleclick.net") || cache.Exists("doubleclick.net") {
+		t.Error("apex was matched by wildcard")
+	}
+
+	if cache.MatchWildcard("notdoubleclick.net") {
+		t.Error("unrelated domain was matched by wildcard")
+	}
+}
+
+func TestBlockCacheNormalize(t *testing.T) {
+	cache := &MemoryBlockCache{
+		Backend: make(map[string]bool),
+	}
+
+	cache.Set("Ads.Example.COM", true)
+	cache.Set("bücher.example", true)
+	cache.Set("*.Tracker.例え.jp", true)
+
+	for _, domain := range []string{"ads.example.com", "ADS.EXAMPLE.COM", "xn--bcher-kva.example", "BÜCHER.example", "XN--BCHER-KVA.EXAMPLE"} {
+		if !cache.Exists(domain) {
+			t.Errorf("%s doesn't match its normalized entry", domain)
+		}
+	}
+
+	for _, domain := range []string{"www.tracker.例え.jp", "WWW.TRACKER.xn--r8jz45g.jp"} {
+		if !cache.MatchWildcard(domain) {
+			t.Errorf("%s wasn't matched by the normalized wildcard", domain)
+		}
+	}
+
+	cache.Remove("ADS.example.com")
+	if cache.Exists("ads.example.com") {
+		t.Error("entry wasn't removed by a differently cased domain")
+	}
+}
+
+func TestQuestionCacheRing(t *testing.T) {
+	cache := &MemoryQuestionCache{Maxcount: 3}
+	for i := int64(1); i <= 5; i++ {
+		cache.Add(QuestionCacheEntry{Date: i})
+	}
+
+	dates := func(entries []QuestionCacheEntry) []int64 {
+		var dates []int64
+		for _, entry := range entries {
+			dates = append(dates, entry.Date)
+		}
+		return dates
+	}
+
+	if got := dates(cache.Entries()); fmt.Sprint(got) != "[3 4 5]" {
+		t.Errorf("expected the 3 newest questions from the oldest, got %v", got)
+	}
+	if entries, total := cache.Query(1, 1, nil); total != 3 || len(entries) != 1 || entries[0].Date != 4 {
+		t.Errorf("expected the second oldest question, got %v of %d", dates(entries), total)
+	}
+
+	cache.SetMaxcount(2)
+	cache.Add(QuestionCacheEntry{Date: 6})
+	if got := dates(cache.Entries()); fmt.Sprint(got) != "[5 6]" {
+		t.Errorf("expected the 2 newest questions after shrinking, got %v", got)
+	}
+}
+
+func TestQuestionCacheConcurrent(t *testing.T) {
+	cache := &MemoryQuestionCache{Maxcount: 100}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cache.Add(QuestionCacheEntry{Date: int64(j)})
+				if j%100 == 0 {
+					cache.Entries()
+					cache.Query(0, 10, nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cache.Length() != 100 {
+		t.Errorf("expected the cache to hold 100 questions, got %d", cache.Length())
+	}
+}
+
+func TestBlockCacheConcurrent(t *testing.T) {
+	withConfig(t, &config{})
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{"ads.example.com": true}})
+	t.Cleanup(func() { BlockCache.Replace(&MemoryBlockCache{Backend: old}) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		// queries
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				isBlocked(fmt.Sprintf("host%d.example.com", j%10), "")
+				BlockCache.Items()
+			}
+		}()
+
+		// the api and the updater
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				domain := fmt.Sprintf("host%d.example.com", j%10)
+				BlockCache.Set(domain, true)
+				BlockCache.Set("*."+domain, true)
+				BlockCache.Remove(domain)
+				if j%100 == 0 {
+					BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{"ads.example.com": true}})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !BlockCache.Exists("ads.example.com") {
+		t.Error("expected the replaced block cache to be kept")
+	}
+}
+
+func TestQuestionCacheCap(t *testing.T) {
+	old := QuestionCache.Maxcount
+	t.Cleanup(func() {
+		QuestionCache.Clear()
+		QuestionCache.SetMaxcount(old)
+	})
+
+	QuestionCache.Clear()
+	for i := int64(1); i <= 3; i++ {
+		QuestionCache.Add(QuestionCacheEntry{Date: i})
+	}
+
+	withConfig(t, &config{QuestionCacheCap: 2})
+	resizeQuestionCache()
+	if QuestionCache.Length() != 2 {
+		t.Errorf("expected the question cache to be trimmed to 2 questions, got %d", QuestionCache.Length())
+	}
+
+	withConfig(t, &config{QuestionCacheCap: 0})
+	resizeQuestionCache()
+	logQuestion(net.ParseIP("192.168.1.10"), Question{testDomain, "A", "IN"}, false, false)
+	time.Sleep(10 * time.Millisecond)
+	if QuestionCache.Length() != 0 {
+		t.Errorf("expected no questions to be kept with the question cache disabled, got %d", QuestionCache.Length())
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	prefetched := make(chan string, 10)
+	release := make(chan struct{})
+
+	cache := &MemoryCache{
+		StaleWindow: time.Hour,
+		Prefetch: func(key string, msg *dns.Msg) {
+			prefetched <- key
+			<-release
+		},
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, testRR(testDomain, 100))
+	for _, key := range []string{"expired", "stale", "fresh"} {
+		if err := cache.Set(key, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pretend the entries expired ten minutes and two hours ago
+	for key, age := range map[string]time.Duration{"stale": 10 * time.Minute, "expired": 2 * time.Hour} {
+		mesg, _ := cache.entry(key)
+		mesg.Stored = mesg.Stored.Add(-age - 100*time.Second)
+		mesg.Expire = mesg.Expire.Add(-age - 100*time.Second)
+		setTestEntry(cache, key, mesg)
+	}
+
+	if _, err := cache.Get("stale"); err == nil {
+		t.Error("expected the stale entry to be expired for Get")
+	}
+	if _, err := cache.Get("expired"); err == nil {
+		t.Error("expected the entry past the stale window to be expired")
+	}
+	if cache.Exists("expired") || !cache.Exists("stale") {
+		t.Error("expected only the entry within the stale window to be kept")
+	}
+
+	for _, key := range []string{"fresh", "expired"} {
+		if _, ok := cache.GetStale(key); ok {
+			t.Errorf("%s was handed out as stale", key)
+		}
+	}
+
+	// a stale entry is refreshed once however often it's handed out
+	for i := 0; i < 2; i++ {
+		msg, ok := cache.GetStale("stale")
+		if !ok {
+			t.Fatal("expected the stale entry")
+		}
+		if ttl := msg.Answer[0].Header().Ttl; ttl != staleTTL {
+			t.Errorf("expected the stale ttl, got %d", ttl)
+		}
+	}
+	if key := <-prefetched; key != "stale" {
+		t.Errorf("expected the stale entry to be refreshed, got %s", key)
+	}
+	select {
+	case <-prefetched:
+		t.Error("the stale entry was refreshed twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+}
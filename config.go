@@ -1,39 +1,247 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
 )
 
-// Version returns the version of grimd
-const Version = "0.0.1"
-
 type config struct {
-	Sources          []string
-	Log              string
-	LogLevel         int
-	Bind             string
-	API              string
-	Nullroute        string
-	Nullroutev6      string
-	Nameservers      []string
-	Interval         int
-	Timeout          int
-	Expire           int
-	Maxcount         int
-	QuestionCacheCap int
-	TTL              uint32
-	Blocklist        []string
-	Whitelist        []string
-}
-
-const defaultConfig = `# list of sources to pull blocklists from
+	Include               []string
+	Sources               []source
+	UpdateInterval        string
+	Log                   string
+	LogMaxSizeMB          int
+	LogMaxBackups         int
+	LogCompress           bool
+	LogLevel              int
+	LogFormat             string
+	QueryLog              string
+	QueryLogFormat        string
+	QueryLogFlushInterval int
+	LogCategories         []string
+	Bind                  stringList
+	BindUDP               stringList
+	BindTCP               stringList
+	AllowedClients        []string
+	MaxConcurrentQueries  int
+	MaxQueuedQueries      int
+	OverloadAction        string
+	DisallowedQtypes      []string
+	DisallowedQtypeAction string
+	API                   string
+	APIToken              string
+	APIUser               string
+	APIPassword           string
+	APIAuthReads          bool
+	APITLSCert            string
+	APITLSKey             string
+	GRPC                  string
+	Metrics               bool
+	MetricsPath           string
+	Nullroute             stringList
+	Nullroutev6           stringList
+	BlockResponse         string
+	BlockResponseV4       string
+	BlockResponseV6       string
+	BlockResponseTTL      uint32
+	SOAMName              string
+	SOARName              string
+	SOAMinimum            uint32
+	BlockPageIP           stringList
+	BlockPageBind         string
+	BlockPageFile         string
+	CNAMEBlocking         bool
+	MonitorMode           bool
+	RebindProtection      bool
+	RebindAllowed         []string
+	Nameservers           []string
+	FallbackNameservers   [][]string
+	ConditionalForwarders map[string]stringList
+	TLSInsecure           bool
+	EDNSPadding           bool
+	Proxy                 string
+	DNSSECValidate        bool
+	DNSSECTrustAnchors    []string
+	ResolverMode          string
+	FallthroughRefused    bool
+	StrictUpstream        bool
+	RetryTruncated        bool
+	DisableIPv6           bool
+	ECSEnabled            bool
+	ECSSubnet             string
+	ECSPrefixV4           int
+	ECSPrefixV6           int
+	Interval              int
+	Timeout               int
+	UpstreamTimeout       int
+	UpstreamRetries       int
+	UpstreamRetryBackoff  int
+	HealthCheckInterval   string
+	HealthCheckDomain     string
+	PoolMaxIdle           int
+	PoolMaxLifetime       int
+	Expire                int
+	MinTTL                int
+	MaxTTL                int
+	Maxcount              int
+	BlockCacheTTL         int
+	BlockCacheMaxcount    int
+	PrefetchThreshold     int
+	PrefetchMinHits       int
+	ServeStale            bool
+	StaleWindow           int
+	QuestionCacheCap      int
+	PersistQuestions      bool
+	AnonymizeClients      string
+	CachePersistPath      string
+	TTL                   uint32
+	Blocklist             []string
+	RegexBlocklist        string
+	BlockedTLDs           []string
+	Whitelist             []string
+	WhitelistFile         string
+	StaticTTL             uint32
+	StaticRecords         map[string][]string
+	StaticPTR             bool
+	UseSystemHosts        bool
+	Rewrites              []rewrite
+	Groups                map[string]group
+
+	allowedClients      []*net.IPNet
+	disallowedQtypes    map[uint16]bool
+	blockedTLDs         map[string]bool
+	ecsSubnet           *net.IPNet
+	updateInterval      time.Duration
+	healthCheckInterval time.Duration
+	trustAnchors        []*dns.DS
+	staticRecords       map[string][]dns.RR
+	forwarders          map[string][]string
+	nullroutes          []net.IP
+	nullroutesV6        []net.IP
+	blockPageIPs        []net.IP
+	logCategories       map[string]bool
+}
+
+// group is a blocklist group, the clients in its networks are blocked by the
+// lists of its sources instead of the default sources
+type group struct {
+	Sources []source
+	Clients []string
+
+	clients []*net.IPNet
+}
+
+// source is a blocklist source, written as its url or path or as a table with
+// the url, the format of the list, whether it's enabled and its priority.
+// Disabled is set by enabled = false, so that sources are enabled by default.
+type source struct {
+	URL      string
+	Format   string
+	Disabled bool
+	Priority int
+}
+
+// UnmarshalTOML decodes a url or a table with a url, a format, enabled and a
+// priority
+func (s *source) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*s = source{URL: v}
+	case map[string]interface{}:
+		*s = source{}
+		for key, value := range v {
+			switch key {
+			case "enabled":
+				enabled, ok := value.(bool)
+				if !ok {
+					return fmt.Errorf("expected a boolean for %s, found %v", key, value)
+				}
+				s.Disabled = !enabled
+				continue
+			case "priority":
+				priority, ok := value.(int64)
+				if !ok {
+					return fmt.Errorf("expected an integer for %s, found %v", key, value)
+				}
+				s.Priority = int(priority)
+				continue
+			}
+
+			field, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("expected a string for %s, found %v", key, value)
+			}
+			switch key {
+			case "url":
+				s.URL = field
+			case "format":
+				s.Format = field
+			default:
+				return fmt.Errorf("unknown source setting %s", key)
+			}
+		}
+		if s.URL == "" {
+			return fmt.Errorf("source without url")
+		}
+	default:
+		return fmt.Errorf("expected a url or a table, found %v", data)
+	}
+
+	return nil
+}
+
+// stringList is a setting that is either a single string or a list of strings
+type stringList []string
+
+// UnmarshalTOML decodes a string or a list of strings
+func (l *stringList) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*l = stringList{v}
+	case []interface{}:
+		list := make(stringList, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a list of strings, found %v", item)
+			}
+			list = append(list, s)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected a string or a list of strings, found %v", data)
+	}
+
+	return nil
+}
+
+const defaultConfig = `# other config files to load after this one, relative to this file, e.g. ["blocklists.toml"],
+# their settings override the settings here, their lists are added to the lists here and their
+# tables add their entries to the tables here
+include = []
+
+# list of sources to pull blocklists from, in hosts format, one domain per line or
+# Adblock Plus syntax (only ||domain^ and @@||domain^ rules), gzipped sources are decompressed,
+# local lists can be added as file:///path or a plain path, a directory loads all .txt and .hosts files in it,
+# entries of local hosts files that point a domain at an address other than 0.0.0.0 or 127.0.0.1 answer with it,
+# the format of each line is detected unless a source is written as {url = "...", format = "..."} with
+# format "hosts", "domains" or "abp", such a table can also set enabled = false to keep a source without
+# using it and a priority, exceptions of a list only allow the domains that lists with the same or a
+# lower priority block, the priority defaults to 0
 sources = [
 "http://mirror1.malwaredomains.com/files/justdomains",
 "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts",
@@ -45,72 +253,1159 @@ sources = [
 "https://raw.githubusercontent.com/quidsup/notrack/master/trackers.txt"
 ]
 
-# location of the log file
+# how often the sources are downloaded again and the blocklist rebuilt, e.g. "12h" or "30m", "0" to disable,
+# sources that send an ETag or Last-Modified header are only downloaded again once they changed
+updateinterval = "24h"
+
+# location of the log file, or syslog:local for the local syslog daemon and syslog://host:514 or
+# syslog+tcp://host:514 for a remote one over udp or tcp
 log = "grimd.log"
 
+# rotate the log file once it's logmaxsizemb megabytes, keeping logmaxbackups rotated files as
+# grimd.log.1 and so on, gzipped when logcompress is set, 0 never rotates the log file
+logmaxsizemb = 0
+logmaxbackups = 3
+logcompress = false
+
 # what kind of information should be logged, 0 = errors and important operations, 1 = dns queries, 2 = debug
 loglevel = 0
 
-# address to bind to for the DNS server
+# format of query log lines, "text" or "json" for one json object per line
+logformat = "text"
+
+# file every query is written to as a line, for analysis over a longer time than the question cache
+# keeps, "" to disable, querylogformat is "json" for one json object per line like the questions of
+# the api or "csv" for date, client, name, type, class, blocked and wouldblock, the lines are
+# buffered and written every querylogflushinterval seconds, the file is rotated like the log file
+querylog = ""
+querylogformat = "json"
+querylogflushinterval = 5
+
+# which queries are logged from loglevel 1 on, an empty list logs all of them, "queries" logs every
+# query as it comes in, "blocked" the blocked queries, "allowed" the queries that weren't blocked,
+# "misses" the cache misses, "cache" the other cache events and "upstream" the answers of the
+# nameservers, errors are always logged so ["errors"] only logs those. "answers" logs the addresses
+# and other records the nameservers answered with from loglevel 2 on, it's only logged when it's in
+# the list, since the answers tell more about the clients than the questions
+logcategories = []
+
+# address to bind to for the DNS server, or a list of addresses, e.g. ["127.0.0.1:53", "192.168.1.2:53"]
 bind = "0.0.0.0:53"
 
-# address to bind to for the API server
+# addresses of the udp and the tcp listener when they differ from bind, "none" disables a listener,
+# e.g. bindudp = "0.0.0.0:53" with bindtcp = "127.0.0.1:53" only answers queries over tcp on localhost
+bindudp = []
+bindtcp = []
+
+# networks allowed to query the DNS server in CIDR notation, e.g. ["192.168.1.0/24", "fd00::/8"],
+# queries from other clients are refused, an empty list allows every client
+allowedclients = []
+
+# how many queries are handled at once, 0 for no limit, further queries wait until maxqueuedqueries
+# of them are waiting, after which overloadaction "refuse" answers them with REFUSED and "drop"
+# doesn't answer them at all
+maxconcurrentqueries = 0
+maxqueuedqueries = 0
+overloadaction = "refuse"
+
+# query types that are answered without asking the nameservers, to keep grimd from amplifying
+# attacks, disallowedqtypeaction "refuse" answers them with REFUSED and "minimal" answers them like
+# RFC 8482 suggests, ANY queries with a single HINFO record and the other types without any records
+disallowedqtypes = ["ANY"]
+disallowedqtypeaction = "refuse"
+
+# address to bind to for the API server, the default only accepts requests from this host
 api = "127.0.0.1:8080"
 
-# ipv4 address to forward blocked queries to
+# require a bearer token ("Authorization: Bearer <apitoken>") or basic auth with apiuser and
+# apipassword for the requests that change something, e.g. blocking a domain or flushing the cache,
+# apiauthreads requires them for every request but /healthz and /readyz, empty to disable
+apitoken = ""
+apiuser = ""
+apipassword = ""
+apiauthreads = false
+
+# serve the API over https with the certificate and key in these PEM files, they are read again on
+# SIGHUP so that a renewed certificate is used without a restart, empty serves the API over http
+apitlscert = ""
+apitlskey = ""
+
+# address to bind to for the gRPC control api described in proto/grimd.proto, it's protected by the
+# credentials and served with the certificate of the API server, empty disables it
+grpc = ""
+
+# expose prometheus metrics on the API server under metricspath
+metrics = false
+metricspath = "/metrics"
+
+# ipv4 address to forward blocked queries to, or a list of addresses that are all answered,
+# e.g. ["0.0.0.0", "192.168.1.5"] to also point blocked domains at a sinkhole web server
 nullroute = "0.0.0.0"
 
-# ipv6 address to forward blocked queries to
+# ipv6 address to forward blocked queries to, or a list of addresses
 nullroutev6 = "0:0:0:0:0:0:0:0"
 
-# nameservers to forward queries to
+# how blocked queries are answered, "nullroute" answers with the nullroute addresses, "blockpage"
+# with the blockpageip addresses where the block page is served, "nodata" answers without any
+# address, "nxdomain" answers that the domain doesn't exist and "refused" refuses the query,
+# blocked domains are blocked for every query type and the queries for other types than A and AAAA
+# are answered without any records by "nullroute" and "blockpage"
+blockresponse = "nullroute"
+
+# how blocked A and AAAA queries are answered, "" for blockresponse, e.g. blockresponsev6 = "nodata"
+# answers AAAA queries without an address so clients don't fall back to ipv6 while A queries are
+# still answered with the nullroute
+blockresponsev4 = ""
+blockresponsev6 = ""
+
+# ttl in seconds of the addresses blocked queries are answered with, a short ttl makes clients ask
+# again soon so that whitelisting a domain takes effect on them quickly, 0 uses ttl
+blockresponsettl = 0
+
+# blocked queries and the other negative answers grimd makes up itself carry a SOA record, so that the
+# caches of the clients keep them for soaminimum seconds, 0 uses the ttl of the blocked addresses.
+# soamname is the primary nameserver and soarname the mailbox of the zone in domain name form
+soamname = "grimd."
+soarname = "hostmaster.grimd."
+soaminimum = 0
+
+# addresses blocked domains point to with blockresponse "blockpage", an ipv4 and an ipv6 address of
+# this host, e.g. ["192.168.1.2", "fd00::2"], AAAA queries are answered without an address when
+# there is no ipv6 address
+blockpageip = []
+
+# address of the http listener that serves the block page for every host, e.g. "0.0.0.0:80", it's
+# the page in blockpagefile where {{.Host}} is the blocked domain, or a short default page, https
+# connections to blocked domains fail since there is no certificate for them
+blockpagebind = ""
+blockpagefile = ""
+
+# also block answers with a CNAME to a blocked domain, which catches trackers hidden behind a
+# domain of the site, this checks the answer of every query that isn't blocked
+cnameblocking = false
+
+# log the queries that would be blocked and mark them in the question cache without blocking them,
+# blocked domains are resolved like any other domain, to try out new lists before they block anything
+monitormode = false
+
+# answer queries for public domains that resolve to a private, loopback or link local address with
+# NXDOMAIN, which stops dns rebinding attacks on the local network, single label names, local
+# domains like .lan and .home.arpa, the domains of conditional forwarders and the domains in
+# rebindallowed may still resolve to them, *.example.com allows every subdomain of example.com
+rebindprotection = true
+rebindallowed = []
+
+# nameservers to forward queries to, prefix an entry with tls:// to use DNS-over-TLS,
+# the certificate name defaults to the host and can be set with ?tls-servername=
+# e.g. "tls://1.1.1.1:853?tls-servername=cloudflare-dns.com", prefix it with quic:// to use
+# DNS-over-QUIC, e.g. "quic://dns.adguard-dns.com:853", or prefix it with https:// to use
+# DNS-over-HTTPS, e.g. "https://cloudflare-dns.com/dns-query"
 nameservers = ["8.8.8.8:53", "8.8.4.4:53"]
 
+# tiers of nameservers that are only asked when every nameserver of the tiers before couldn't answer,
+# each tier is asked like the nameservers according to resolvermode, e.g. with nameservers on the
+# local network and [["1.1.1.1:53", "1.0.0.1:53"], ["8.8.8.8:53"]] public ones only when they fail
+fallbacknameservers = []
+
+# skip certificate validation for DNS-over-TLS and DNS-over-HTTPS nameservers, only use this for testing
+tlsinsecure = false
+
+# pad the queries to DNS-over-TLS, DNS-over-HTTPS and DNS-over-QUIC nameservers with EDNS0 padding to
+# a multiple of 128 bytes, so that their length doesn't give away the names they are for, queries
+# over plain udp and tcp are never padded
+ednspadding = true
+
+# proxy for DNS-over-HTTPS nameservers, e.g. "socks5://127.0.0.1:9050" or "http://proxy:3128", which
+# defaults to HTTPS_PROXY or ALL_PROXY from the environment, "none" connects directly, a nameserver
+# can use another proxy with ?proxy=, e.g. "https://cloudflare-dns.com/dns-query?proxy=none"
+proxy = ""
+
+# validate the DNSSEC signatures of answers, validated answers have the AD bit set and answers
+# that fail validation are answered with SERVFAIL, validation starts from the DS records in
+# dnssectrustanchors, e.g. ". IN DS 20326 8 2 E06D...", which default to the root zone keys
+dnssecvalidate = false
+dnssectrustanchors = []
+
+# forward the subnet of the client to nameservers with EDNS0 client subnet, for answers that
+# suit the location of the client, the address of the client is truncated to ecsprefixv4 or
+# ecsprefixv6 bits, or ecssubnet is sent instead when it's set, e.g. "203.0.113.0/24"
+ecsenabled = false
+ecssubnet = ""
+ecsprefixv4 = 24
+ecsprefixv6 = 56
+
+# how nameservers are queried, "sequential" starts a new request on the next nameserver
+# every interval until one answers, "race" queries all nameservers at once and uses the first answer,
+# "roundrobin" and "random" work like sequential but start on the next or a random nameserver for
+# every query to spread the load, nameservers that couldn't be reached are then asked last for a while
+resolvermode = "sequential"
+
+# answers with SERVFAIL are discarded and the query is left to the other nameservers, the client is
+# only answered with SERVFAIL when every nameserver failed, fallthroughrefused discards answers with
+# REFUSED as well, strictupstream returns the first answer of a nameserver whatever its rcode
+fallthroughrefused = false
+strictupstream = false
+
+# truncated answers to queries over udp are never cached, with retrytruncated the query is asked again
+# over tcp so that the client gets the complete answer
+retrytruncated = true
+
+# on networks without ipv6 connectivity disableipv6 answers every AAAA query with an empty answer
+# instead of asking the nameservers, A queries are resolved as usual
+disableipv6 = false
+
 # concurrency interval for lookups in miliseconds
 interval = 200
 
 # query timeout for dns lookups in seconds
 timeout = 5
 
-# cache entry lifespan in seconds
+# how long in miliseconds a single nameserver has to answer before its query fails, 0 uses timeout,
+# in sequential mode the next nameserver is asked after interval regardless, so this mostly bounds how
+# long a lookup waits on nameservers that don't answer, which is at most the time until the last
+# nameserver was asked plus upstreamtimeout, in race mode it's how long a lookup waits at most
+upstreamtimeout = 2000
+
+# how many times a query is sent again to a nameserver that couldn't be reached or didn't answer in
+# time, after upstreamretrybackoff miliseconds that double with every retry, in sequential mode the
+# next nameserver is still asked after interval, a lookup stops retrying once it reaches timeout
+upstreamretries = 0
+upstreamretrybackoff = 100
+
+# probe every nameserver with a query for healthcheckdomain every healthcheckinterval, e.g. "30s",
+# nameservers that fail the probe are skipped until they pass it again, unless every nameserver
+# fails it, "0" to disable
+healthcheckinterval = "30s"
+healthcheckdomain = "example.com"
+
+# tcp and tls connections to nameservers are reused, they are closed after being idle for
+# poolmaxidle seconds or once they are poolmaxlifetime seconds old, 0 keeps them open, quic
+# connections are closed after being idle for poolmaxidle seconds or 30 seconds for 0
+poolmaxidle = 10
+poolmaxlifetime = 300
+
+# lifespan in seconds of cache entries without an answer to take a TTL from
 expire = 600
 
+# bounds in seconds for the TTLs of cached answers, lower TTLs are raised to minttl and higher
+# TTLs are lowered to maxttl, which also sets how long the answer is cached, 0 for no maximum
+minttl = 0
+maxttl = 86400
+
 # cache capacity, 0 for infinite
 maxcount = 0
 
-# question cache capacity, 0 for infinite but not recommended (this is used for storing logs)
+# blocked answers are cached apart from the other answers, for blockcachettl seconds so that blocks
+# are lifted soon after the blocklists change, 0 caches them for their ttl, and at most
+# blockcachemaxcount of them, 0 for infinite
+blockcachettl = 60
+blockcachemaxcount = 10000
+
+# refresh cached answers that were asked for at least prefetchminhits times once prefetchthreshold
+# percent of their TTL has passed, so popular domains never expire from the cache, 0 to disable
+prefetchthreshold = 90
+prefetchminhits = 10
+
+# answer with an expired cached answer when the nameservers can't be reached, as RFC 8767 describes,
+# for up to stalewindow seconds after it expired, stale answers have a TTL of 30 seconds and are
+# refreshed in the background
+servestale = false
+stalewindow = 86400
+
+# question cache capacity, the question cache keeps the latest queries with the client that sent them
+# for the api, 0 disables it so that no queries are kept, -1 for infinite but not recommended
 questioncachecap = 5000
 
-# manual blocklist entries
+# save the question cache along with the other caches to cachepersistpath, which keeps the clients
+# and their queries on disk
+persistquestions = false
+
+# how the clients are kept in the question cache, "" keeps their addresses, "truncate" zeros the last
+# octet of ipv4 and the last 80 bits of ipv6 addresses, "hash" keeps a hash of the address that
+# changes whenever grimd restarts
+anonymizeclients = ""
+
+# file the dns cache and block cache are saved to on shutdown and restored from on startup,
+# leave empty to disable, a restored block cache is only rebuilt from the lists when running with -update
+cachepersistpath = ""
+
+# manual blocklist entries, *.example.com blocks every subdomain of example.com
 blocklist = []
 
-# manual whitelist entries
+# file of regular expressions to block domains by, one per line, e.g. ^ads[0-9]+\.
+# the patterns are only tried for domains that aren't in the blocklists
+regexblocklist = ""
+
+# top level domains to block with every domain under them, e.g. ["zip", "mov"], whitelisted domains
+# are still resolved
+blockedtlds = []
+
+# manual whitelist entries, whitelisted domains are never blocked, *.example.com whitelists every
+# subdomain of example.com whatever blocks them
 whitelist = [
 	"getsentry.com",
 	"www.getsentry.com"
 ]
+
+# file of domains to whitelist, one per line
+whitelistfile = ""
+
+# ttl in seconds of static records that don't set one and of the addresses from hosts files
+staticttl = 3600
+
+# answer reverse lookups of the addresses in static records with their names, unless the reverse
+# names have static records of their own, reverse lookups of the nullroute addresses are always
+# answered with NXDOMAIN instead of asking the nameservers
+staticptr = true
+
+# answer the domains in the hosts file of the system, /etc/hosts or its windows equivalent, with their
+# addresses like static records, domains it points at 0.0.0.0 or :: are blocked, the file is read
+# again when the lists are updated and on SIGHUP
+usesystemhosts = true
+
+# records that are answered directly instead of asking the nameservers, in zone file syntax without
+# the name, a record may start with its ttl, a CNAME to a name without static records is resolved, e.g.
+# [staticrecords]
+# "nas.home" = ["A 192.168.1.10", "AAAA fd00::10", "TXT \"backups\""]
+# "files.home" = ["300 CNAME nas.home."]
+
+# nameservers to forward the queries for a domain and its subdomains to instead of nameservers,
+# the longest matching domain wins, answers from these nameservers aren't DNSSEC validated, e.g.
+# [conditionalforwarders]
+# "corp.local" = "10.0.0.1:53"
+# "lab.corp.local" = ["10.0.1.1:53", "10.0.1.2:53"]
+
+# rules that replace the addresses in the answers of the nameservers before they are cached, a rule
+# applies to the queries for its domain, or its subdomains with *., and to the addresses in its
+# network, either can be left out, the addresses are replaced with the addresses of the same family
+# in to and the first matching rule wins, e.g.
+# [[rewrites]]
+# network = "10.0.0.0/8"
+# to = ["192.168.1.10"]
+# [[rewrites]]
+# domain = "*.portal.example.com"
+# to = ["192.168.1.2", "fd00::2"]
+
+# blocklist groups, clients in the networks of a group are blocked by the sources of the group
+# instead of sources, the manual blocklist, the regex blocklist and the whitelist apply to every group,
+# a client in several groups belongs to the one with the most specific network, e.g.
+# [groups.kids]
+# sources = ["https://raw.githubusercontent.com/StevenBlack/hosts/master/alternates/porn/hosts"]
+# clients = ["192.168.1.64/26", "192.168.1.20"]
 `
 
-// Config is the global configuration
-var Config config
+// restartOnly lists the settings that only take effect on startup, a reload
+// keeps their current values
+var restartOnly = []string{"Bind", "BindUDP", "BindTCP", "MaxConcurrentQueries", "API", "APITLSCert", "APITLSKey", "GRPC", "BlockPageBind", "BlockPageFile", "Metrics", "MetricsPath", "Expire", "MinTTL", "MaxTTL", "Maxcount", "BlockCacheTTL", "BlockCacheMaxcount", "PrefetchThreshold", "PrefetchMinHits", "ServeStale", "StaleWindow", "PoolMaxIdle", "PoolMaxLifetime", "UpdateInterval", "HealthCheckInterval", "DNSSECTrustAnchors"}
+
+// activeConfig holds the *config in use, it is swapped as a whole on reload so
+// that a query never sees a partially loaded config
+var activeConfig atomic.Value
+
+// Config returns the global configuration, it must not be modified
+func Config() *config {
+	return activeConfig.Load().(*config)
+}
 
 // LoadConfig loads the given config file
 func LoadConfig(path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	activeConfig.Store(c)
+
+	return nil
+}
+
+// ReloadConfig loads the given config file in place of the current config,
+// settings that can't be changed without a restart are logged and ignored
+func ReloadConfig(path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	old := Config()
+	for _, name := range restartOnly {
+		field, current := reflect.ValueOf(c).Elem().FieldByName(name), reflect.ValueOf(old).Elem().FieldByName(name)
+		if !reflect.DeepEqual(field.Interface(), current.Interface()) {
+			log.Printf("%s can't be changed without a restart, ignoring\n", strings.ToLower(name))
+			field.Set(current)
+		}
+	}
+
+	// the kept settings are parsed again so the parsed values match them
+	if err := c.parse(); err != nil {
+		return err
+	}
+
+	activeConfig.Store(c)
+
+	return nil
+}
+
+func loadConfig(path string) (*config, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err := generateConfig(path); err != nil {
-			return err
+		if err := WriteDefaultConfig(path); err != nil {
+			return nil, err
+		}
+	}
+
+	c := new(config)
+	if err := decodeConfig(path, c, nil); err != nil {
+		return nil, fmt.Errorf("could not load config: %s", err)
+	}
+
+	if err := c.applyEnv(); err != nil {
+		return nil, fmt.Errorf("could not load config: %s", err)
+	}
+
+	// the problems of both are reported together, so that one restart is
+	// enough to see all of them
+	var problems configError
+	problems.merge(c.Validate())
+	problems.merge(c.parse())
+	if err := problems.err(); err != nil {
+		return nil, fmt.Errorf("could not load config %s: %s", path, err)
+	}
+
+	return c, nil
+}
+
+// envPrefix is the prefix of the environment variables that override settings,
+// GRIMD_ followed by the setting in uppercase, e.g. GRIMD_NAMESERVERS
+const envPrefix = "GRIMD_"
+
+// applyEnv overrides the settings that have an environment variable set, lists
+// are separated by commas and sources are given by their urls. The tables,
+// staticrecords, conditionalforwarders, rewrites and groups, can only be set in
+// the file.
+func (c *config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value, ok := os.LookupEnv(envPrefix + strings.ToUpper(name))
+		if !ok || !v.Type().Field(i).IsExported() {
+			continue
+		}
+		// the includes are loaded with the config file, before the environment
+		if name == "Include" {
+			return fmt.Errorf("%s%s can only be set in the config file", envPrefix, strings.ToUpper(name))
+		}
+
+		if err := setFromEnv(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid %s%s %s: %s", envPrefix, strings.ToUpper(name), value, err)
+		}
+	}
+
+	return nil
+}
+
+// setFromEnv sets a setting to the value of its environment variable
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		field.SetInt(int64(n))
+	case reflect.Uint32:
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("expected a positive integer")
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		if elem := field.Type().Elem(); elem.Kind() != reflect.String && elem != reflect.TypeOf(source{}) {
+			return fmt.Errorf("can only be set in the config file")
+		}
+
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+
+		list := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			switch elem := list.Index(i); elem.Kind() {
+			case reflect.String:
+				elem.SetString(item)
+			case reflect.Struct:
+				elem.Set(reflect.ValueOf(source{URL: item}))
+			}
+		}
+		field.Set(list)
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+
+	return nil
+}
+
+// Validate checks the settings that would otherwise only fail once they are
+// used and returns every problem it finds at once, so that a config can be
+// fixed in one go. The settings parse derives values from are checked there,
+// loadConfig lists the problems of both in one error.
+func (c *config) Validate() error {
+	var problems configError
+	problem := problems.add
+
+	checkAddr := func(name, addr string) {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			problem("invalid %s %s: %s", name, addr, err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			problem("invalid %s %s: invalid port %s", name, addr, port)
+		}
+	}
+
+	if len(c.Bind) == 0 && len(c.BindUDP) == 0 && len(c.BindTCP) == 0 {
+		problem("bind is required")
+	}
+	for _, addr := range c.Bind {
+		checkAddr("bind", addr)
+	}
+	for i, addrs := range []stringList{c.BindUDP, c.BindTCP} {
+		if len(addrs) == 1 && addrs[0] == "none" {
+			continue
+		}
+		for _, addr := range addrs {
+			checkAddr([]string{"bindudp", "bindtcp"}[i], addr)
+		}
+	}
+	if c.API != "" {
+		checkAddr("api", c.API)
+	}
+	if c.GRPC != "" {
+		checkAddr("grpc", c.GRPC)
+	}
+	if c.BlockPageBind != "" {
+		checkAddr("blockpagebind", c.BlockPageBind)
+	}
+
+	if _, err := parseNullroutes(c.Nullroute, false); err != nil {
+		problem("%s", err)
+	}
+	if _, err := parseNullroutes(c.Nullroutev6, true); err != nil {
+		problem("%s", err)
+	}
+	for i, mode := range []string{c.BlockResponse, c.BlockResponseV4, c.BlockResponseV6} {
+		switch mode {
+		case "", "nullroute", "blockpage", "nodata", "nxdomain", "refused":
+		default:
+			problem("invalid %s %s: expected nullroute, blockpage, nodata, nxdomain or refused", []string{"blockresponse", "blockresponsev4", "blockresponsev6"}[i], mode)
+		}
+	}
+
+	if len(c.Nameservers) == 0 {
+		problem("nameservers is required")
+	}
+	for _, nameserver := range c.Nameservers {
+		if _, err := ParseUpstream(nameserver); err != nil {
+			problem("invalid nameserver: %s", err)
+		}
+	}
+	for _, tier := range c.FallbackNameservers {
+		for _, nameserver := range tier {
+			if _, err := ParseUpstream(nameserver); err != nil {
+				problem("invalid fallback nameserver: %s", err)
+			}
+		}
+	}
+	switch c.ResolverMode {
+	case "", "sequential", "race", "roundrobin", "random":
+	default:
+		problem("invalid resolvermode %s: expected sequential, race, roundrobin or random", c.ResolverMode)
+	}
+	switch c.OverloadAction {
+	case "", "refuse", "drop":
+	default:
+		problem("invalid overloadaction %s: expected refuse or drop", c.OverloadAction)
+	}
+	switch c.DisallowedQtypeAction {
+	case "", "refuse", "minimal":
+	default:
+		problem("invalid disallowedqtypeaction %s: expected refuse or minimal", c.DisallowedQtypeAction)
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		problem("invalid logformat %s: expected text or json", c.LogFormat)
+	}
+	switch c.QueryLogFormat {
+	case "", "json", "csv":
+	default:
+		problem("invalid querylogformat %s: expected json or csv", c.QueryLogFormat)
+	}
+
+	if c.Interval <= 0 {
+		problem("invalid interval %d: must be positive", c.Interval)
+	}
+	if c.Timeout <= 0 {
+		problem("invalid timeout %d: must be positive", c.Timeout)
+	}
+	if c.MinTTL > c.MaxTTL && c.MaxTTL > 0 {
+		problem("invalid minttl %d: larger than maxttl %d", c.MinTTL, c.MaxTTL)
+	}
+	if c.PrefetchThreshold < 0 || c.PrefetchThreshold > 100 {
+		problem("invalid prefetchthreshold %d: must be between 0 and 100", c.PrefetchThreshold)
+	}
+	if c.ECSPrefixV4 < 0 || c.ECSPrefixV4 > 32 {
+		problem("invalid ecsprefixv4 %d: must be between 0 and 32", c.ECSPrefixV4)
+	}
+	if c.ECSPrefixV6 < 0 || c.ECSPrefixV6 > 128 {
+		problem("invalid ecsprefixv6 %d: must be between 0 and 128", c.ECSPrefixV6)
+	}
+	if c.QuestionCacheCap < -1 {
+		problem("invalid questioncachecap %d: must be -1, 0 or positive", c.QuestionCacheCap)
+	}
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"logmaxsizemb", c.LogMaxSizeMB}, {"logmaxbackups", c.LogMaxBackups}, {"querylogflushinterval", c.QueryLogFlushInterval},
+		{"maxconcurrentqueries", c.MaxConcurrentQueries}, {"maxqueuedqueries", c.MaxQueuedQueries},
+		{"upstreamtimeout", c.UpstreamTimeout}, {"upstreamretries", c.UpstreamRetries}, {"upstreamretrybackoff", c.UpstreamRetryBackoff},
+		{"poolmaxidle", c.PoolMaxIdle}, {"poolmaxlifetime", c.PoolMaxLifetime},
+		{"expire", c.Expire}, {"minttl", c.MinTTL}, {"maxttl", c.MaxTTL}, {"maxcount", c.Maxcount},
+		{"blockcachettl", c.BlockCacheTTL}, {"blockcachemaxcount", c.BlockCacheMaxcount}, {"prefetchminhits", c.PrefetchMinHits},
+		{"stalewindow", c.StaleWindow},
+	} {
+		if setting.value < 0 {
+			problem("invalid %s %d: must not be negative", setting.name, setting.value)
+		}
+	}
+
+	return problems.err()
+}
+
+// configError lists every problem found in a config
+type configError []string
+
+// add adds a problem, a problem found by both Validate and parse is only
+// listed once
+func (e *configError) add(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	for _, p := range *e {
+		if p == problem {
+			return
+		}
+	}
+	*e = append(*e, problem)
+}
+
+// merge adds the problems of an error returned by Validate or parse
+func (e *configError) merge(err error) {
+	var problems configError
+	if !errors.As(err, &problems) {
+		if err != nil {
+			e.add("%s", err)
+		}
+		return
+	}
+	for _, p := range problems {
+		e.add("%s", p)
+	}
+}
+
+// err returns the problems as an error, nil if there are none
+func (e configError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e configError) Error() string {
+	if len(e) == 1 {
+		return e[0]
+	}
+	return fmt.Sprintf("%d problems:\n\t%s", len(e), strings.Join(e, "\n\t"))
+}
+
+// parse prepares the values that are used on every query, so the handler
+// doesn't have to parse them again. Like Validate it returns every problem it
+// finds at once.
+func (c *config) parse() error {
+	var problems configError
+	problem := problems.add
+
+	c.allowedClients = nil
+	for _, entry := range c.AllowedClients {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			problem("invalid allowed client %s: %s", entry, err)
+			continue
+		}
+		c.allowedClients = append(c.allowedClients, network)
+	}
+
+	c.disallowedQtypes = make(map[uint16]bool)
+	for _, name := range c.DisallowedQtypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			problem("invalid disallowed qtype %s: unknown query type", name)
+			continue
+		}
+		c.disallowedQtypes[qtype] = true
+	}
+
+	if err := checkSources(c.Sources); err != nil {
+		problem("%s", err)
+	}
+
+	nullroutes, err := parseNullroutes(c.Nullroute, false)
+	if err != nil {
+		problem("%s", err)
+	}
+	nullroutesV6, err := parseNullroutes(c.Nullroutev6, true)
+	if err != nil {
+		problem("%s", err)
+	}
+	c.nullroutes, c.nullroutesV6 = nullroutes, nullroutesV6
+
+	c.logCategories = nil
+	for _, category := range c.LogCategories {
+		if _, ok := logCategoryNames[category]; !ok {
+			problem("invalid log category %s", category)
+			continue
+		}
+		if c.logCategories == nil {
+			c.logCategories = make(map[string]bool)
+		}
+		c.logCategories[category] = true
+	}
+
+	c.blockPageIPs = nil
+	for _, entry := range c.BlockPageIP {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			problem("invalid blockpageip %s: not an ip address", entry)
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		c.blockPageIPs = append(c.blockPageIPs, ip)
+	}
+	for _, IPQuery := range []int{_IP4Query, _IP6Query} {
+		if c.blockMode(IPQuery) == "blockpage" && len(c.BlockPageIP) == 0 {
+			problem("blockresponse blockpage needs a blockpageip")
+			break
 		}
 	}
 
-	if _, err := toml.DecodeFile(path, &Config); err != nil {
-		return fmt.Errorf("could not load config: %s", err)
+	for _, soa := range []struct{ name, value string }{{"soamname", c.SOAMName}, {"soarname", c.SOARName}} {
+		if _, ok := dns.IsDomainName(soa.value); soa.value != "" && !ok {
+			problem("invalid %s %s: not a domain name", soa.name, soa.value)
+		}
+	}
+
+	if (c.APITLSCert == "") != (c.APITLSKey == "") {
+		problem("apitlscert and apitlskey must be set together")
+	}
+
+	if c.Proxy != "" && c.Proxy != "none" {
+		if _, err := parseProxy(c.Proxy); err != nil {
+			problem("invalid proxy %s: %s", c.Proxy, err)
+		}
+	}
+
+	for name, g := range c.Groups {
+		// the name is used as the directory of the lists of the group
+		if !groupName.MatchString(name) {
+			problem("invalid group name %s: only letters, digits, - and _ are allowed", name)
+		}
+		if err := checkSources(g.Sources); err != nil {
+			problem("%s of group %s", err, name)
+		}
+
+		g.clients = nil
+		for _, entry := range g.Clients {
+			network, err := parseNetwork(entry)
+			if err != nil {
+				problem("invalid client %s of group %s: %s", entry, name, err)
+				continue
+			}
+			g.clients = append(g.clients, network)
+		}
+		c.Groups[name] = g
+	}
+
+	switch c.AnonymizeClients {
+	case "", "truncate", "hash":
+	default:
+		problem("invalid anonymizeclients %s: expected truncate or hash", c.AnonymizeClients)
+	}
+
+	c.ecsSubnet = nil
+	if c.ECSSubnet != "" {
+		if _, network, err := net.ParseCIDR(c.ECSSubnet); err != nil {
+			problem("invalid ecs subnet %s: %s", c.ECSSubnet, err)
+		} else {
+			c.ecsSubnet = network
+		}
+	}
+
+	interval, err := parseInterval(c.UpdateInterval)
+	if err != nil {
+		problem("invalid update interval %s: %s", c.UpdateInterval, err)
+	}
+	c.updateInterval = interval
+
+	if interval, err = parseInterval(c.HealthCheckInterval); err != nil {
+		problem("invalid health check interval %s: %s", c.HealthCheckInterval, err)
+	}
+	if interval > 0 && c.HealthCheckDomain == "" {
+		problem("healthcheckdomain is required for health checks")
+	}
+	c.healthCheckInterval = interval
+
+	c.trustAnchors = nil
+	anchors := c.DNSSECTrustAnchors
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+	for _, entry := range anchors {
+		rr, err := dns.NewRR(entry)
+		if err != nil {
+			problem("invalid trust anchor %s: %s", entry, err)
+			continue
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			problem("invalid trust anchor %s: not a DS record", entry)
+			continue
+		}
+		c.trustAnchors = append(c.trustAnchors, ds)
+	}
+
+	c.blockedTLDs = nil
+	for _, entry := range c.BlockedTLDs {
+		tld := normalizeDomain(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(entry, "*"), "."), "."))
+		if tld == "" || strings.Contains(tld, ".") {
+			problem("invalid blocked tld %s: not a top level domain", entry)
+			continue
+		}
+		if c.blockedTLDs == nil {
+			c.blockedTLDs = make(map[string]bool)
+		}
+		c.blockedTLDs[tld] = true
+	}
+
+	c.staticRecords = make(map[string][]dns.RR, len(c.StaticRecords))
+	for name, values := range c.StaticRecords {
+		for _, value := range values {
+			rr, err := parseStaticRecord(name, value, c.staticTTL())
+			if err != nil {
+				problem("invalid static record %s %s: %s", name, value, err)
+				continue
+			}
+			key := strings.ToLower(rr.Header().Name)
+			c.staticRecords[key] = append(c.staticRecords[key], rr)
+		}
+	}
+	if c.StaticPTR {
+		c.staticRecords = addStaticPTRs(c.staticRecords)
+	}
+
+	for i := range c.Rewrites {
+		if err := c.Rewrites[i].parse(); err != nil {
+			problem("invalid rewrite %d: %s", i+1, err)
+		}
+	}
+
+	c.forwarders = make(map[string][]string, len(c.ConditionalForwarders))
+	for suffix, nameservers := range c.ConditionalForwarders {
+		for _, nameserver := range nameservers {
+			if _, err := ParseUpstream(nameserver); err != nil {
+				problem("invalid conditional forwarder %s %s: %s", suffix, nameserver, err)
+			}
+		}
+		c.forwarders[normalizeDomain(UnFqdn(suffix))] = nameservers
 	}
 
+	return problems.err()
+}
+
+// parseNullroutes parses the addresses blocked queries are answered with once,
+// so that blocked queries don't parse them, v6 allows ipv6 addresses
+func parseNullroutes(entries []string, v6 bool) ([]net.IP, error) {
+	var ips []net.IP
+	for _, entry := range entries {
+		ip := net.ParseIP(entry)
+		if ip != nil && !v6 {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			if v6 {
+				return nil, fmt.Errorf("invalid nullroutev6 %s: not an ip address", entry)
+			}
+			return nil, fmt.Errorf("invalid nullroute %s: not an ipv4 address", entry)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// checkSources returns an error for a source with an unknown list format
+func checkSources(sources []source) error {
+	for _, s := range sources {
+		switch s.Format {
+		case formatAuto, formatHosts, formatDomains, formatABP:
+		default:
+			return fmt.Errorf("invalid format %s of source %s", s.Format, s.URL)
+		}
+	}
 	return nil
 }
 
-func generateConfig(path string) error {
-	output, err := os.Create(path)
+// blockMode returns how blocked queries of an address family are answered
+func (c *config) blockMode(IPQuery int) string {
+	switch {
+	case IPQuery == _IP4Query && c.BlockResponseV4 != "":
+		return c.BlockResponseV4
+	case IPQuery == _IP6Query && c.BlockResponseV6 != "":
+		return c.BlockResponseV6
+	}
+	return c.BlockResponse
+}
+
+// listenAddrs returns the addresses the listener for Net binds to, bind unless
+// the listener has addresses of its own, none if it's disabled
+func (c *config) listenAddrs(Net string) []string {
+	addrs := c.BindUDP
+	if Net == "tcp" {
+		addrs = c.BindTCP
+	}
+
+	switch {
+	case len(addrs) == 0:
+		return c.Bind
+	case len(addrs) == 1 && addrs[0] == "none":
+		return nil
+	}
+	return addrs
+}
+
+// tiers returns the nameservers and the tiers of fallback nameservers that
+// have any
+func (c *config) tiers() [][]string {
+	tiers := [][]string{c.Nameservers}
+	for _, tier := range c.FallbackNameservers {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// forwardersFor returns the conditional forwarders of the longest domain suffix
+// of qname that has any, nil if the nameservers answer the query
+func (c *config) forwardersFor(qname string) []string {
+	if len(c.forwarders) == 0 {
+		return nil
+	}
+
+	name := normalizeDomain(UnFqdn(qname))
+	for {
+		if nameservers, ok := c.forwarders[name]; ok {
+			return nameservers
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// staticTTL returns the TTL of static records that don't set one
+func (c *config) staticTTL() uint32 {
+	if c.StaticTTL == 0 {
+		return 3600
+	}
+	return c.StaticTTL
+}
+
+// blockResponseTTL returns the TTL of the addresses blocked queries are
+// answered with
+func (c *config) blockResponseTTL() uint32 {
+	if c.BlockResponseTTL == 0 {
+		return c.TTL
+	}
+	return c.BlockResponseTTL
+}
+
+// soa returns the SOA record the negative answers to queries for name that
+// grimd makes up itself are sent with
+func (c *config) soa(name string) *dns.SOA {
+	mname, rname, minimum := c.SOAMName, c.SOARName, c.SOAMinimum
+	if mname == "" {
+		mname = "grimd."
+	}
+	if rname == "" {
+		rname = "hostmaster.grimd."
+	}
+	if minimum == 0 {
+		minimum = c.blockResponseTTL()
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: minimum},
+		Ns:      dns.Fqdn(mname),
+		Mbox:    dns.Fqdn(rname),
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  minimum,
+	}
+}
+
+// parseInterval parses the duration of a schedule, "" disables it like "0"
+func parseInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+
+	return interval, nil
+}
+
+// addStaticPTRs adds PTR records pointing the addresses of the static A and
+// AAAA records back at their names, the reverse names that have static records
+// of their own are left alone
+func addStaticPTRs(records map[string][]dns.RR) map[string][]dns.RR {
+	ptrs := make(map[string][]dns.RR)
+	for _, rrs := range records {
+		for _, rr := range rrs {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+
+			reverse, err := dns.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+			if _, ok := records[reverse]; ok {
+				continue
+			}
+			hdr := dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl}
+			ptrs[reverse] = append(ptrs[reverse], &dns.PTR{Hdr: hdr, Ptr: rr.Header().Name})
+		}
+	}
+
+	for reverse, rrs := range ptrs {
+		// the order of the names doesn't depend on the order of the map
+		sort.Slice(rrs, func(i, j int) bool { return rrs[i].(*dns.PTR).Ptr < rrs[j].(*dns.PTR).Ptr })
+		records[reverse] = rrs
+	}
+
+	return records
+}
+
+// parseStaticRecord parses a static record of a name
+func parseStaticRecord(name, value string, ttl uint32) (dns.RR, error) {
+	zp := dns.NewZoneParser(strings.NewReader(dns.Fqdn(name)+" "+value), ".", "")
+	zp.SetDefaultTTL(ttl)
+
+	rr, ok := zp.Next()
+	if !ok {
+		if err := zp.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no record")
+	}
+	if rr.Header().Class != dns.ClassINET {
+		return nil, fmt.Errorf("only records of class IN are supported")
+	}
+
+	return rr, nil
+}
+
+// ClientAllowed returns whether or not a client may query the DNS server
+func (c *config) ClientAllowed(ip net.IP) bool {
+	if len(c.allowedClients) == 0 {
+		return true
+	}
+
+	for _, network := range c.allowedClients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientGroup returns the name of the blocklist group of a client, or "" if
+// the client is in no group
+func (c *config) ClientGroup(ip net.IP) string {
+	name, bits := "", -1
+	for n, g := range c.Groups {
+		for _, network := range g.clients {
+			ones, _ := network.Mask.Size()
+			if network.Contains(ip) && (ones > bits || ones == bits && n < name) {
+				name, bits = n, ones
+			}
+		}
+	}
+
+	return name
+}
+
+// groupName matches the names allowed for blocklist groups
+var groupName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseNetwork parses a network in CIDR notation, a plain address is a network
+// of only that address
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+			entry += "/32"
+		} else {
+			entry += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
+func init() {
+	activeConfig.Store(new(config))
+}
+
+// WriteDefaultConfig writes the default config with the comments explaining
+// every setting to path, a file that already exists is never overwritten
+func WriteDefaultConfig(path string) error {
+	output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return fmt.Errorf("could not generate config: %s", err)
 	}
@@ -118,6 +1413,8 @@ func generateConfig(path string) error {
 
 	r := strings.NewReader(defaultConfig)
 	if _, err := io.Copy(output, r); err != nil {
+		output.Close()
+		os.Remove(path)
 		return fmt.Errorf("could not copy default config: %s", err)
 	}
 
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestConfigBind(t *testing.T) {
+	tests := map[string][]string{
+		`bind = "127.0.0.1:53"`:                       {"127.0.0.1:53"},
+		`bind = ["127.0.0.1:53", "192.168.1.2:5353"]`: {"127.0.0.1:53", "192.168.1.2:5353"},
+	}
+
+	for data, expected := range tests {
+		var c config
+		if _, err := toml.Decode(data, &c); err != nil {
+			t.Errorf("%s: %s", data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual([]string(c.Bind), expected) {
+			t.Errorf("%s: expected %v, got %v", data, expected, c.Bind)
+		}
+	}
+
+	var c config
+	if _, err := toml.Decode(`bind = 53`, &c); err == nil {
+		t.Error("expected an error for a bind that isn't a string")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	var c config
+	if _, err := toml.Decode(defaultConfig, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("the default config is invalid: %s", err)
+	}
+
+	c.Bind = stringList{"0.0.0.0"}
+	c.Nullroute = stringList{"::1"}
+	c.Nameservers = nil
+	c.MaxTTL, c.Maxcount = -1, -1
+	c.Timeout = 0
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+	for _, problem := range []string{"bind 0.0.0.0", "nullroute ::1", "nameservers is required", "maxttl -1", "maxcount -1", "timeout 0"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected the error to list %q, got %s", problem, err)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "6 problems:") {
+		t.Errorf("expected every problem to be counted, got %s", err)
+	}
+}
+
+func TestLoadConfigProblems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grimd.toml")
+	if err := WriteDefaultConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GRIMD_NULLROUTE", "1.2.3")
+	t.Setenv("GRIMD_TIMEOUT", "0")
+	t.Setenv("GRIMD_UPDATEINTERVAL", "often")
+	t.Setenv("GRIMD_ALLOWEDCLIENTS", "somewhere")
+	t.Setenv("GRIMD_ANONYMIZECLIENTS", "mask")
+	t.Setenv("GRIMD_BLOCKEDTLDS", "co.uk")
+	t.Setenv("GRIMD_APITLSCERT", "cert.pem")
+
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+	for _, problem := range []string{"nullroute 1.2.3", "timeout 0", "update interval often", "allowed client somewhere", "anonymizeclients mask", "blocked tld co.uk", "apitlscert and apitlskey"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected the error to list %q, got %s", problem, err)
+		}
+	}
+	if !strings.Contains(err.Error(), "7 problems:") {
+		t.Errorf("expected every problem to be listed once, got %s", err)
+	}
+}
+
+func TestWriteDefaultConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grimd.toml")
+	if err := WriteDefaultConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("the generated config doesn't load: %s", err)
+	}
+	if len(c.Nameservers) == 0 {
+		t.Error("the generated config has no defaults")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("bind = \"127.0.0.1:53\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDefaultConfig(path); err == nil {
+		t.Error("expected an error for a config that already exists")
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "bind = \"127.0.0.1:53\"\n" {
+		t.Error("the existing config was overwritten")
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grimd.toml")
+	if err := WriteDefaultConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GRIMD_BIND", "127.0.0.1:5353")
+	t.Setenv("GRIMD_NAMESERVERS", "1.1.1.1:53, 1.0.0.1:53")
+	t.Setenv("GRIMD_SOURCES", "lists.txt")
+	t.Setenv("GRIMD_TIMEOUT", "2")
+	t.Setenv("GRIMD_TTL", "60")
+	t.Setenv("GRIMD_MONITORMODE", "true")
+	t.Setenv("GRIMD_WHITELIST", "")
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual([]string(c.Bind), []string{"127.0.0.1:5353"}) {
+		t.Errorf("expected the bind from the environment, got %v", c.Bind)
+	}
+	if !reflect.DeepEqual(c.Nameservers, []string{"1.1.1.1:53", "1.0.0.1:53"}) {
+		t.Errorf("expected the nameservers from the environment, got %v", c.Nameservers)
+	}
+	if !reflect.DeepEqual(c.Sources, []source{{URL: "lists.txt"}}) {
+		t.Errorf("expected the sources from the environment, got %v", c.Sources)
+	}
+	if c.Timeout != 2 || c.TTL != 60 || !c.MonitorMode || len(c.Whitelist) != 0 {
+		t.Errorf("expected the settings from the environment, got timeout %d, ttl %d, monitormode %v, whitelist %v", c.Timeout, c.TTL, c.MonitorMode, c.Whitelist)
+	}
+	if c.Interval != 200 {
+		t.Errorf("expected the settings without an environment variable from the file, got interval %d", c.Interval)
+	}
+
+	t.Setenv("GRIMD_TIMEOUT", "soon")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "GRIMD_TIMEOUT") {
+		t.Errorf("expected an error for an invalid environment variable, got %v", err)
+	}
+}
+
+func TestConfigListenAddrs(t *testing.T) {
+	tests := []struct {
+		data     string
+		udp, tcp []string
+	}{
+		{`bind = "0.0.0.0:53"`, []string{"0.0.0.0:53"}, []string{"0.0.0.0:53"}},
+		{"bind = \"0.0.0.0:53\"\nbindtcp = \"127.0.0.1:53\"", []string{"0.0.0.0:53"}, []string{"127.0.0.1:53"}},
+		{"bind = \"0.0.0.0:53\"\nbindtcp = \"none\"", []string{"0.0.0.0:53"}, nil},
+		{"bind = \"0.0.0.0:53\"\nbindudp = \"none\"\nbindtcp = [\"127.0.0.1:53\", \"[::1]:53\"]", nil, []string{"127.0.0.1:53", "[::1]:53"}},
+	}
+
+	for _, test := range tests {
+		var c config
+		if _, err := toml.Decode(test.data, &c); err != nil {
+			t.Errorf("%s: %s", test.data, err)
+			continue
+		}
+
+		if udp := c.listenAddrs("udp"); !reflect.DeepEqual(udp, test.udp) {
+			t.Errorf("%q: expected udp listeners on %v, got %v", test.data, test.udp, udp)
+		}
+		if tcp := c.listenAddrs("tcp"); !reflect.DeepEqual(tcp, test.tcp) {
+			t.Errorf("%q: expected tcp listeners on %v, got %v", test.data, test.tcp, tcp)
+		}
+	}
+}
+
+func TestConfigSources(t *testing.T) {
+	var c config
+	data := `sources = ["https://example.com/hosts", {url = "https://example.com/abp.txt", format = "abp"}]`
+	if _, err := toml.Decode(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []source{{URL: "https://example.com/hosts"}, {URL: "https://example.com/abp.txt", Format: formatABP}}
+	if !reflect.DeepEqual(c.Sources, expected) {
+		t.Errorf("expected %v, got %v", expected, c.Sources)
+	}
+
+	c = config{}
+	if _, err := toml.Decode(`sources = [{url = "lists.txt", format = "csv"}]`, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.parse(); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+
+	c = config{}
+	if _, err := toml.Decode(`sources = [{url = "lists.txt", enabled = false, priority = 10}]`, &c); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []source{{URL: "lists.txt", Disabled: true, Priority: 10}}; !reflect.DeepEqual(c.Sources, expected) {
+		t.Errorf("expected %v, got %v", expected, c.Sources)
+	}
+
+	for _, data := range []string{`sources = [{format = "abp"}]`, `sources = [42]`, `sources = [{url = "lists.txt", enabled = "no"}]`} {
+		c = config{}
+		if _, err := toml.Decode(data, &c); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+}
+
+func TestConfigNullroute(t *testing.T) {
+	tests := []struct {
+		nullroute   stringList
+		nullroutev6 stringList
+		valid       bool
+	}{
+		{stringList{"0.0.0.0", "192.168.1.5"}, stringList{"::"}, true},
+		{nil, nil, true},
+		{stringList{"sinkhole"}, nil, false},
+		{stringList{"fd00::5"}, nil, false},
+		{nil, stringList{"0:0:0:0:0:0:0:0:0"}, false},
+	}
+
+	for _, test := range tests {
+		c := &config{Nullroute: test.nullroute, Nullroutev6: test.nullroutev6}
+		if err := c.parse(); (err == nil) != test.valid {
+			t.Errorf("%v %v: expected valid to be %v, got %v", test.nullroute, test.nullroutev6, test.valid, err)
+		}
+	}
+
+	c := &config{Nullroute: stringList{"0.0.0.0"}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.nullroutes) != 1 || len(c.nullroutes[0]) != net.IPv4len {
+		t.Errorf("expected the nullroute to be stored as an ipv4 address, got %v", c.nullroutes)
+	}
+}
+
+func TestConfigClientGroup(t *testing.T) {
+	var c config
+	data := `
+[groups.kids]
+clients = ["192.168.1.0/24", "fd00::/8"]
+
+[groups.guests]
+clients = ["192.168.1.200/29", "192.168.1.10"]
+`
+	if _, err := toml.Decode(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"192.168.1.20":  "kids",
+		"fd00::1":       "kids",
+		"192.168.1.201": "guests",
+		"192.168.1.10":  "guests",
+		"10.0.0.1":      "",
+	}
+
+	for ip, expected := range tests {
+		if name := c.ClientGroup(net.ParseIP(ip)); name != expected {
+			t.Errorf("%s: expected group %q, got %q", ip, expected, name)
+		}
+	}
+
+	c.Groups["../lists"] = group{}
+	if err := c.parse(); err == nil {
+		t.Error("expected an error for an invalid group name")
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"grimd.toml":          "include = [\"conf.d/servers.toml\"]\nbind = \"127.0.0.1:53\"\ntimeout = 5\nnameservers = [\"1.1.1.1:53\"]\n[staticrecords]\n\"nas.home\" = [\"A 192.168.1.10\"]\n",
+		"conf.d/servers.toml": "include = [\"static.toml\"]\ntimeout = 10\nnameservers = [\"8.8.8.8:53\"]\n",
+		"conf.d/static.toml":  "[staticrecords]\n\"printer.home\" = [\"A 192.168.1.20\"]\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := new(config)
+	if err := decodeConfig(filepath.Join(dir, "grimd.toml"), c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Timeout != 10 {
+		t.Errorf("expected the include to override the timeout, got %d", c.Timeout)
+	}
+	if len(c.Bind) != 1 || c.Bind[0] != "127.0.0.1:53" {
+		t.Errorf("expected the setting the include doesn't set to be kept, got %v", c.Bind)
+	}
+	if !reflect.DeepEqual(c.Nameservers, []string{"1.1.1.1:53", "8.8.8.8:53"}) {
+		t.Errorf("expected the nameservers of the include to be added, got %v", c.Nameservers)
+	}
+	if len(c.StaticRecords) != 2 {
+		t.Errorf("expected the static records of both files, got %v", c.StaticRecords)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf.d/static.toml"), []byte("include = [\"../grimd.toml\"]\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	err := decodeConfig(filepath.Join(dir, "grimd.toml"), new(config), nil)
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected an include cycle error, got %v", err)
+	}
+}
+
+func TestConfigUpdateInterval(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"": 0, "0": 0, "24h": 24 * time.Hour, "90m": 90 * time.Minute} {
+		c := &config{UpdateInterval: value}
+		if err := c.parse(); err != nil {
+			t.Errorf("%q: %s", value, err)
+			continue
+		}
+		if c.updateInterval != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, c.updateInterval)
+		}
+	}
+
+	for _, value := range []string{"-1h", "daily", "24"} {
+		if err := (&config{UpdateInterval: value}).parse(); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
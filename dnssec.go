@@ -0,0 +1,627 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultTrustAnchors are the DS records of the root zone key signing keys
+// KSK-2017 and KSK-2024
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// maxValidatorTTL bounds how long validated keys and the records used to
+	// validate them are kept, so rolled keys are picked up in time
+	maxValidatorTTL = time.Hour
+
+	// maxValidatorEntries bounds the number of records the validator keeps
+	maxValidatorEntries = 10000
+)
+
+// ValidationError is returned for answers that fail DNSSEC validation
+type ValidationError struct {
+	name, reason string
+}
+
+// Error formats a ValidationError
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s dnssec validation failed: %s", e.name, e.reason)
+}
+
+// Validator validates the DNSSEC signatures of answers, the keys of a zone are
+// looked up as needed and trusted once they chain up to a trust anchor.
+//
+// Signed records are checked against the keys of the signing zone, unsigned
+// records are only accepted when a signed delegation without DS records proves
+// that their zone is unsigned. Negative answers from signed zones need a signed
+// NSEC or NSEC3 record that denies the name or type, wildcard and closest
+// encloser proofs are not checked.
+type Validator struct {
+	anchors map[string][]*dns.DS
+	lookup  func(name string, qtype uint16) (*dns.Msg, error)
+
+	mu   sync.Mutex
+	keys map[string]zoneKeys
+	msgs map[string]cachedMsg
+}
+
+// zoneKeys are the validated keys of a zone, keys is empty for zones that are
+// proven to be unsigned
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+type cachedMsg struct {
+	msg    *dns.Msg
+	expire time.Time
+}
+
+// NewValidator returns a new Validator that trusts the keys matching anchors
+// and looks up the records it needs to validate answers with lookup
+func NewValidator(anchors []*dns.DS, lookup func(name string, qtype uint16) (*dns.Msg, error)) *Validator {
+	v := &Validator{
+		anchors: make(map[string][]*dns.DS),
+		lookup:  lookup,
+		keys:    make(map[string]zoneKeys),
+		msgs:    make(map[string]cachedMsg),
+	}
+
+	for _, ds := range anchors {
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+
+	return v
+}
+
+// Validate checks the signatures in the answer and authority sections of msg,
+// it returns whether or not the answer is secure. Answers from unsigned zones
+// are valid but insecure, an error is returned for bogus answers.
+func (v *Validator) Validate(msg *dns.Msg) (bool, error) {
+	if len(msg.Question) == 0 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return false, nil
+	}
+	q := msg.Question[0]
+
+	if len(msg.Answer) > 0 {
+		return v.verifySection(msg.Answer)
+	}
+
+	// only the records that deny the answer matter for a negative answer
+	var denial []dns.RR
+	for _, rr := range msg.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			denial = append(denial, rr)
+		}
+	}
+
+	secure, err := v.verifySection(denial)
+	if err != nil || !secure {
+		return false, err
+	}
+
+	if denies(msg.Ns, q.Name, q.Qtype, msg.Rcode == dns.RcodeNameError) {
+		return true, nil
+	}
+
+	// without any denial the answer is only valid if the zone is unsigned
+	insecure, err := v.insecure(q.Name)
+	if err != nil {
+		return false, err
+	}
+	if !insecure {
+		return false, ValidationError{q.Name, "the non-existence of the answer is not proven"}
+	}
+
+	return false, nil
+}
+
+// verifySection verifies every record set in a section, it returns false if
+// some of the records are from unsigned zones
+func (v *Validator) verifySection(section []dns.RR) (bool, error) {
+	sigs := signatures(section)
+
+	dname := false
+	for _, rr := range section {
+		dname = dname || rr.Header().Rrtype == dns.TypeDNAME
+	}
+
+	secure := true
+	for _, set := range rrsets(section) {
+		h := set[0].Header()
+
+		covering := signaturesFor(set, sigs)
+		// the CNAME records synthesized from a DNAME are never signed
+		if len(covering) == 0 && dname && h.Rrtype == dns.TypeCNAME {
+			continue
+		}
+		if len(covering) == 0 {
+			insecure, err := v.insecure(h.Name)
+			if err != nil {
+				return false, err
+			}
+			if !insecure {
+				return false, ValidationError{h.Name, fmt.Sprintf("%s records are not signed", dns.TypeToString[h.Rrtype])}
+			}
+			secure = false
+			continue
+		}
+
+		ok, err := v.verify(set, covering)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+	}
+
+	return secure, nil
+}
+
+// verify checks that a record set is signed by one of the keys of its zone,
+// it returns false without an error if the signing zone is unsigned
+func (v *Validator) verify(set []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	name := set[0].Header().Name
+	reason := fmt.Sprintf("%s records are not signed", dns.TypeToString[set[0].Header().Rrtype])
+
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, name) {
+			reason = fmt.Sprintf("signer %s is not a parent", sig.SignerName)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			reason = "the signature is not valid at this time"
+			continue
+		}
+
+		keys, err := v.zoneKeys(sig.SignerName)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) == 0 {
+			return false, nil
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, set); err != nil {
+				reason = err.Error()
+				continue
+			}
+			return true, nil
+		}
+	}
+
+	return false, ValidationError{name, reason}
+}
+
+// zoneKeys returns the validated keys of a zone, the keys are trusted when a
+// trust anchor or a validated DS record of the parent zone matches one that
+// signed them
+func (v *Validator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expire) {
+		return cached.keys, nil
+	}
+
+	ds, ok := v.anchors[zone]
+	if !ok {
+		msg, err := v.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+
+		var set []dns.RR
+		for _, rr := range msg.Answer {
+			if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, zone) {
+				ds = append(ds, d)
+				set = append(set, d)
+			}
+		}
+
+		if len(ds) == 0 {
+			cut, ok, err := v.noDS(zone, msg)
+			if err != nil {
+				return nil, err
+			}
+			// the denial is unsigned when a zone above is unsigned
+			if !ok {
+				if cut, err = v.insecure(zone); err != nil {
+					return nil, err
+				}
+			}
+			if !cut {
+				return nil, ValidationError{zone, "the absence of DS records is not proven"}
+			}
+			v.storeKeys(zone, nil, maxValidatorTTL)
+			return nil, nil
+		}
+
+		secure, err := v.verify(set, signaturesFor(set, signatures(msg.Answer)))
+		if err != nil {
+			return nil, err
+		}
+		if !secure {
+			v.storeKeys(zone, nil, maxValidatorTTL)
+			return nil, nil
+		}
+	}
+
+	msg, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*dns.DNSKEY
+	var set []dns.RR
+	for _, rr := range msg.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			keys = append(keys, key)
+			set = append(set, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ValidationError{zone, "the zone has no DNSKEY records"}
+	}
+
+	if !trusted(keys, ds, set, signaturesFor(set, signatures(msg.Answer))) {
+		return nil, ValidationError{zone, "no DNSKEY matching a DS record signed the keys"}
+	}
+
+	v.storeKeys(zone, keys, time.Duration(minTTL(set))*time.Second)
+
+	return keys, nil
+}
+
+// trusted returns whether or not one of the keys matches a DS record and
+// signed the key set
+func trusted(keys []*dns.DNSKEY, ds []*dns.DS, set []dns.RR, sigs []*dns.RRSIG) bool {
+	for _, key := range keys {
+		for _, d := range ds {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+			if digest := key.ToDS(d.DigestType); digest == nil || !strings.EqualFold(digest.Digest, d.Digest) {
+				continue
+			}
+
+			for _, sig := range sigs {
+				if sig.KeyTag == key.KeyTag() && sig.ValidityPeriod(time.Now()) && sig.Verify(key, set) == nil {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// insecure returns whether or not a name is in an unsigned zone, which is
+// proven by a signed delegation above it that has no DS records
+func (v *Validator) insecure(name string) (bool, error) {
+	labels := dns.SplitDomainName(name)
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if _, ok := v.anchors[dns.CanonicalName(zone)]; ok {
+			continue
+		}
+
+		msg, err := v.query(zone, dns.TypeDS)
+		if err != nil {
+			return false, err
+		}
+
+		hasDS := false
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, zone) {
+				hasDS = true
+			}
+		}
+		// the DS records are validated with the keys of the zone when it
+		// signs something, a forged DS record can't make data insecure
+		if hasDS {
+			continue
+		}
+
+		cut, ok, err := v.noDS(zone, msg)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, ValidationError{zone, "the absence of DS records is not proven"}
+		}
+		if cut {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// noDS checks the signed denial in a DS response without DS records, ok is
+// set if the denial proves that there are none and cut is set if the name is
+// a delegation to an unsigned zone
+func (v *Validator) noDS(name string, msg *dns.Msg) (cut bool, ok bool, err error) {
+	sigs := signatures(msg.Ns)
+
+	var denials []dns.RR
+	for _, set := range rrsets(msg.Ns) {
+		if t := set[0].Header().Rrtype; t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+
+		covering := signaturesFor(set, sigs)
+		if len(covering) == 0 {
+			continue
+		}
+
+		secure, err := v.verify(set, covering)
+		if err != nil {
+			return false, false, err
+		}
+		if secure {
+			denials = append(denials, set...)
+		}
+	}
+
+	for _, rr := range denials {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				if hasType(rr.TypeBitMap, dns.TypeDS) {
+					continue
+				}
+				return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA), true, nil
+			}
+			if nsecCovers(rr, name) {
+				return false, true, nil
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				if hasType(rr.TypeBitMap, dns.TypeDS) {
+					continue
+				}
+				return hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA), true, nil
+			}
+			if rr.Cover(name) {
+				// an opt-out range may contain unsigned delegations
+				return rr.Flags&1 == 1, true, nil
+			}
+		}
+	}
+
+	return false, false, nil
+}
+
+// query looks up a record used for validation, the answers are kept for their
+// TTL so that the keys of popular zones aren't looked up for every answer
+func (v *Validator) query(name string, qtype uint16) (*dns.Msg, error) {
+	key := dns.CanonicalName(name) + "/" + dns.TypeToString[qtype]
+
+	v.mu.Lock()
+	cached, ok := v.msgs[key]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expire) {
+		return cached.msg, nil
+	}
+
+	msg, err := v.lookup(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(minTTL(append(append([]dns.RR{}, msg.Answer...), msg.Ns...))) * time.Second
+	if ttl > maxValidatorTTL {
+		ttl = maxValidatorTTL
+	}
+
+	v.mu.Lock()
+	if len(v.msgs) >= maxValidatorEntries {
+		v.msgs = make(map[string]cachedMsg)
+	}
+	v.msgs[key] = cachedMsg{msg, time.Now().Add(ttl)}
+	v.mu.Unlock()
+
+	return msg, nil
+}
+
+func (v *Validator) storeKeys(zone string, keys []*dns.DNSKEY, ttl time.Duration) {
+	if ttl > maxValidatorTTL {
+		ttl = maxValidatorTTL
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.keys) >= maxValidatorEntries {
+		v.keys = make(map[string]zoneKeys)
+	}
+	v.keys[zone] = zoneKeys{keys, time.Now().Add(ttl)}
+}
+
+// denies returns whether or not the NSEC or NSEC3 records in a section deny
+// the existence of a name, or of the type at that name
+func denies(section []dns.RR, name string, qtype uint16, nxdomain bool) bool {
+	for _, rr := range section {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nxdomain && nsecCovers(rr, name) {
+				return true
+			}
+			if !nxdomain && strings.EqualFold(rr.Hdr.Name, name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nxdomain && rr.Cover(name) {
+				return true
+			}
+			if !nxdomain && rr.Match(name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nsecCovers returns whether or not a name falls between the owner and the
+// next name of an NSEC record, the last record of a zone wraps around
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(next, owner) <= 0 {
+		return canonicalCompare(name, owner) > 0 || canonicalCompare(name, next) < 0
+	}
+
+	return canonicalCompare(name, owner) > 0 && canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare compares two names in the canonical DNS order, where
+// names are compared label by label starting at the root
+func canonicalCompare(a, b string) int {
+	x, y := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+
+	for i, j := len(x)-1, len(y)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(x[i], y[j]); c != 0 {
+			return c
+		}
+	}
+
+	return len(x) - len(y)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsets groups the records of a section by name and type, signatures and
+// the OPT record are left out
+func rrsets(section []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[string]int)
+
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := dns.CanonicalName(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+
+	return sets
+}
+
+func signatures(section []dns.RR) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// signaturesFor returns the signatures that cover a record set
+func signaturesFor(set []dns.RR, sigs []*dns.RRSIG) []*dns.RRSIG {
+	h := set[0].Header()
+
+	var covering []*dns.RRSIG
+	for _, sig := range sigs {
+		if sig.TypeCovered == h.Rrtype && strings.EqualFold(sig.Hdr.Name, h.Name) {
+			covering = append(covering, sig)
+		}
+	}
+	return covering
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// stripDnssec removes the DNSSEC records a client didn't ask for from an
+// answer, unless they are the records that were queried
+func stripDnssec(msg *dns.Msg, qtype uint16) {
+	strip := func(section []dns.RR) []dns.RR {
+		kept := section[:0]
+		for _, rr := range section {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+}
+
+// dnssecKey returns the suffix added to cache keys for queries with the CD or
+// the DO bit set, the answers to them may be unvalidated or carry signatures,
+// so they are never handed to clients that asked without these bits
+func dnssecKey(req *dns.Msg) string {
+	opt := req.IsEdns0()
+	do := opt != nil && opt.Do()
+	if !req.CheckingDisabled && !do {
+		return ""
+	}
+
+	key := "+"
+	if req.CheckingDisabled {
+		key += "c"
+	}
+	if do {
+		key += "d"
+	}
+	return key
+}
+
+// keyDnssec returns whether a cache key was made by dnssecKey for a query with
+// the CD and the DO bit set
+func keyDnssec(key string) (cd, do bool) {
+	i := strings.IndexByte(key, '+')
+	if i < 0 {
+		return false, false
+	}
+
+	flags := key[i+1:]
+	if j := strings.IndexAny(flags, "@/"); j >= 0 {
+		flags = flags[:j]
+	}
+	return strings.Contains(flags, "c"), strings.Contains(flags, "d")
+}
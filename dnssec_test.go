@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a signed zone of the test hierarchy
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testZone{name, key, priv.(crypto.Signer)}
+}
+
+// sign returns the set followed by its signature
+func (z *testZone) sign(t *testing.T, inception, expiration time.Time, set ...dns.RR) []dns.RR {
+	h := set[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		TypeCovered: h.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(h.Name)),
+		OrigTtl:     h.Ttl,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.name,
+	}
+	if err := sig.Sign(z.priv, set); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(set, sig)
+}
+
+func (z *testZone) signNow(t *testing.T, set ...dns.RR) []dns.RR {
+	return z.sign(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), set...)
+}
+
+func testNSEC(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func testA(name, ip string) *dns.A {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}
+}
+
+func testAnswer(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	return m
+}
+
+// newTestValidator returns a validator for a hierarchy of the signed zones
+// . and example. with the unsigned delegation insecure.example.
+func newTestValidator(t *testing.T) (*Validator, *testZone) {
+	root, example := newTestZone(t, "."), newTestZone(t, "example.")
+
+	records := map[string]*dns.Msg{
+		"./DNSKEY":        testAnswer(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.signNow(t, root.key), nil),
+		"example./DNSKEY": testAnswer("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.signNow(t, example.key), nil),
+		"example./DS":     testAnswer("example.", dns.TypeDS, dns.RcodeSuccess, root.signNow(t, example.key.ToDS(dns.SHA256)), nil),
+		"insecure.example./DS": testAnswer("insecure.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+			example.signNow(t, testNSEC("insecure.example.", "www.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))),
+		"unsigned.example./DS": testAnswer("unsigned.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+			example.signNow(t, testNSEC("unsigned.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))),
+	}
+
+	lookup := func(name string, qtype uint16) (*dns.Msg, error) {
+		if msg, ok := records[name+"/"+dns.TypeToString[qtype]]; ok {
+			return msg, nil
+		}
+		return testAnswer(name, qtype, dns.RcodeNameError, nil, nil), nil
+	}
+
+	return NewValidator([]*dns.DS{root.key.ToDS(dns.SHA256)}, lookup), example
+}
+
+func TestValidatorSecure(t *testing.T) {
+	v, example := newTestValidator(t)
+
+	msg := testAnswer("www.example.", dns.TypeA, dns.RcodeSuccess, example.signNow(t, testA("www.example.", "192.0.2.1")), nil)
+	secure, err := v.Validate(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure {
+		t.Error("signed answer is not secure")
+	}
+}
+
+func TestValidatorBogus(t *testing.T) {
+	v, example := newTestValidator(t)
+
+	tampered := example.signNow(t, testA("www.example.", "192.0.2.1"))
+	tampered[0].(*dns.A).A = net.ParseIP("192.0.2.66")
+
+	expired := example.sign(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour), testA("www.example.", "192.0.2.1"))
+
+	tests := map[string]*dns.Msg{
+		"tampered": testAnswer("www.example.", dns.TypeA, dns.RcodeSuccess, tampered, nil),
+		"expired":  testAnswer("www.example.", dns.TypeA, dns.RcodeSuccess, expired, nil),
+		"unsigned": testAnswer("unsigned.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{testA("unsigned.example.", "192.0.2.1")}, nil),
+		"undenied": testAnswer("missing.example.", dns.TypeA, dns.RcodeNameError, nil, nil),
+	}
+
+	for name, msg := range tests {
+		if _, err := v.Validate(msg); err == nil {
+			t.Errorf("%s answer passed validation", name)
+		}
+	}
+}
+
+func TestValidatorInsecure(t *testing.T) {
+	v, _ := newTestValidator(t)
+
+	msg := testAnswer("host.insecure.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{testA("host.insecure.example.", "192.0.2.1")}, nil)
+	secure, err := v.Validate(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secure {
+		t.Error("answer from an unsigned zone is secure")
+	}
+}
+
+func TestValidatorDenial(t *testing.T) {
+	v, example := newTestValidator(t)
+
+	nxdomain := testAnswer("missing.example.", dns.TypeA, dns.RcodeNameError, nil,
+		example.signNow(t, testNSEC("insecure.example.", "www.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)))
+	nodata := testAnswer("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+		example.signNow(t, testNSEC("www.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)))
+
+	for name, msg := range map[string]*dns.Msg{"nxdomain": nxdomain, "nodata": nodata} {
+		secure, err := v.Validate(msg)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !secure {
+			t.Errorf("signed %s answer is not secure", name)
+		}
+	}
+}
+
+func TestDnssecKey(t *testing.T) {
+	tests := []struct{ cd, do bool }{{false, false}, {true, false}, {false, true}, {true, true}}
+
+	keys := make(map[string]bool)
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		req.CheckingDisabled = test.cd
+		if test.do {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+
+		key := KeyGen(Question{testDomain, "A", "IN"}) + dnssecKey(req) + groupKey("kids") + "/192.0.2.0/24"
+		if cd, do := keyDnssec(key); cd != test.cd || do != test.do {
+			t.Errorf("%s: expected cd %v and do %v, got %v and %v", key, test.cd, test.do, cd, do)
+		}
+		if group := keyGroup(key); group != "kids" {
+			t.Errorf("%s: expected group kids, got %q", key, group)
+		}
+		keys[key] = true
+	}
+
+	if len(keys) != len(tests) {
+		t.Errorf("expected every combination of the bits to have its own key, got %v", keys)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		if canonicalCompare(ordered[i], ordered[i+1]) >= 0 {
+			t.Errorf("%s should sort before %s", ordered[i], ordered[i+1])
+		}
+	}
+}
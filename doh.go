@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS messages sent over HTTPS
+const dohContentType = "application/dns-message"
+
+// dohClient sends queries to a DNS-over-HTTPS nameserver as POST requests
+type dohClient struct {
+	url    string
+	client *http.Client
+}
+
+// newDoHClient returns a client for a DNS-over-HTTPS upstream, connections
+// are reused by the http client and closed after being idle for maxIdle
+func newDoHClient(upstream *Upstream, timeout, maxIdle time.Duration) (*dohClient, error) {
+	proxy, err := upstreamProxy(upstream.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:             proxy,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: Config().TLSInsecure},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   maxIdle,
+	}
+
+	return &dohClient{url: upstream.URL, client: &http.Client{Transport: transport, Timeout: timeout}}, nil
+}
+
+// Exchange sends a query and returns the answer
+func (d *dohClient) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// the id is always 0 so that http caches can serve the answer
+	query := req.Copy()
+	query.Id = 0
+
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", dohContentType)
+	request.Header.Set("Accept", dohContentType)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered with %s", d.url, response.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, err
+	}
+	msg.Id = req.Id
+
+	return msg, nil
+}
+
+// upstreamProxy returns the proxy function of a DNS-over-HTTPS upstream from
+// the proxy of the upstream or else the proxy in the config, "none" connects
+// directly and without a proxy the one in the environment is used
+func upstreamProxy(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		proxy = Config().Proxy
+	}
+
+	switch proxy {
+	case "":
+		return proxyFromEnvironment, nil
+	case "none":
+		return nil, nil
+	}
+
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// proxyFromEnvironment returns the proxy of a request from HTTPS_PROXY and
+// NO_PROXY, or else from ALL_PROXY
+func proxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	if u, err := http.ProxyFromEnvironment(req); u != nil || err != nil {
+		return u, err
+	}
+
+	for _, name := range []string{"ALL_PROXY", "all_proxy"} {
+		if value := os.Getenv(name); value != "" {
+			return parseProxy(value)
+		}
+	}
+
+	return nil, nil
+}
+
+// parseProxy parses the url of an http, https or socks5 proxy
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %s has no host", proxy)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHLookup(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType || req.Unpack(body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, testA(req.Question[0].Name, "192.0.2.1"))
+		buf, _ := m.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(buf)
+	}))
+	defer server.Close()
+
+	withConfig(t, &config{
+		Nameservers: []string{server.URL + "/dns-query?proxy=none"},
+		TLSInsecure: true,
+		Interval:    200,
+		Timeout:     5,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	resp, err := NewResolver().Lookup("udp", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 {
+		t.Errorf("expected the answer of the DoH nameserver, got %v", resp)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	withConfig(t, &config{Proxy: "http://proxy.example.com:3128"})
+
+	req, _ := http.NewRequest(http.MethodPost, "https://dns.example.com/dns-query", nil)
+	tests := map[string]string{
+		"":                        "http://proxy.example.com:3128",
+		"socks5://127.0.0.1:9050": "socks5://127.0.0.1:9050",
+	}
+
+	for proxy, expected := range tests {
+		f, err := upstreamProxy(proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u, _ := f(req); u == nil || u.String() != expected {
+			t.Errorf("%q: expected proxy %s, got %v", proxy, expected, u)
+		}
+	}
+
+	if f, err := upstreamProxy("none"); err != nil || f != nil {
+		t.Error("expected no proxy for none")
+	}
+
+	upstream, err := ParseUpstream("https://dns.example.com/dns-query?proxy=socks5://127.0.0.1:9050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream.URL != "https://dns.example.com/dns-query" || upstream.Proxy != "socks5://127.0.0.1:9050" {
+		t.Errorf("expected the proxy to be taken from the url, got %+v", upstream)
+	}
+
+	if _, err := ParseUpstream("https://dns.example.com/dns-query?proxy=ftp://127.0.0.1"); err == nil {
+		t.Error("expected an error for an unsupported proxy scheme")
+	}
+}
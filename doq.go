@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqALPN is the application protocol of DNS-over-QUIC connections
+const doqALPN = "doq"
+
+// doqNoError is the application error code of a connection that is closed
+// because it's no longer needed
+const doqNoError = 0
+
+// doqClient sends queries to a DNS-over-QUIC nameserver, every query is sent
+// on its own stream of a connection that is reused until it goes idle
+type doqClient struct {
+	addr string
+	tls  *tls.Config
+	quic *quic.Config
+	conn *quic.Conn
+	mu   sync.Mutex
+}
+
+// newDoQClient returns a client for a DNS-over-QUIC upstream, connections are
+// closed after being idle for maxIdle, the tls session is kept so that the
+// next connection can send its first query with 0-RTT
+func newDoQClient(upstream *Upstream, maxIdle time.Duration) *doqClient {
+	tlsConfig := upstream.TLSConfig()
+	tlsConfig.NextProtos = []string{doqALPN}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	return &doqClient{
+		addr: upstream.Addr,
+		tls:  tlsConfig,
+		quic: &quic.Config{MaxIdleTimeout: maxIdle},
+	}
+}
+
+// Exchange sends a query and returns the answer
+func (d *doqClient) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	msg, err := d.exchange(ctx, req, false)
+	// a connection that was closed by the nameserver is dialed again once
+	if err != nil && ctx.Err() == nil && d.closed(err) {
+		msg, err = d.exchange(ctx, req, true)
+	}
+	return msg, err
+}
+
+// exchange sends a query on a new stream, redial replaces the connection
+func (d *doqClient) exchange(ctx context.Context, req *dns.Msg, redial bool) (*dns.Msg, error) {
+	conn, err := d.connection(ctx, redial)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(doqNoError)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// the id is always 0 and the message is prefixed with its length like
+	// over tcp, the client closes its side of the stream after the query
+	query := req.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(buf))), buf...)); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, length)
+	if _, err := io.ReadFull(stream, answer); err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(answer); err != nil {
+		return nil, err
+	}
+	msg.Id = req.Id
+
+	return msg, nil
+}
+
+// connection returns the connection to the nameserver, dialing it when there
+// is none, it was closed or redial is set
+func (d *doqClient) connection(ctx context.Context, redial bool) (*quic.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil && !redial && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+	if d.conn != nil {
+		d.conn.CloseWithError(doqNoError, "")
+		d.conn = nil
+	}
+
+	conn, err := quic.DialAddrEarly(ctx, d.addr, d.tls, d.quic)
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+
+	return conn, nil
+}
+
+// closed returns whether or not a query failed because its connection was
+// closed, e.g. after it went idle on the side of the nameserver
+func (d *doqClient) closed(err error) bool {
+	var idle *quic.IdleTimeoutError
+	var application *quic.ApplicationError
+	var reset *quic.StatelessResetError
+	return errors.As(err, &idle) || errors.As(err, &application) || errors.As(err, &reset)
+}
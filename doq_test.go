@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// startDoQUpstream returns the address of a DNS-over-QUIC nameserver that
+// answers every query for an A record with 192.0.2.1, it counts the
+// connections it accepted in conns
+func startDoQUpstream(t *testing.T, conns *int32) string {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "localhost")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+
+					var length uint16
+					if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+						return
+					}
+					buf := make([]byte, length)
+					req := new(dns.Msg)
+					if _, err := io.ReadFull(stream, buf); err != nil || req.Unpack(buf) != nil || req.Id != 0 {
+						stream.CancelWrite(1)
+						continue
+					}
+
+					m := new(dns.Msg)
+					m.SetReply(req)
+					m.Answer = append(m.Answer, testA(req.Question[0].Name, "192.0.2.1"))
+					answer, _ := m.Pack()
+					stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+					stream.Close()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestDoQLookup(t *testing.T) {
+	var conns int32
+	withConfig(t, &config{
+		Nameservers: []string{"quic://" + startDoQUpstream(t, &conns) + "?tls-servername=localhost"},
+		TLSInsecure: true,
+		Interval:    200,
+		Timeout:     5,
+		PoolMaxIdle: 10,
+	})
+
+	r := NewResolver()
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+		resp, err := r.Lookup("udp", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != req.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("expected the answer of the DNS-over-QUIC nameserver, got %v", resp)
+		}
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected the queries to share a connection, got %d connections", n)
+	}
+}
+
+func TestParseUpstreamQUIC(t *testing.T) {
+	upstream, err := ParseUpstream("quic://dns.adguard-dns.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream.Net != "quic" || upstream.Addr != "dns.adguard-dns.com:853" || upstream.ServerName != "dns.adguard-dns.com" {
+		t.Errorf("unexpected upstream %+v", upstream)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultECSPrefixV4 = 24
+	defaultECSPrefixV6 = 56
+)
+
+// ClientSubnet returns the EDNS0 client subnet for a query, which is the
+// subnet sent by the client, the configured override subnet or the address
+// of the client truncated to the configured prefix length. It returns nil
+// when client subnet forwarding is disabled.
+func ClientSubnet(req *dns.Msg, remote net.IP) *dns.EDNS0_SUBNET {
+	cfg := Config()
+
+	if !cfg.ECSEnabled {
+		return nil
+	}
+
+	if subnet := requestSubnet(req); subnet != nil {
+		return subnet
+	}
+
+	ip, prefix := remote, 0
+	if cfg.ecsSubnet != nil {
+		ip = cfg.ecsSubnet.IP
+		prefix, _ = cfg.ecsSubnet.Mask.Size()
+	}
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		if prefix == 0 {
+			prefix = cfg.ECSPrefixV4
+		}
+		if prefix <= 0 || prefix > net.IPv4len*8 {
+			prefix = defaultECSPrefixV4
+		}
+		subnet.Family = 1
+		subnet.Address = ip4.Mask(net.CIDRMask(prefix, net.IPv4len*8))
+	} else {
+		if prefix == 0 {
+			prefix = cfg.ECSPrefixV6
+		}
+		if prefix <= 0 || prefix > net.IPv6len*8 {
+			prefix = defaultECSPrefixV6
+		}
+		subnet.Family = 2
+		subnet.Address = ip.Mask(net.CIDRMask(prefix, net.IPv6len*8))
+	}
+	subnet.SourceNetmask = uint8(prefix)
+
+	return subnet
+}
+
+// requestSubnet returns the client subnet option of a message, if any
+func requestSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// stripSubnet removes the client subnet option from a message, so that an
+// option added by grimd is never returned to a client that didn't send one
+func stripSubnet(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// stripEdns removes the OPT record from a message
+func stripEdns(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
+
+// normalizeEdns returns a message whose OPT record only keeps what describes
+// the answer, the client subnet and extended errors, and advertises our own
+// buffer size, so that a cached answer never replays the cookie, padding or
+// nameserver id of the exchange it came from. The message is copied if it
+// changes.
+func normalizeEdns(msg *dns.Msg) *dns.Msg {
+	if msg == nil {
+		return nil
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return msg
+	}
+
+	transient := opt.UDPSize() != dns.DefaultMsgSize
+	for _, option := range opt.Option {
+		switch option.(type) {
+		case *dns.EDNS0_SUBNET, *dns.EDNS0_EDE:
+		default:
+			transient = true
+		}
+	}
+	if !transient {
+		return msg
+	}
+
+	msg = msg.Copy()
+	opt = msg.IsEdns0()
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		switch option.(type) {
+		case *dns.EDNS0_SUBNET, *dns.EDNS0_EDE:
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+
+	return msg
+}
+
+// subnetKey returns the suffix added to cache keys when answers depend on the
+// client subnet, so clients in different subnets never share cached answers
+func subnetKey(req *dns.Msg, remote net.IP) string {
+	subnet := ClientSubnet(req, remote)
+	if subnet == nil {
+		return ""
+	}
+
+	return "/" + (&net.IPNet{IP: subnet.Address, Mask: net.CIDRMask(int(subnet.SourceNetmask), len(subnet.Address)*8)}).String()
+}
+
+// keySubnet returns the client subnet a cache key was made for by subnetKey,
+// or nil if the key has none
+func keySubnet(key string) *dns.EDNS0_SUBNET {
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(key[i+1:])
+	if err != nil {
+		return nil
+	}
+
+	prefix, _ := network.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(prefix), Family: 2, Address: network.IP}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		subnet.Family = 1
+		subnet.Address = ip4
+	}
+
+	return subnet
+}
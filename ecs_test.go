@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// withSubnet adds a client subnet option to a query
+func withSubnet(req *dns.Msg, cidr string) *dns.Msg {
+	_, network, _ := net.ParseCIDR(cidr)
+	prefix, _ := network.Mask.Size()
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: uint8(prefix), Address: network.IP}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		subnet.Family, subnet.Address = 1, ip4
+	}
+
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+	return req
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        *config
+		remote   string
+		sent     string
+		expected string
+	}{
+		{"disabled", &config{}, "192.168.1.20", "", ""},
+		{"default ipv4 prefix", &config{ECSEnabled: true}, "192.168.1.20", "", "192.168.1.0/24"},
+		{"default ipv6 prefix", &config{ECSEnabled: true}, "2001:db8:1:2:3::1", "", "2001:db8:1::/56"},
+		{"ipv4 prefix", &config{ECSEnabled: true, ECSPrefixV4: 16}, "192.168.1.20", "", "192.168.0.0/16"},
+		{"ipv6 prefix", &config{ECSEnabled: true, ECSPrefixV6: 48}, "2001:db8:1:2:3::1", "", "2001:db8:1::/48"},
+		{"invalid prefix", &config{ECSEnabled: true, ECSPrefixV4: 40}, "192.168.1.20", "", "192.168.1.0/24"},
+		{"override subnet", &config{ECSEnabled: true, ECSSubnet: "198.51.100.0/24"}, "192.168.1.20", "", "198.51.100.0/24"},
+		{"override ipv6 subnet", &config{ECSEnabled: true, ECSSubnet: "2001:db8:ff::/48"}, "192.168.1.20", "", "2001:db8:ff::/48"},
+		{"client option", &config{ECSEnabled: true, ECSSubnet: "198.51.100.0/24"}, "192.168.1.20", "203.0.113.0/24", "203.0.113.0/24"},
+	}
+
+	for _, test := range tests {
+		if err := test.c.parse(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		withConfig(t, test.c)
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		if test.sent != "" {
+			withSubnet(req, test.sent)
+		}
+
+		subnet := ClientSubnet(req, net.ParseIP(test.remote))
+		if test.expected == "" {
+			if subnet != nil {
+				t.Errorf("%s: expected no subnet, got %v", test.name, subnet)
+			}
+			continue
+		}
+
+		if subnet == nil {
+			t.Errorf("%s: expected %s, got no subnet", test.name, test.expected)
+			continue
+		}
+		got := (&net.IPNet{IP: subnet.Address, Mask: net.CIDRMask(int(subnet.SourceNetmask), len(subnet.Address)*8)}).String()
+		if got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, got)
+		}
+	}
+}
+
+// startSubnetUpstream returns the address of a udp nameserver that echoes the
+// options of a query in its answer and sends the subnet it was asked with,
+// if any, to received
+func startSubnetUpstream(t *testing.T, received chan<- *dns.EDNS0_SUBNET) string {
+	return startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		received <- requestSubnet(req)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{testRR(req.Question[0].Name, 300)}
+		if opt := req.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), false)
+			m.IsEdns0().Option = opt.Option
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestClientSubnetForwarded(t *testing.T) {
+	received := make(chan *dns.EDNS0_SUBNET, 1)
+	withParsedConfig(t, &config{Nameservers: []string{startSubnetUpstream(t, received)}, ECSEnabled: true, Interval: 200, Timeout: 5})
+	remote := net.ParseIP("192.168.1.20")
+	r := NewResolver()
+
+	tests := []struct {
+		name      string
+		req       func(*dns.Msg) *dns.Msg
+		forwarded string
+		answered  bool
+	}{
+		{"without edns", func(m *dns.Msg) *dns.Msg { return m }, "192.168.1.0", false},
+		{"with edns", func(m *dns.Msg) *dns.Msg { return m.SetEdns0(dns.DefaultMsgSize, false) }, "192.168.1.0", false},
+		{"with a subnet", func(m *dns.Msg) *dns.Msg { return withSubnet(m, "203.0.113.0/24") }, "203.0.113.0", true},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		req = test.req(req)
+		edns := req.IsEdns0() != nil
+
+		resp, err := r.Lookup("udp", req, remote)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if subnet := <-received; subnet == nil || subnet.Address.String() != test.forwarded {
+			t.Errorf("%s: expected the nameserver to be asked for %s, got %v", test.name, test.forwarded, subnet)
+		}
+		if (resp.IsEdns0() != nil) != edns {
+			t.Errorf("%s: expected an OPT record in the answer only if the client sent one", test.name)
+		}
+		if answered := requestSubnet(resp) != nil; answered != test.answered {
+			t.Errorf("%s: expected the subnet in the answer to be %v, got %v", test.name, test.answered, answered)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// BlockGroup holds the domains blocked and allowed by the lists of a
+// blocklist group
+type BlockGroup struct {
+	Block *MemoryBlockCache
+	Allow *MemoryBlockCache
+}
+
+// BlockGroupCache holds the blocklist groups by name
+type BlockGroupCache struct {
+	Backend map[string]*BlockGroup
+	mu      sync.RWMutex
+}
+
+// Get returns the blocklist group with the given name
+func (c *BlockGroupCache) Get(name string) (*BlockGroup, bool) {
+	c.mu.RLock()
+	g, ok := c.Backend[name]
+	c.mu.RUnlock()
+	return g, ok
+}
+
+// Replace swaps in the groups of a rebuild
+func (c *BlockGroupCache) Replace(backend map[string]*BlockGroup) {
+	c.mu.Lock()
+	c.Backend = backend
+	c.mu.Unlock()
+}
+
+// Set blocks a domain in every group
+func (c *BlockGroupCache) Set(domain string) {
+	c.mu.RLock()
+	for _, g := range c.Backend {
+		g.Block.Set(domain, true)
+	}
+	c.mu.RUnlock()
+}
+
+// Remove unblocks a domain in every group
+func (c *BlockGroupCache) Remove(domain string) {
+	c.mu.RLock()
+	for _, g := range c.Backend {
+		g.Block.Remove(domain)
+	}
+	c.mu.RUnlock()
+}
+
+// groupKey returns the suffix added to cache keys for the clients of a
+// blocklist group, so that they never share blocked answers with other clients
+func groupKey(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "@" + name
+}
+
+// keyGroup returns the blocklist group a cache key was made for by groupKey,
+// or "" if the key has none
+func keyGroup(key string) string {
+	i := strings.IndexByte(key, '@')
+	if i < 0 {
+		return ""
+	}
+
+	name := key[i+1:]
+	if j := strings.IndexByte(name, '/'); j >= 0 {
+		name = name[:j]
+	}
+	return name
+}
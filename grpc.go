@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+
+	grimdpb "github.com/looterz/grimd/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// questionFeedBuffer is how many questions a stream may fall behind before
+// questions are dropped for it
+const questionFeedBuffer = 256
+
+// questionFeed fans the answered questions out to the streams of the gRPC API
+type questionFeed struct {
+	subscribers map[chan QuestionCacheEntry]bool
+	closed      bool
+	mu          sync.RWMutex
+}
+
+// Subscribe returns a channel that receives every question published from now
+// on, it's closed by Unsubscribe or when the feed is closed
+func (f *questionFeed) Subscribe() chan QuestionCacheEntry {
+	ch := make(chan QuestionCacheEntry, questionFeedBuffer)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		close(ch)
+		return ch
+	}
+	if f.subscribers == nil {
+		f.subscribers = make(map[chan QuestionCacheEntry]bool)
+	}
+	f.subscribers[ch] = true
+	return ch
+}
+
+// Unsubscribe stops sending questions to a subscribed channel and closes it
+func (f *questionFeed) Unsubscribe(ch chan QuestionCacheEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subscribers[ch] {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish sends a question to every subscriber without waiting, subscribers
+// that fell behind miss it
+func (f *questionFeed) Publish(entry QuestionCacheEntry) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// Active returns whether or not anything is subscribed to the feed
+func (f *questionFeed) Active() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.subscribers) > 0
+}
+
+// Close closes the channels of every subscriber, so the streams end before
+// the server is stopped
+func (f *questionFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subscribers {
+		close(ch)
+	}
+	f.subscribers = nil
+	f.closed = true
+}
+
+// controlServer implements the Control service of proto/grimd.proto
+type controlServer struct {
+	grimdpb.UnimplementedControlServer
+	handler *DNSHandler
+}
+
+func (s *controlServer) Block(ctx context.Context, req *grimdpb.DomainRequest) (*grimdpb.BlockResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+
+	BlockDomain(req.GetDomain())
+	s.handler.Evict(req.GetDomain())
+	return &grimdpb.BlockResponse{Success: true}, nil
+}
+
+func (s *controlServer) Unblock(ctx context.Context, req *grimdpb.DomainRequest) (*grimdpb.BlockResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+
+	if !UnblockDomain(req.GetDomain()) {
+		return &grimdpb.BlockResponse{Success: false}, nil
+	}
+	s.handler.Evict(req.GetDomain())
+	return &grimdpb.BlockResponse{Success: true}, nil
+}
+
+func (s *controlServer) FlushCache(ctx context.Context, req *grimdpb.FlushCacheRequest) (*grimdpb.FlushCacheResponse, error) {
+	if req.GetDomain() != "" {
+		return &grimdpb.FlushCacheResponse{Removed: int64(s.handler.Evict(req.GetDomain()))}, nil
+	}
+	return &grimdpb.FlushCacheResponse{Removed: int64(s.handler.Flush())}, nil
+}
+
+// Stats returns the same stats as GET /cache/stats
+func (s *controlServer) Stats(ctx context.Context, req *grimdpb.StatsRequest) (*grimdpb.StatsResponse, error) {
+	stats := s.handler.CacheStats(req.GetReset_())
+
+	// the counters are left out for caches that don't count
+	resp := &grimdpb.StatsResponse{
+		Size:         int64(stats["size"].(int)),
+		NegativeSize: int64(stats["negative_size"].(int)),
+		BlockSize:    int64(stats["block_size"].(int)),
+		Fill:         stats["fill"].(float64),
+	}
+	resp.Hits, _ = stats["hits"].(uint64)
+	resp.Misses, _ = stats["misses"].(uint64)
+	resp.Evictions, _ = stats["evictions"].(uint64)
+	return resp, nil
+}
+
+func (s *controlServer) StreamQuestions(req *grimdpb.StreamQuestionsRequest, stream grpc.ServerStreamingServer[grimdpb.QuestionCacheEntry]) error {
+	questions := QuestionFeed.Subscribe()
+	defer QuestionFeed.Unsubscribe(questions)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case entry, ok := <-questions:
+			if !ok {
+				return nil
+			}
+			if req.GetClient() != "" && entry.Remote != req.GetClient() {
+				continue
+			}
+			if req.GetBlocked() && !entry.Blocked {
+				continue
+			}
+
+			err := stream.Send(&grimdpb.QuestionCacheEntry{
+				Date:       entry.Date,
+				Client:     entry.Remote,
+				Blocked:    entry.Blocked,
+				Wouldblock: entry.WouldBlock,
+				Query:      &grimdpb.Question{Name: entry.Query.Qname, Type: entry.Query.Qtype, Class: entry.Query.Qclass},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcMutating returns whether or not a call changes something, like
+// isMutating for the web api
+func grpcMutating(method string, req interface{}) bool {
+	switch method {
+	case grimdpb.Control_Block_FullMethodName, grimdpb.Control_Unblock_FullMethodName, grimdpb.Control_FlushCache_FullMethodName:
+		return true
+	case grimdpb.Control_Stats_FullMethodName:
+		stats, ok := req.(*grimdpb.StatsRequest)
+		return ok && stats.GetReset_()
+	}
+	return false
+}
+
+// grpcAuth checks the credentials of a call like apiAuth, they're sent in the
+// authorization metadata the same way as the Authorization header
+func grpcAuth(ctx context.Context, method string, req interface{}) error {
+	cfg := Config()
+	if cfg.APIToken == "" && cfg.APIUser == "" {
+		return nil
+	}
+	if !cfg.APIAuthReads && !grpcMutating(method, req) {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if validCredentials(cfg, auth) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcAuth(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAuth(ss.Context(), info.FullMethod, nil); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcServer returns a server with the Control service registered, with the
+// certificate of the API server when one is configured
+func grpcServer(handler *DNSHandler) (*grpc.Server, error) {
+	cfg := Config()
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(grpcUnaryAuth), grpc.StreamInterceptor(grpcStreamAuth)}
+	if cfg.APITLSCert != "" {
+		cert := apiCertificate
+		if cert == nil {
+			var err error
+			if cert, err = loadCertificate(cfg.APITLSCert, cfg.APITLSKey); err != nil {
+				return nil, err
+			}
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: cert.GetCertificate, MinVersion: tls.VersionTLS12})))
+	}
+
+	server := grpc.NewServer(options...)
+	grimdpb.RegisterControlServer(server, &controlServer{handler: handler})
+	return server, nil
+}
+
+// StartGRPCServer launches the gRPC control API, the returned server is
+// stopped to stop it and is nil if the API is disabled
+func StartGRPCServer(handler *DNSHandler) (*grpc.Server, error) {
+	cfg := Config()
+	if cfg.GRPC == "" {
+		return nil, nil
+	}
+
+	server, err := grpcServer(handler)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", cfg.GRPC)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && cfg.APIToken == "" && cfg.APIUser == "" {
+		log.Printf("gRPC server on %s is reachable from the network without authentication\n", cfg.GRPC)
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("gRPC server failed: %s\n", err)
+		}
+	}()
+
+	log.Println("gRPC server listening on", cfg.GRPC)
+
+	return server, nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -12,6 +15,7 @@ const (
 	notIPQuery = 0
 	_IP4Query  = 4
 	_IP6Query  = 6
+	_PTRQuery  = 12
 )
 
 // Question type
@@ -23,10 +27,11 @@ type Question struct {
 
 // QuestionCacheEntry represents a full query from a client with metadata
 type QuestionCacheEntry struct {
-	Date    int64    `json:"date"`
-	Remote  string   `json:"client"`
-	Blocked bool     `json:"blocked"`
-	Query   Question `json:"query"`
+	Date       int64    `json:"date"`
+	Remote     string   `json:"client"`
+	Blocked    bool     `json:"blocked"`
+	WouldBlock bool     `json:"wouldblock"`
+	Query      Question `json:"query"`
 }
 
 // String formats a question
@@ -36,41 +41,140 @@ func (q *Question) String() string {
 
 // DNSHandler type
 type DNSHandler struct {
-	resolver *Resolver
-	cache    Cache
-	negCache Cache
+	// queued counts the queries waiting for a slot, first for 64-bit atomic
+	// alignment on 32-bit platforms
+	queued int64
+
+	resolver   *Resolver
+	cache      Cache
+	negCache   Cache
+	blockCache Cache
+
+	// inflight counts the queries that haven't been answered yet, stopping
+	// is set once they are drained and new queries are dropped from then on
+	inflight sync.WaitGroup
+	stopping bool
+	stopMu   sync.RWMutex
+	// slots holds a value for every query being handled, nil if the number
+	// of queries handled at once isn't limited
+	slots chan struct{}
 }
 
 // NewHandler returns a new DNSHandler
 func NewHandler() *DNSHandler {
+	cfg := Config()
+
 	var (
-		clientConfig *dns.ClientConfig
-		resolver     *Resolver
-		cache        Cache
-		negCache     Cache
+		resolver   *Resolver
+		cache      Cache
+		negCache   Cache
+		blockCache Cache
 	)
 
-	resolver = &Resolver{clientConfig}
+	resolver = NewResolver()
 
-	cache = &MemoryCache{
-		Backend:  make(map[string]Mesg, Config.Maxcount),
-		Expire:   time.Duration(Config.Expire) * time.Second,
-		Maxcount: Config.Maxcount,
+	memoryCache := &MemoryCache{
+		Expire:            time.Duration(cfg.Expire) * time.Second,
+		MinTTL:            time.Duration(cfg.MinTTL) * time.Second,
+		MaxTTL:            time.Duration(cfg.MaxTTL) * time.Second,
+		Maxcount:          cfg.Maxcount,
+		PrefetchThreshold: float64(cfg.PrefetchThreshold) / 100,
+		PrefetchMinHits:   cfg.PrefetchMinHits,
+	}
+	if cfg.ServeStale {
+		memoryCache.StaleWindow = time.Duration(cfg.StaleWindow) * time.Second
 	}
+	cache = memoryCache
 	negCache = &MemoryCache{
-		Backend:  make(map[string]Mesg),
-		Expire:   time.Duration(Config.Expire) * time.Second / 2,
-		Maxcount: Config.Maxcount,
+		Expire:   time.Duration(cfg.Expire) * time.Second / 2,
+		MinTTL:   time.Duration(cfg.MinTTL) * time.Second,
+		MaxTTL:   time.Duration(cfg.MaxTTL) * time.Second,
+		Maxcount: cfg.Maxcount,
+	}
+	// blocks have a cache of their own, so that a flood of blocked queries
+	// doesn't evict the answers
+	blockCache = &MemoryCache{
+		Expire:   time.Duration(cfg.Expire) * time.Second,
+		MinTTL:   time.Duration(cfg.MinTTL) * time.Second,
+		MaxTTL:   time.Duration(cfg.MaxTTL) * time.Second,
+		Lifetime: time.Duration(cfg.BlockCacheTTL) * time.Second,
+		Maxcount: cfg.BlockCacheMaxcount,
+	}
+
+	h := &DNSHandler{resolver: resolver, cache: cache, negCache: negCache, blockCache: blockCache}
+	if cfg.MaxConcurrentQueries > 0 {
+		h.slots = make(chan struct{}, cfg.MaxConcurrentQueries)
+	}
+	memoryCache.Prefetch = h.prefetch
+
+	return h
+}
+
+// prefetch refreshes a popular cache entry before it expires, blocked domains
+// are answered from the cache until they expire
+func (h *DNSHandler) prefetch(key string, msg *dns.Msg) {
+	q := msg.Question[0]
+	Q := Question{UnFqdn(q.Name), dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]}
+
+	if isBlocked(Q.Qname, keyGroup(key)) {
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	cd, do := keyDnssec(key)
+	req.CheckingDisabled = cd
+	if subnet := keySubnet(key); subnet != nil || do {
+		req.SetEdns0(dns.DefaultMsgSize, do)
+		if subnet != nil {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
+		}
+	}
+
+	mesg, err := h.resolver.Lookup("udp", req, nil)
+	if err != nil {
+		LogEvent(0, NewEvent(nil, Q, "prefetch_error").WithError(err), "prefetch %s failed: %s\n", Q.String(), err)
+		return
+	}
+	if len(mesg.Answer) == 0 || mesg.Truncated {
+		return
+	}
+	// the answer is left to expire, so that the next query blocks it
+	if _, blocked := blockedTarget(mesg, keyGroup(key)); blocked {
+		return
+	}
+	if _, rebinding := rebindingAddress(q.Name, mesg); rebinding {
+		return
+	}
+	mesg, _ = rewriteAnswer(q.Name, mesg)
+
+	// keep the shape of the answer the clients were given
+	if msg.IsEdns0() == nil {
+		stripEdns(mesg)
+	} else if requestSubnet(msg) == nil {
+		stripSubnet(mesg)
 	}
 
-	return &DNSHandler{resolver, cache, negCache}
+	if err := h.cache.Set(key, mesg); err != nil {
+		LogEvent(0, NewEvent(nil, Q, "cache_error").WithError(err), "set %s cache failed: %s\n", Q.String(), err.Error())
+		return
+	}
+	LogEvent(1, NewEvent(nil, Q, "prefetch"), "prefetched %s\n", Q.String())
 }
 
 func (h *DNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
+	cfg := Config()
+
 	defer w.Close()
 	q := req.Question[0]
 	Q := Question{UnFqdn(q.Name), dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]}
 
+	// the result is set before every answer, the time until it's written is
+	// observed under that result
+	tw := &timedWriter{ResponseWriter: w, start: time.Now(), result: "forwarded"}
+	w = tw
+
 	var remote net.IP
 	if Net == "tcp" {
 		remote = w.RemoteAddr().(*net.TCPAddr).IP
@@ -78,133 +182,667 @@ func (h *DNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
 		remote = w.RemoteAddr().(*net.UDPAddr).IP
 	}
 
-	if Config.LogLevel > 0 {
-		log.Printf("%s lookup　%s\n", remote, Q.String())
+	queriesTotal.Inc()
+
+	if !cfg.ClientAllowed(remote) {
+		LogEvent(1, NewEvent(remote, Q, "refused"), "%s refused %s\n", remote, Q.String())
+
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		tw.result = "refused"
+		h.reply(Net, w, req, m)
+		return
+	}
+
+	if cfg.disallowedQtypes[q.Qtype] {
+		LogEvent(1, NewEvent(remote, Q, "qtype_disallowed"), "%s disallowed qtype %s\n", remote, Q.String())
+
+		tw.result = "refused"
+		h.reply(Net, w, req, h.disallowedResponse(req))
+		return
+	}
+
+	LogEvent(1, NewEvent(remote, Q, "lookup"), "%s lookup　%s\n", remote, Q.String())
+	TopQueried.Add(Q.Qname)
+
+	// static records take precedence over the blocklists and the nameservers
+	if m := h.staticResponse(Net, req, remote); m != nil {
+		LogEvent(1, NewEvent(remote, Q, "static"), "%s answered from static records\n", Q.String())
+		tw.result = "static"
+		h.reply(Net, w, req, m)
+
+		logQuestion(remote, Q, false, false)
+		return
 	}
 
 	IPQuery := h.isIPQuery(q)
 
-	// Only query cache when qtype == 'A'|'AAAA' , qclass == 'IN'
-	key := KeyGen(Q)
-	if IPQuery > 0 {
+	// the nameservers can't know the nullroutes, asking them only leaks them
+	if IPQuery == _PTRQuery {
+		if m := h.reverseResponse(req); m != nil {
+			LogEvent(1, NewEvent(remote, Q, "reverse"), "%s answered for a nullroute\n", Q.String())
+			tw.result = "static"
+			h.reply(Net, w, req, m)
+
+			logQuestion(remote, Q, false, false)
+			return
+		}
+	}
+
+	group := cfg.ClientGroup(remote)
+
+	// Only query cache when qclass == 'IN', the key tells the qtypes apart.
+	// Names are keyed case insensitively, so that clients that randomize the
+	// case of their queries share the cached answers.
+	cacheable := q.Qclass == dns.ClassINET
+	key := KeyGen(Question{normalizeDomain(Q.Qname), Q.Qtype, Q.Qclass}) + dnssecKey(req) + groupKey(group) + subnetKey(req, remote)
+	if cacheable {
+		if mesg, err := h.blockCache.Get(key); err == nil {
+			LogEvent(1, NewEvent(remote, Q, "block_cache_hit"), "%s hit block cache\n", Q.String())
+			TopBlocked.Add(Q.Qname)
+
+			// the cache hands out copies, so the Id and the question the
+			// client sent can be set in place
+			mesg.Id = req.Id
+			mesg.Question = req.Question
+			tw.result = "blocked"
+			h.reply(Net, w, req, mesg)
+			return
+		}
+
 		mesg, err := h.cache.Get(key)
 		if err != nil {
+			cacheMissesTotal.Inc()
 			if mesg, err = h.negCache.Get(key); err != nil {
-				if Config.LogLevel > 0 {
-					log.Printf("%s didn't hit cache\n", Q.String())
-				}
+				LogEvent(1, NewEvent(remote, Q, "cache_miss"), "%s didn't hit cache\n", Q.String())
+			} else if stale, ok := h.staleAnswer(key, mesg); ok {
+				// the nameservers failed recently, they are asked again
+				// in the background
+				LogEvent(1, NewEvent(remote, Q, "stale_answer"), "%s answered with a stale answer\n", Q.String())
+				tw.result = "cached"
+				stale.Id = req.Id
+				stale.Question = req.Question
+				h.reply(Net, w, req, stale)
+				return
 			} else {
-				if Config.LogLevel > 0 {
-					log.Printf("%s hit negative cache\n", Q.String())
+				LogEvent(1, NewEvent(remote, Q, "negative_cache_hit"), "%s hit negative cache\n", Q.String())
+				tw.result = "cached"
+
+				// failures cached without a message are answered with SERVFAIL
+				if mesg == nil {
+					dns.HandleFailed(w, req)
+					return
 				}
-				dns.HandleFailed(w, req)
+				mesg.Id = req.Id
+				mesg.Question = req.Question
+				h.reply(Net, w, req, mesg)
 				return
 			}
 		} else {
-			if Config.LogLevel > 0 {
-				log.Printf("%s hit cache\n", Q.String())
-			}
-
-			// we need this copy against concurrent modification of Id
-			msg := *mesg
-			msg.Id = req.Id
-			w.WriteMsg(&msg)
+			cacheHitsTotal.Inc()
+			LogEvent(1, NewEvent(remote, Q, "cache_hit"), "%s hit cache\n", Q.String())
+			tw.result = "cached"
+
+			// the cache hands out copies, so the Id and the question the
+			// client sent can be set in place
+			mesg.Id = req.Id
+			mesg.Question = req.Question
+			h.reply(Net, w, req, mesg)
 			return
 		}
 	}
 
-	// Check blocklist
-	if IPQuery > 0 {
-		exists := BlockCache.Exists(Q.Qname)
-		if exists {
-			m := new(dns.Msg)
-			m.SetReply(req)
+	// Check blocklist, blocked domains are blocked for every qtype, in monitor
+	// mode they're only recorded and resolved like any other domain
+	listed := isBlocked(Q.Qname, group)
+	if listed && !cfg.MonitorMode {
+		m := h.blockResponse(req, IPQuery)
+		tw.result = "blocked"
+		h.reply(Net, w, req, m)
+		blockedTotal.Inc()
+		TopBlocked.Add(Q.Qname)
 
-			nullroute := net.ParseIP(Config.Nullroute)
-			nullroutev6 := net.ParseIP(Config.Nullroutev6)
+		LogEvent(1, NewEvent(remote, Q, "blocked"), "%s found in blocklist\n", Q.Qname)
 
-			switch IPQuery {
-			case _IP4Query:
-				rrHeader := dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    Config.TTL,
-				}
-				a := &dns.A{Hdr: rrHeader, A: nullroute}
-				m.Answer = append(m.Answer, a)
-			case _IP6Query:
-				rrHeader := dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    Config.TTL,
-				}
-				a := &dns.AAAA{Hdr: rrHeader, AAAA: nullroutev6}
-				m.Answer = append(m.Answer, a)
+		// log query
+		logQuestion(remote, Q, true, false)
+
+		// cache the block
+		if cacheable {
+			err := h.blockCache.Set(key, m)
+			if err != nil {
+				LogEvent(0, NewEvent(remote, Q, "cache_error").WithError(err), "Set %s block cache failed: %s\n", Q.String(), err.Error())
 			}
+		}
 
-			w.WriteMsg(m)
+		return
+	}
+	wouldBlock := listed
+	if wouldBlock {
+		LogEvent(1, NewEvent(remote, Q, "would_block"), "%s found in blocklist, not blocked in monitor mode\n", Q.Qname)
+	} else {
+		LogEvent(1, NewEvent(remote, Q, "not_blocked"), "%s not found in blocklist\n", Q.Qname)
+	}
 
-			if Config.LogLevel > 0 {
-				log.Printf("%s found in blocklist\n", Q.Qname)
-			}
+	// the nameservers aren't asked for addresses that can't be reached
+	if q.Qtype == dns.TypeAAAA && cfg.DisableIPv6 {
+		LogEvent(1, NewEvent(remote, Q, "ipv6_disabled"), "%s answered without addresses, ipv6 is disabled\n", Q.String())
 
-			// log query
-			NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q, Blocked: true}
-			go QuestionCache.Add(NewEntry)
+		m := withSOA(new(dns.Msg).SetReply(req))
+		tw.result = "static"
+		h.reply(Net, w, req, m)
 
-			// cache the block
-			err := h.cache.Set(key, m)
-			if err != nil {
-				log.Printf("Set %s block cache failed: %s\n", Q.String(), err.Error())
+		logQuestion(remote, Q, false, wouldBlock)
+
+		// the empty answer lives in the negative cache for as long as its
+		// SOA record allows
+		if cacheable {
+			if err := h.negCache.Set(key, m); err != nil {
+				LogEvent(0, NewEvent(remote, Q, "cache_error").WithError(err), "set %s negative cache failed: %v\n", Q.String(), err)
 			}
+		}
+		return
+	}
 
-			return
+	mesg, err := h.resolver.Lookup(Net, req, remote)
+
+	// the nameserver had more records than fit in a udp answer
+	if err == nil && mesg.Truncated && Net == "udp" && cfg.RetryTruncated {
+		LogEvent(1, NewEvent(remote, Q, "truncated_retry"), "%s truncated, retrying over tcp\n", Q.String())
+		if tcp, err := h.resolver.Lookup("tcp", req, remote); err == nil {
+			mesg = tcp
+		} else {
+			LogEvent(0, NewEvent(remote, Q, "resolve_error").WithError(err), "resolve query over tcp error %s\n", err)
 		}
-		if Config.LogLevel > 0 {
-			log.Printf("%s not found in blocklist\n", Q.Qname)
+	}
+
+	// the records are only collected when they're logged
+	if err == nil && LogEnabled(2, "answer") {
+		ev := NewEvent(remote, Q, "answer").WithAnswers(mesg)
+		LogEvent(2, ev, "%s answered with %s\n", Q.String(), strings.Join(ev.Answers, " "))
+	}
+
+	blocked := false
+	if err == nil {
+		if target, ok := blockedTarget(mesg, group); ok && cfg.MonitorMode {
+			LogEvent(1, NewEvent(remote, Q, "would_block"), "%s has a CNAME to %s, not blocked in monitor mode\n", Q.Qname, target)
+			wouldBlock = true
+		} else if ok {
+			LogEvent(1, NewEvent(remote, Q, "cname_blocked"), "%s blocked by CNAME to %s\n", Q.Qname, target)
+			blockedTotal.Inc()
+			TopBlocked.Add(Q.Qname)
+			mesg, blocked = h.blockResponse(req, IPQuery), true
+			tw.result = "blocked"
+		} else if ip, ok := rebindingAddress(q.Name, mesg); ok && cfg.MonitorMode {
+			LogEvent(1, NewEvent(remote, Q, "would_block"), "%s resolves to private address %s, not blocked in monitor mode\n", Q.Qname, ip)
+			wouldBlock = true
+		} else if ok {
+			LogEvent(1, NewEvent(remote, Q, "rebind_blocked"), "%s blocked as dns rebinding, it resolves to private address %s\n", Q.Qname, ip)
+			blockedTotal.Inc()
+			TopBlocked.Add(Q.Qname)
+			mesg, blocked = withSOA(new(dns.Msg).SetRcode(req, dns.RcodeNameError)), true
+			tw.result = "blocked"
+		}
+
+		// the addresses of blocks are never rewritten
+		if !blocked {
+			if rewritten, ok := rewriteAnswer(q.Name, mesg); ok {
+				LogEvent(1, NewEvent(remote, Q, "rewritten"), "%s answer rewritten\n", Q.String())
+				mesg = rewritten
+			}
 		}
 	}
 
 	// log query
-	NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q, Blocked: false}
-	go QuestionCache.Add(NewEntry)
-
-	mesg, err := h.resolver.Lookup(Net, req)
+	logQuestion(remote, Q, blocked, wouldBlock)
 
 	if err != nil {
-		log.Printf("resolve query error %s\n", err)
-		dns.HandleFailed(w, req)
+		LogEvent(0, NewEvent(remote, Q, "resolve_error").WithError(err), "resolve query error %s\n", err)
+
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		if stale, ok := h.staleAnswer(key, m); ok && cacheable {
+			LogEvent(1, NewEvent(remote, Q, "stale_answer"), "%s answered with a stale answer\n", Q.String())
+			tw.result = "cached"
+			stale.Id = req.Id
+			stale.Question = req.Question
+			h.reply(Net, w, req, stale)
+		} else {
+			tw.result = "error"
+			h.reply(Net, w, req, m)
+		}
 
 		// cache the failure, too!
-		if err = h.negCache.Set(key, nil); err != nil {
-			log.Printf("set %s negative cache failed: %v\n", Q.String(), err)
+		if err = h.negCache.Set(key, m); err != nil {
+			LogEvent(0, NewEvent(remote, Q, "cache_error").WithError(err), "set %s negative cache failed: %v\n", Q.String(), err)
 		}
 		return
 	}
 
-	w.WriteMsg(mesg)
+	h.reply(Net, w, req, mesg)
 
-	if IPQuery > 0 && len(mesg.Answer) > 0 {
+	// a truncated answer may be missing records, and an empty answer is only
+	// cached when it's a negative answer
+	if mesg.Truncated {
+		return
+	}
+
+	if cacheable && blocked {
+		if err = h.blockCache.Set(key, mesg); err != nil {
+			LogEvent(0, NewEvent(remote, Q, "cache_error").WithError(err), "set %s block cache failed: %s\n", Q.String(), err.Error())
+		}
+		return
+	}
+
+	if cacheable && len(mesg.Answer) > 0 {
 		err = h.cache.Set(key, mesg)
 		if err != nil {
-			log.Printf("set %s cache failed: %s\n", Q.String(), err.Error())
+			LogEvent(0, NewEvent(remote, Q, "cache_error").WithError(err), "set %s cache failed: %s\n", Q.String(), err.Error())
+		}
+		LogEvent(1, NewEvent(remote, Q, "cache_insert"), "insert %s into cache\n", Q.String())
+	}
+
+	// negative answers are cached for as long as their SOA record allows
+	if cacheable && !blocked && isNegative(mesg) {
+		if err = h.negCache.Set(key, mesg); err != nil {
+			LogEvent(0, NewEvent(remote, Q, "cache_error").WithError(err), "set %s negative cache failed: %v\n", Q.String(), err)
+		}
+		LogEvent(1, NewEvent(remote, Q, "negative_cache_insert"), "insert %s into negative cache\n", Q.String())
+	}
+}
+
+// staleAnswer returns the expired answer for a key when serve-stale is enabled
+// and the nameservers failed to answer, failure is the failure that was
+// cached or is about to be cached for the key
+func (h *DNSHandler) staleAnswer(key string, failure *dns.Msg) (*dns.Msg, bool) {
+	if !Config().ServeStale || (failure != nil && failure.Rcode != dns.RcodeServerFailure) {
+		return nil, false
+	}
+
+	c, ok := h.cache.(*MemoryCache)
+	if !ok {
+		return nil, false
+	}
+	return c.GetStale(key)
+}
+
+// logQuestion adds a query to the question cache and the query log, unless
+// they are disabled, the client is anonymized as configured. wouldBlock marks the
+// queries that were only resolved because of monitor mode.
+func logQuestion(remote net.IP, Q Question, blocked, wouldBlock bool) {
+	cfg := Config()
+
+	// questioncachecap = 0 keeps the questions from the streams as well
+	streamed := cfg.QuestionCacheCap != 0 && QuestionFeed.Active()
+	if cfg.QuestionCacheCap == 0 && cfg.QueryLog == "" && !streamed {
+		return
+	}
+
+	client := anonymizeClient(remote, cfg.AnonymizeClients)
+	NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: client, Query: Q, Blocked: blocked, WouldBlock: wouldBlock}
+	if streamed {
+		QuestionFeed.Publish(NewEntry)
+	}
+	if cfg.QueryLog != "" {
+		writeQueryLog(NewEntry)
+	}
+	if cfg.QuestionCacheCap != 0 {
+		go QuestionCache.Add(NewEntry)
+	}
+}
+
+// isNegative returns whether or not an answer is a NXDOMAIN or NODATA answer
+// that can be cached, which requires a SOA record
+func isNegative(msg *dns.Msg) bool {
+	if len(msg.Answer) > 0 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return false
+	}
+	_, ok := negativeTTL(msg)
+	return ok
+}
+
+// withSOA adds the configured SOA record to a negative answer that grimd made
+// up itself, downstream caches only keep a negative answer with a SOA record
+// for its TTL. Other answers and those with an authority section are returned
+// as they are.
+func withSOA(m *dns.Msg) *dns.Msg {
+	if len(m.Answer) > 0 || len(m.Ns) > 0 || len(m.Question) == 0 || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return m
+	}
+
+	m.Ns = append(m.Ns, Config().soa(m.Question[0].Name))
+	return m
+}
+
+// reply writes an answer to the client, clients that sent an OPT record get
+// one back with their DO bit and udp answers are truncated to the buffer size the client
+// advertised, so that it retries over tcp. The answer is copied before it's
+// changed, since it may be cached after it has been written.
+func (h *DNSHandler) reply(Net string, w dns.ResponseWriter, req, m *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	size := maxReplySize(Net, reqOpt)
+
+	opt := m.IsEdns0()
+	if (reqOpt == nil) != (opt == nil) || (opt != nil && opt.Do() != reqOpt.Do()) || m.Len() > size {
+		m = m.Copy()
+		if reqOpt == nil {
+			stripEdns(m)
+		} else if opt = m.IsEdns0(); opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, reqOpt.Do())
+		} else {
+			opt.SetDo(reqOpt.Do())
+		}
+		m.Truncate(size)
+	}
+
+	w.WriteMsg(m)
+}
+
+// maxReplySize returns the largest answer a client can receive, over udp it's
+// the buffer size from its OPT record but no less than 512 bytes
+func maxReplySize(Net string, opt *dns.OPT) int {
+	switch {
+	case Net == "tcp":
+		return dns.MaxMsgSize
+	case opt == nil:
+		return dns.MinMsgSize
+	case opt.UDPSize() < dns.MinMsgSize:
+		return dns.MinMsgSize
+	}
+	return int(opt.UDPSize())
+}
+
+// isBlocked returns whether or not a domain is blocked for the clients of a
+// blocklist group, "" is the default group, whitelisted domains are never
+// blocked
+func isBlocked(domain, group string) bool {
+	// the caches normalize domains as well, this is for the regex blocklist
+	domain = normalizeDomain(domain)
+
+	// whitelisted wildcards exempt their subdomains from every block rule
+	if WhitelistCache.Match(domain) {
+		return false
+	}
+
+	block := BlockCache
+	if g, ok := BlockGroups.Get(group); ok {
+		if g.Allow.Match(domain) {
+			return false
+		}
+		block = g.Block
+	}
+
+	if blockedTLD(domain) {
+		return true
+	}
+
+	// exact matches are cheap, so the patterns are only tried when those fail
+	return block.Exists(domain) || block.MatchWildcard(domain) || RegexBlockCache.Match(domain)
+}
+
+// blockedTLD returns whether or not the tld of a normalized domain is in
+// blockedtlds, which takes a single lookup of the last label
+func blockedTLD(domain string) bool {
+	tlds := Config().blockedTLDs
+	return tlds != nil && tlds[domain[strings.LastIndexByte(domain, '.')+1:]]
+}
+
+// blockedTarget returns the first CNAME target of an answer that is blocked
+// for the clients of a group, if CNAME blocking is enabled
+func blockedTarget(msg *dns.Msg, group string) (string, bool) {
+	if !Config().CNAMEBlocking {
+		return "", false
+	}
+
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if target := UnFqdn(cname.Target); isBlocked(target, group) {
+				return target, true
+			}
 		}
-		if Config.LogLevel > 0 {
-			log.Printf("insert %s into cache\n", Q.String())
+	}
+
+	return "", false
+}
+
+// blockResponse builds the answer to a blocked query according to the
+// block response configured for its address family, queries that aren't for
+// an address get an empty answer instead of the nullroute
+func (h *DNSHandler) blockResponse(req *dns.Msg, IPQuery int) *dns.Msg {
+	cfg := Config()
+
+	m := new(dns.Msg)
+
+	switch cfg.blockMode(IPQuery) {
+	case "nxdomain":
+		m.SetRcode(req, dns.RcodeNameError)
+		return withSOA(m)
+	case "refused":
+		m.SetRcode(req, dns.RcodeRefused)
+		return m
+	case "nodata":
+		m.SetReply(req)
+		return withSOA(m)
+	}
+
+	m.SetReply(req)
+	q := req.Question[0]
+
+	nullroutes, nullroutesV6 := cfg.nullroutes, cfg.nullroutesV6
+	if cfg.blockMode(IPQuery) == "blockpage" {
+		nullroutes, nullroutesV6 = nil, nil
+		for _, ip := range cfg.blockPageIPs {
+			if ip.To4() != nil {
+				nullroutes = append(nullroutes, ip)
+			} else {
+				nullroutesV6 = append(nullroutesV6, ip)
+			}
 		}
 	}
+
+	switch IPQuery {
+	case _IP4Query:
+		rrHeader := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    cfg.blockResponseTTL(),
+		}
+		for _, nullroute := range nullroutes {
+			m.Answer = append(m.Answer, &dns.A{Hdr: rrHeader, A: nullroute})
+		}
+	case _IP6Query:
+		rrHeader := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    cfg.blockResponseTTL(),
+		}
+		for _, nullroutev6 := range nullroutesV6 {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: nullroutev6})
+		}
+	}
+
+	// the other qtypes and empty nullroutes get an empty answer
+	return withSOA(m)
+}
+
+// disallowedResponse builds the answer to a query for a disallowed qtype
+// according to disallowedqtypeaction, "minimal" answers ANY queries with the
+// HINFO record of RFC 8482 and the other qtypes without any records
+func (h *DNSHandler) disallowedResponse(req *dns.Msg) *dns.Msg {
+	cfg := Config()
+
+	m := new(dns.Msg)
+	if cfg.DisallowedQtypeAction != "minimal" {
+		m.SetRcode(req, dns.RcodeRefused)
+		return m
+	}
+
+	m.SetReply(req)
+	if q := req.Question[0]; q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: q.Qclass, Ttl: cfg.staticTTL()},
+			Cpu: "RFC8482",
+		})
+	}
+
+	return withSOA(m)
+}
+
+// Evict removes the cached answers for a domain, so that changes to the
+// block and white lists apply to it immediately, it returns how many answers
+// were removed
+func (h *DNSHandler) Evict(domain string) int {
+	// the subdomains a wildcard covers can't be looked up in the cache
+	if strings.HasPrefix(domain, "*.") {
+		return h.Flush()
+	}
+
+	// the keys of every client subnet, group and dnssec flag of a question
+	// start with its KeyGen key
+	keys := make(map[string]bool, len(dns.TypeToString))
+	for _, qtype := range dns.TypeToString {
+		keys[KeyGen(Question{normalizeDomain(UnFqdn(domain)), qtype, dns.ClassToString[dns.ClassINET]})] = true
+	}
+	match := func(key string) bool {
+		return len(key) >= keyGenLen && keys[key[:keyGenLen]]
+	}
+
+	return h.cache.RemoveMatching(match) + h.negCache.RemoveMatching(match) + h.blockCache.RemoveMatching(match)
+}
+
+// Flush removes all cached answers and returns how many were removed
+func (h *DNSHandler) Flush() int {
+	return h.cache.Flush() + h.negCache.Flush() + h.blockCache.Flush()
+}
+
+// CacheStats returns the sizes of the caches and the counters of the cache of
+// answers, fill is its size relative to maxcount or 0 for an unbounded cache,
+// reset starts the counters over from zero
+func (h *DNSHandler) CacheStats(reset bool) map[string]interface{} {
+	stats := map[string]interface{}{
+		"size":          h.cache.Length(),
+		"negative_size": h.negCache.Length(),
+		"block_size":    h.blockCache.Length(),
+		"fill":          0.0,
+	}
+
+	if c, ok := h.cache.(*MemoryCache); ok {
+		counters := c.Stats(reset)
+		stats["hits"], stats["misses"], stats["evictions"] = counters.Hits, counters.Misses, counters.Evictions
+		if c.Maxcount > 0 {
+			stats["fill"] = float64(c.Length()) / float64(c.Maxcount)
+		}
+	}
+
+	return stats
 }
 
 // DoTCP begins a tcp query
 func (h *DNSHandler) DoTCP(w dns.ResponseWriter, req *dns.Msg) {
-	go h.do("tcp", w, req)
+	h.dispatch("tcp", w, req)
 }
 
 // DoUDP begins a udp query
 func (h *DNSHandler) DoUDP(w dns.ResponseWriter, req *dns.Msg) {
-	go h.do("udp", w, req)
+	h.dispatch("udp", w, req)
+}
+
+// dispatch handles a query in a goroutine of its own, when every slot is
+// taken the query waits for one unless maxqueuedqueries queries are waiting
+// already, in which case it's rejected
+func (h *DNSHandler) dispatch(Net string, w dns.ResponseWriter, req *dns.Msg) {
+	h.stopMu.RLock()
+	if h.stopping {
+		h.stopMu.RUnlock()
+		w.Close()
+		return
+	}
+	h.inflight.Add(1)
+	h.stopMu.RUnlock()
+
+	if h.slots == nil {
+		go func() {
+			defer h.inflight.Done()
+			h.do(Net, w, req)
+		}()
+		return
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+		queriesInflight.Inc()
+		go h.run(Net, w, req)
+		return
+	default:
+	}
+
+	if atomic.AddInt64(&h.queued, 1) > int64(Config().MaxQueuedQueries) {
+		atomic.AddInt64(&h.queued, -1)
+		defer h.inflight.Done()
+		h.reject(w, req)
+		return
+	}
+
+	queriesQueued.Inc()
+	go func() {
+		h.slots <- struct{}{}
+		atomic.AddInt64(&h.queued, -1)
+		queriesQueued.Dec()
+		queriesInflight.Inc()
+		h.run(Net, w, req)
+	}()
+}
+
+// run handles a query that holds a slot and frees the slot afterwards
+func (h *DNSHandler) run(Net string, w dns.ResponseWriter, req *dns.Msg) {
+	defer h.inflight.Done()
+	defer func() {
+		queriesInflight.Dec()
+		<-h.slots
+	}()
+
+	h.do(Net, w, req)
+}
+
+// reject answers a query that can't be handled because of the load with
+// REFUSED, or not at all if overloadaction is "drop"
+func (h *DNSHandler) reject(w dns.ResponseWriter, req *dns.Msg) {
+	defer w.Close()
+	overloadedTotal.Inc()
+
+	if Config().OverloadAction == "drop" {
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
+
+// Stop drops the queries that arrive from now on, Wait waits for the ones
+// already in flight
+func (h *DNSHandler) Stop() {
+	h.stopMu.Lock()
+	h.stopping = true
+	h.stopMu.Unlock()
+}
+
+// Wait waits for the queries in flight to be answered or for ctx to be done
+func (h *DNSHandler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (h *DNSHandler) isIPQuery(q dns.Question) int {
@@ -217,6 +855,11 @@ func (h *DNSHandler) isIPQuery(q dns.Question) int {
 		return _IP4Query
 	case dns.TypeAAAA:
 		return _IP6Query
+	case dns.TypePTR:
+		if reverseIP(q.Name) != nil {
+			return _PTRQuery
+		}
+		return notIPQuery
 	default:
 		return notIPQuery
 	}
@@ -0,0 +1,820 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testWriter is a dns.ResponseWriter that keeps the written answer, it's
+// connected over tcp if tcp is set
+type testWriter struct {
+	dns.ResponseWriter
+	msg    *dns.Msg
+	tcp    bool
+	remote net.IP
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testWriter) Close() error {
+	return nil
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	ip := w.remote
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if w.tcp {
+		return &net.TCPAddr{IP: ip, Port: 53}
+	}
+	return &net.UDPAddr{IP: ip, Port: 53}
+}
+
+// testLargeAnswer returns an answer with enough records to exceed 512 bytes
+func testLargeAnswer(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for i := 0; i < 64; i++ {
+		m.Answer = append(m.Answer, testA(req.Question[0].Name, fmt.Sprintf("192.0.2.%d", i)))
+	}
+	return m
+}
+
+func TestDispatchOverload(t *testing.T) {
+	h := &DNSHandler{slots: make(chan struct{}, 1)}
+	h.slots <- struct{}{}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	withConfig(t, &config{MaxConcurrentQueries: 1, OverloadAction: "refuse"})
+	w := &testWriter{}
+	h.dispatch("udp", w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused || w.msg.Id != req.Id {
+		t.Errorf("expected the query to be refused while every slot is taken, got %v", w.msg)
+	}
+
+	withConfig(t, &config{MaxConcurrentQueries: 1, OverloadAction: "drop"})
+	w = &testWriter{}
+	h.dispatch("udp", w, req)
+	if w.msg != nil {
+		t.Errorf("expected the query to be dropped, got %v", w.msg)
+	}
+
+	if queued := atomic.LoadInt64(&h.queued); queued != 0 {
+		t.Errorf("expected no queued queries, got %d", queued)
+	}
+}
+
+func TestReplyTruncate(t *testing.T) {
+	h := &DNSHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m := testLargeAnswer(req)
+
+	w := &testWriter{}
+	h.reply("udp", w, req, m)
+	if !w.msg.Truncated || w.msg.Len() > dns.MinMsgSize {
+		t.Errorf("answer of %d bytes wasn't truncated for a client without EDNS", w.msg.Len())
+	}
+	if m.Truncated || len(m.Answer) != 64 {
+		t.Error("the original answer was modified")
+	}
+
+	h.reply("tcp", w, req, m)
+	if w.msg.Truncated {
+		t.Error("answer over tcp was truncated")
+	}
+
+	edns := req.Copy()
+	edns.SetEdns0(dns.DefaultMsgSize, true)
+	h.reply("udp", w, edns, m)
+	if w.msg.Truncated {
+		t.Errorf("answer of %d bytes was truncated for a client with a %d byte buffer", w.msg.Len(), dns.DefaultMsgSize)
+	}
+	if opt := w.msg.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("answer to an EDNS client has no OPT record with the DO bit")
+	}
+}
+
+func TestReplyStripEdns(t *testing.T) {
+	h := &DNSHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.Answer = append(m.Answer, testA(req.Question[0].Name, "192.0.2.1"))
+
+	w := &testWriter{}
+	h.reply("udp", w, req, m)
+	if w.msg.IsEdns0() != nil {
+		t.Error("answer to a client without EDNS has an OPT record")
+	}
+	if m.IsEdns0() == nil {
+		t.Error("the original answer was modified")
+	}
+
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	h.reply("udp", w, req, m)
+	if opt := w.msg.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("answer to a client that set the DO bit doesn't have it set")
+	}
+	if m.IsEdns0().Do() {
+		t.Error("the original answer was modified")
+	}
+}
+
+func TestMaxReplySize(t *testing.T) {
+	small := new(dns.OPT)
+	small.SetUDPSize(256)
+	large := new(dns.OPT)
+	large.SetUDPSize(4096)
+
+	tests := []struct {
+		net  string
+		opt  *dns.OPT
+		size int
+	}{
+		{"udp", nil, dns.MinMsgSize},
+		{"udp", small, dns.MinMsgSize},
+		{"udp", large, 4096},
+		{"tcp", nil, dns.MaxMsgSize},
+	}
+
+	for _, test := range tests {
+		if size := maxReplySize(test.net, test.opt); size != test.size {
+			t.Errorf("maxReplySize(%s, %v) = %d, expected %d", test.net, test.opt, size, test.size)
+		}
+	}
+}
+
+func TestBlockedTarget(t *testing.T) {
+	c := &config{CNAMEBlocking: true}
+	withConfig(t, c)
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{"tracker.example.net": true}})
+	t.Cleanup(func() { BlockCache.Replace(&MemoryBlockCache{Backend: old}) })
+
+	req := new(dns.Msg)
+	req.SetQuestion("metrics.example.com.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "metrics.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "edge.example.org."},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "edge.example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "tracker.example.net."},
+		testA("tracker.example.net.", "192.0.2.1"),
+	}
+
+	if target, ok := blockedTarget(m, ""); !ok || target != "tracker.example.net" {
+		t.Errorf("expected the CNAME to tracker.example.net to be blocked, got %q", target)
+	}
+
+	c.CNAMEBlocking = false
+	if _, ok := blockedTarget(m, ""); ok {
+		t.Error("answer was blocked with CNAME blocking disabled")
+	}
+}
+
+func TestIsBlockedNormalize(t *testing.T) {
+	withConfig(t, &config{})
+
+	old, oldRegex := BlockCache.Backend, RegexBlockCache.Backend
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	block.Set("xn--bcher-kva.example", true)
+	BlockCache.Replace(block)
+	RegexBlockCache.Replace(&MemoryRegexBlockCache{Backend: []*regexp.Regexp{regexp.MustCompile(`^ads\.`)}})
+	t.Cleanup(func() {
+		BlockCache.Replace(&MemoryBlockCache{Backend: old})
+		RegexBlockCache.Replace(&MemoryRegexBlockCache{Backend: oldRegex})
+	})
+
+	for _, domain := range []string{"Bücher.example", "XN--BCHER-KVA.example", "ADS.example.com"} {
+		if !isBlocked(domain, "") {
+			t.Errorf("%s is not blocked", domain)
+		}
+	}
+}
+
+func TestRetryTruncated(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the answer doesn't fit over udp, only the tcp answer is complete
+	udp := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})}
+	tcp := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(testLargeAnswer(req))
+	})}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+
+	for _, retry := range []bool{true, false} {
+		withParsedConfig(t, &config{Nameservers: []string{conn.LocalAddr().String()}, Interval: 10, Timeout: 1, Expire: 600, Maxcount: 10, RetryTruncated: retry})
+		h := NewHandler()
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		req.SetEdns0(dns.MaxMsgSize, false)
+		w := &testWriter{}
+		h.do("udp", w, req)
+
+		if w.msg == nil {
+			t.Fatalf("retry %t: no answer was written", retry)
+		}
+		if retry && (w.msg.Truncated || len(w.msg.Answer) != 64) {
+			t.Errorf("expected the complete answer from tcp, got %d records", len(w.msg.Answer))
+		}
+		if !retry && !w.msg.Truncated {
+			t.Error("expected the truncated answer without retrying")
+		}
+		expected := 0
+		if retry {
+			expected = 1
+		}
+		if cached := h.cache.Length() + h.negCache.Length(); cached != expected {
+			t.Errorf("retry %t: expected only the complete answer to be cached, got %d entries", retry, cached)
+		}
+	}
+}
+
+func TestMonitorMode(t *testing.T) {
+	upstream := startRcodeUpstream(t, dns.RcodeSuccess)
+	withParsedConfig(t, &config{Nameservers: []string{upstream}, Interval: 10, Timeout: 1, Nullroute: stringList{"0.0.0.0"}, QuestionCacheCap: 10, MonitorMode: true})
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{testDomain: true}})
+	QuestionCache.Clear()
+	t.Cleanup(func() {
+		BlockCache.Replace(&MemoryBlockCache{Backend: old})
+		QuestionCache.Clear()
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	w := &testWriter{}
+	NewHandler().do("udp", w, req)
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Fatalf("expected the answer of the nameserver in monitor mode, got %v", w.msg)
+	}
+
+	// the question cache is added to in the background
+	for i := 0; i < 100 && QuestionCache.Length() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	entries := QuestionCache.Entries()
+	if len(entries) != 1 || entries[0].Blocked || !entries[0].WouldBlock {
+		t.Errorf("expected the query to be marked as would be blocked, got %+v", entries)
+	}
+}
+
+func TestBlockCacheSeparate(t *testing.T) {
+	upstream := startRcodeUpstream(t, dns.RcodeSuccess)
+	withParsedConfig(t, &config{Nameservers: []string{upstream}, Interval: 10, Timeout: 1, Nullroute: stringList{"0.0.0.0"}, TTL: 600, BlockCacheTTL: 60, BlockCacheMaxcount: 1})
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{testDomain: true, "ads.example.com": true}})
+	t.Cleanup(func() { BlockCache.Replace(&MemoryBlockCache{Backend: old}) })
+
+	h := NewHandler()
+	for _, name := range []string{testDomain, "ads.example.com"} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		h.do("udp", &testWriter{}, req)
+	}
+
+	if h.cache.Length() != 0 {
+		t.Errorf("expected the blocks to be kept out of the cache, got %d entries", h.cache.Length())
+	}
+	blockCache := h.blockCache.(*MemoryCache)
+	if blockCache.Length() != 1 {
+		t.Fatalf("expected the block cache to hold at most blockcachemaxcount blocks, got %d", blockCache.Length())
+	}
+
+	mesg, _ := blockCache.entry(KeyGen(Question{"ads.example.com", "A", "IN"}))
+	if lifetime := mesg.Expire.Sub(mesg.Stored); lifetime != time.Minute {
+		t.Errorf("expected the block to be cached for blockcachettl, got %s", lifetime)
+	}
+	if ttl := mesg.Msg.Answer[0].Header().Ttl; ttl != 600 {
+		t.Errorf("expected the block to keep its ttl, got %d", ttl)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	silent := startSilentUpstream(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	key := KeyGen(Question{testDomain, "A", "IN"})
+
+	for _, serveStale := range []bool{true, false} {
+		withParsedConfig(t, &config{Nameservers: []string{silent}, Interval: 10, Timeout: 1, UpstreamTimeout: 100, Expire: 60, ServeStale: serveStale, StaleWindow: 3600})
+		h := NewHandler()
+
+		// the answer expired while the nameserver went down
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, testA(req.Question[0].Name, "192.0.2.1"))
+		cache := h.cache.(*MemoryCache)
+		cache.Set(key, m)
+		mesg, _ := cache.entry(key)
+		mesg.Expire = time.Now().Add(-time.Minute)
+		setTestEntry(cache, key, mesg)
+
+		// the second query hits the cached failure
+		for i := 0; i < 2; i++ {
+			w := &testWriter{}
+			h.do("udp", w, req)
+
+			if serveStale && (len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Ttl != staleTTL) {
+				t.Errorf("query %d: expected the stale answer, got %v", i, w.msg)
+			}
+			if !serveStale && w.msg.Rcode != dns.RcodeServerFailure {
+				t.Errorf("query %d: expected SERVFAIL without servestale, got %v", i, w.msg)
+			}
+		}
+	}
+}
+
+func TestDisableIPv6(t *testing.T) {
+	withParsedConfig(t, &config{Nameservers: []string{startSilentUpstream(t)}, Interval: 10, Timeout: 1, UpstreamTimeout: 100, Expire: 60, TTL: 600, DisableIPv6: true})
+	h := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeAAAA)
+	w := &testWriter{}
+	h.do("udp", w, req)
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) > 0 || len(w.msg.Ns) != 1 {
+		t.Errorf("expected an empty answer with a SOA record to the AAAA query, got %v", w.msg)
+	}
+	if _, err := h.negCache.Get(KeyGen(Question{testDomain, "AAAA", "IN"})); err != nil {
+		t.Error("the empty answer was not cached")
+	}
+
+	// A queries still go to the nameserver, which doesn't answer
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	h.do("udp", w, req)
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected the A query to be resolved, got %v", w.msg)
+	}
+}
+
+func TestDisallowedQtypes(t *testing.T) {
+	upstream := startRcodeUpstream(t, dns.RcodeSuccess)
+
+	tests := []struct {
+		action string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"refuse", dns.TypeANY, dns.RcodeRefused, 0},
+		{"refuse", dns.TypeA, dns.RcodeSuccess, 0},
+		{"minimal", dns.TypeANY, dns.RcodeSuccess, 1},
+		{"minimal", dns.TypeAXFR, dns.RcodeSuccess, 0},
+	}
+
+	for _, test := range tests {
+		withParsedConfig(t, &config{Nameservers: []string{upstream}, Interval: 10, Timeout: 1, DisallowedQtypes: []string{"any", "AXFR"}, DisallowedQtypeAction: test.action})
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), test.qtype)
+		w := &testWriter{}
+		NewHandler().do("udp", w, req)
+
+		if w.msg.Rcode != test.rcode || len(w.msg.Answer) != test.answer {
+			t.Errorf("%s %s: expected rcode %d with %d records, got %v", test.action, dns.TypeToString[test.qtype], test.rcode, test.answer, w.msg)
+		}
+		if test.answer > 0 && w.msg.Answer[0].(*dns.HINFO).Cpu != "RFC8482" {
+			t.Errorf("expected the HINFO record of RFC 8482, got %v", w.msg.Answer)
+		}
+	}
+
+	c := &config{DisallowedQtypes: []string{"NOTATYPE"}}
+	if err := c.parse(); err == nil {
+		t.Error("expected an error for an unknown qtype")
+	}
+}
+
+func TestQueryDuration(t *testing.T) {
+	withParsedConfig(t, &config{Nullroute: stringList{"0.0.0.0"}})
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{testDomain: true}})
+	t.Cleanup(func() { BlockCache.Replace(&MemoryBlockCache{Backend: old}) })
+
+	count := func(result string) uint64 {
+		var m dto.Metric
+		if err := queryDuration.WithLabelValues(result).(prometheus.Metric).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	blocked, cached := count("blocked"), count("cached")
+
+	h := NewHandler()
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		h.do("udp", &testWriter{}, req)
+	}
+
+	if n := count("blocked") - blocked; n != 2 {
+		t.Errorf("expected 2 blocked queries to be observed, got %d", n)
+	}
+	if n := count("cached") - cached; n != 0 {
+		t.Errorf("expected the cached block to count as blocked, got %d cached queries", n)
+	}
+}
+
+func TestBlockedTLDs(t *testing.T) {
+	withParsedConfig(t, &config{BlockedTLDs: []string{"zip", ".MOV", "*.xyz"}})
+
+	oldWhitelist := WhitelistCache.Backend
+	whitelist := &MemoryBlockCache{Backend: make(map[string]bool)}
+	whitelist.Set("release.zip", true)
+	WhitelistCache.Replace(whitelist)
+	t.Cleanup(func() { WhitelistCache.Replace(&MemoryBlockCache{Backend: oldWhitelist}) })
+
+	tests := map[string]bool{
+		"files.zip":       true,
+		"a.b.example.mov": true,
+		"Trailer.MOV":     true,
+		"example.xyz":     true,
+		"release.zip":     false,
+		"zip.example.com": false,
+		"example.com":     false,
+	}
+	for domain, blocked := range tests {
+		if isBlocked(domain, "") != blocked {
+			t.Errorf("expected %s blocked to be %t", domain, blocked)
+		}
+	}
+
+	for _, entry := range []string{"co.uk", "", "."} {
+		if err := (&config{BlockedTLDs: []string{entry}}).parse(); err == nil {
+			t.Errorf("expected an error for blocked tld %q", entry)
+		}
+	}
+}
+
+func TestWhitelistWildcard(t *testing.T) {
+	withConfig(t, &config{})
+
+	old, oldWhitelist := BlockCache.Backend, WhitelistCache.Backend
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	for _, domain := range []string{"github.com", "api.github.com", "*.githubusercontent.com", "ads.example.com"} {
+		block.Set(domain, true)
+	}
+	whitelist := &MemoryBlockCache{Backend: make(map[string]bool)}
+	whitelist.Set("*.github.com", true)
+	whitelist.Set("*.githubusercontent.com", true)
+	BlockCache.Replace(block)
+	WhitelistCache.Replace(whitelist)
+	t.Cleanup(func() {
+		BlockCache.Replace(&MemoryBlockCache{Backend: old})
+		WhitelistCache.Replace(&MemoryBlockCache{Backend: oldWhitelist})
+	})
+
+	tests := map[string]bool{
+		"api.github.com":            false,
+		"raw.githubusercontent.com": false,
+		"a.b.githubusercontent.com": false,
+		"github.com":                true,
+		"ads.example.com":           true,
+	}
+	for domain, blocked := range tests {
+		if isBlocked(domain, "") != blocked {
+			t.Errorf("expected %s blocked to be %t", domain, blocked)
+		}
+	}
+
+	if !WhitelistCache.Has("*.github.com") || WhitelistCache.Has("github.com") {
+		t.Error("expected only the wildcard entry to be in the whitelist")
+	}
+}
+
+func TestNegativeCacheRcode(t *testing.T) {
+	// no nameserver is asked, the answers come from the negative cache
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10})
+	h := NewHandler()
+
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("missing.example.com.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetRcode(nxdomain, dns.RcodeNameError)
+	m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Ns: "ns.example.com.", Mbox: "hostmaster.example.com.", Minttl: 300}}
+	h.negCache.Set(KeyGen(Question{"missing.example.com", "A", "IN"}), m)
+
+	servfail := new(dns.Msg)
+	servfail.SetQuestion("broken.example.com.", dns.TypeA)
+	m = new(dns.Msg)
+	m.SetRcode(servfail, dns.RcodeServerFailure)
+	h.negCache.Set(KeyGen(Question{"broken.example.com", "A", "IN"}), m)
+
+	for req, rcode := range map[*dns.Msg]int{nxdomain: dns.RcodeNameError, servfail: dns.RcodeServerFailure} {
+		w := &testWriter{}
+		h.do("udp", w, req)
+		if w.msg == nil || w.msg.Rcode != rcode || w.msg.Id != req.Id {
+			t.Errorf("%s: expected the cached %s, got %v", req.Question[0].Name, dns.RcodeToString[rcode], w.msg)
+		}
+	}
+}
+
+func TestLargeSynthesizedAnswers(t *testing.T) {
+	var records, nullroutes stringList
+	for i := 0; i < 64; i++ {
+		records = append(records, fmt.Sprintf("A 192.168.1.%d", i))
+		nullroutes = append(nullroutes, fmt.Sprintf("0.0.0.%d", i))
+	}
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10, Nullroute: nullroutes, StaticRecords: map[string][]string{"nas.home": records}})
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{"ads.example.com": true}})
+	t.Cleanup(func() { BlockCache.Replace(&MemoryBlockCache{Backend: old}) })
+
+	h := NewHandler()
+	for _, name := range []string{"nas.home.", "ads.example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		w := &testWriter{}
+		h.do("udp", w, req)
+		if w.msg == nil || !w.msg.Truncated || w.msg.Len() > dns.MinMsgSize {
+			t.Errorf("%s: expected a truncated answer over udp, got %v", name, w.msg)
+		}
+
+		// the client retries over tcp, blocks are answered from the cache then
+		w = &testWriter{tcp: true}
+		h.do("tcp", w, req)
+		if w.msg == nil || w.msg.Truncated || len(w.msg.Answer) != 64 {
+			t.Errorf("%s: expected the complete answer over tcp, got %v", name, w.msg)
+		}
+	}
+}
+
+// withParsedConfig parses c and makes it the active config for the rest of
+// the test
+func withParsedConfig(t *testing.T, c *config) {
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+}
+
+func TestBlockResponseFamily(t *testing.T) {
+	withParsedConfig(t, &config{BlockResponse: "nullroute", BlockResponseV6: "nodata", Nullroute: stringList{"0.0.0.0"}, Nullroutev6: stringList{"::"}, TTL: 600})
+	h := &DNSHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m := h.blockResponse(req, _IP4Query)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "0.0.0.0" {
+		t.Errorf("expected the nullroute for an A query, got %v", m)
+	}
+
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeAAAA)
+	m = h.blockResponse(req, _IP6Query)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("expected NODATA for an AAAA query, got %v", m)
+	}
+
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeMX)
+	m = h.blockResponse(req, notIPQuery)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("expected an empty answer for an MX query, got %v", m)
+	}
+
+	withParsedConfig(t, &config{BlockResponse: "nxdomain", BlockResponseV4: "nullroute", Nullroute: stringList{"0.0.0.0"}})
+	if m = h.blockResponse(req, notIPQuery); m.Rcode != dns.RcodeNameError {
+		t.Errorf("expected blockresponse for an MX query, got %v", m)
+	}
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeAAAA)
+	if m = h.blockResponse(req, _IP6Query); m.Rcode != dns.RcodeNameError {
+		t.Errorf("expected blockresponse for an AAAA query without blockresponsev6, got %v", m)
+	}
+}
+
+func TestBlockResponseNullroutes(t *testing.T) {
+	withParsedConfig(t, &config{Nullroute: stringList{"0.0.0.0", "192.168.1.5"}, Nullroutev6: stringList{"::", "fd00::5"}})
+	h := &DNSHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m := h.blockResponse(req, _IP4Query)
+	if len(m.Answer) != 2 || m.Answer[1].(*dns.A).A.String() != "192.168.1.5" {
+		t.Errorf("expected an A record for every ipv4 nullroute, got %v", m.Answer)
+	}
+
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeAAAA)
+	m = h.blockResponse(req, _IP6Query)
+	if len(m.Answer) != 2 || m.Answer[1].(*dns.AAAA).AAAA.String() != "fd00::5" {
+		t.Errorf("expected an AAAA record for every ipv6 nullroute, got %v", m.Answer)
+	}
+}
+
+func TestBlockResponseTTL(t *testing.T) {
+	h := &DNSHandler{}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	for _, test := range []struct {
+		c   *config
+		ttl uint32
+	}{
+		{&config{Nullroute: stringList{"0.0.0.0"}, TTL: 600}, 600},
+		{&config{Nullroute: stringList{"0.0.0.0"}, TTL: 600, BlockResponseTTL: 10}, 10},
+	} {
+		withParsedConfig(t, test.c)
+		m := h.blockResponse(req, _IP4Query)
+		if len(m.Answer) != 1 || m.Answer[0].Header().Ttl != test.ttl {
+			t.Errorf("blockresponsettl %d: expected a ttl of %d, got %v", test.c.BlockResponseTTL, test.ttl, m.Answer)
+		}
+	}
+}
+
+func TestBlockResponseSOA(t *testing.T) {
+	h := &DNSHandler{}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeMX)
+
+	for _, test := range []struct {
+		c       *config
+		mname   string
+		minimum uint32
+	}{
+		{&config{BlockResponse: "nxdomain", TTL: 600}, "grimd.", 600},
+		{&config{BlockResponse: "nodata", TTL: 600, SOAMName: "ns.home", SOARName: "admin.home", SOAMinimum: 60}, "ns.home.", 60},
+	} {
+		withParsedConfig(t, test.c)
+		m := h.blockResponse(req, _IP4Query)
+		if len(m.Ns) != 1 {
+			t.Errorf("blockresponse %s: expected a SOA record, got %v", test.c.BlockResponse, m)
+			continue
+		}
+		soa := m.Ns[0].(*dns.SOA)
+		if soa.Ns != test.mname || soa.Minttl != test.minimum || soa.Hdr.Ttl != test.minimum {
+			t.Errorf("blockresponse %s: expected a SOA of %s with minimum %d, got %v", test.c.BlockResponse, test.mname, test.minimum, soa)
+		}
+	}
+
+	// the refused answer and the nullroute addresses aren't negative
+	withParsedConfig(t, &config{BlockResponse: "refused"})
+	if m := h.blockResponse(req, _IP4Query); len(m.Ns) > 0 {
+		t.Errorf("expected no SOA record in a refused answer, got %v", m)
+	}
+	withParsedConfig(t, &config{Nullroute: stringList{"0.0.0.0"}})
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	if m := h.blockResponse(req, _IP4Query); len(m.Ns) > 0 {
+		t.Errorf("expected no SOA record with the nullroute address, got %v", m)
+	}
+
+	if err := (&config{SOAMName: "not a..name"}).parse(); err == nil {
+		t.Error("expected an error for an invalid soamname")
+	}
+}
+
+func TestBlockResponseBlockPage(t *testing.T) {
+	withParsedConfig(t, &config{BlockResponse: "blockpage", BlockPageIP: stringList{"192.168.1.2", "fd00::2"}, Nullroute: stringList{"0.0.0.0"}})
+	h := &DNSHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m := h.blockResponse(req, _IP4Query)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.168.1.2" {
+		t.Errorf("expected the ipv4 block page address, got %v", m.Answer)
+	}
+
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeAAAA)
+	m = h.blockResponse(req, _IP6Query)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::2" {
+		t.Errorf("expected the ipv6 block page address, got %v", m.Answer)
+	}
+
+	if err := (&config{BlockResponseV6: "blockpage"}).parse(); err == nil {
+		t.Error("expected an error for blockpage without a blockpageip")
+	}
+}
+
+func TestEvictQtypes(t *testing.T) {
+	h := &DNSHandler{
+		cache:      &MemoryCache{Expire: time.Minute},
+		negCache:   &MemoryCache{Expire: time.Minute},
+		blockCache: &MemoryCache{Expire: time.Minute},
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT, dns.TypeMX} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), qtype)
+		key := KeyGen(Question{testDomain, dns.TypeToString[qtype], "IN"})
+		if err := h.cache.Set(key, testLargeAnswer(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.cache.Set(KeyGen(Question{"other.example.com", "TXT", "IN"}), new(dns.Msg))
+	h.blockCache.Set(KeyGen(Question{testDomain, "AAAA", "IN"}), new(dns.Msg))
+
+	if removed := h.Evict(testDomain); removed != 4 {
+		t.Errorf("expected the answers and blocks of every qtype to be removed, got %d", removed)
+	}
+	if h.cache.Length() != 1 {
+		t.Errorf("expected the answers for other domains to be kept, got %d entries", h.cache.Length())
+	}
+}
+
+func TestCacheKeyCase(t *testing.T) {
+	// no nameserver is asked, the answer comes from the cache
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10})
+	h := NewHandler()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = []dns.RR{testRR(dns.Fqdn(testDomain), 600)}
+	h.cache.Set(KeyGen(Question{testDomain, "A", "IN"}), m)
+
+	req := new(dns.Msg)
+	req.SetQuestion("WwW.GooGLe.cOm.", dns.TypeA)
+	w := &testWriter{}
+	h.do("udp", w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected the cached answer for a name in another case, got %v", w.msg)
+	}
+	if w.msg.Question[0].Name != "WwW.GooGLe.cOm." {
+		t.Errorf("expected the question the client sent, got %s", w.msg.Question[0].Name)
+	}
+
+	if removed := h.Evict("WWW.Google.com"); removed != 1 {
+		t.Errorf("expected the answer to be evicted for a name in another case, got %d", removed)
+	}
+}
+
+func TestAllowedClients(t *testing.T) {
+	withParsedConfig(t, &config{
+		AllowedClients: []string{"192.168.1.0/24", "10.0.0.1", "fd00::/8"},
+		StaticRecords:  map[string][]string{"nas.home": {"A 192.168.1.2"}},
+		TTL:            600,
+	})
+
+	for ip, allowed := range map[string]bool{
+		"192.168.1.20": true,
+		"192.168.2.20": false,
+		"10.0.0.1":     true,
+		"10.0.0.2":     false,
+		"fd00::1":      true,
+		"2001:db8::1":  false,
+	} {
+		if Config().ClientAllowed(net.ParseIP(ip)) != allowed {
+			t.Errorf("%s: expected allowed to be %v", ip, allowed)
+		}
+	}
+
+	h := NewHandler()
+	for ip, rcode := range map[string]int{"192.168.1.20": dns.RcodeSuccess, "203.0.113.5": dns.RcodeRefused} {
+		req := new(dns.Msg)
+		req.SetQuestion("nas.home.", dns.TypeA)
+		w := &testWriter{remote: net.ParseIP(ip)}
+		h.do("udp", w, req)
+		if w.msg == nil || w.msg.Rcode != rcode || w.msg.Id != req.Id {
+			t.Errorf("%s: expected %s, got %v", ip, dns.RcodeToString[rcode], w.msg)
+		}
+		if rcode == dns.RcodeRefused && len(w.msg.Answer) != 0 {
+			t.Errorf("%s: expected no answer for a refused client, got %v", ip, w.msg.Answer)
+		}
+	}
+
+	for _, entry := range []string{"192.168.1.0/33", "not an address"} {
+		if err := (&config{AllowedClients: []string{entry}}).parse(); err == nil {
+			t.Errorf("%s: expected an error", entry)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// decodeConfig decodes a config file and the files it includes into c, the
+// included files are decoded after the file that includes them, relative to
+// its directory. A setting of a later file overrides the setting of an earlier
+// one, lists are appended to and tables get the entries of both files.
+// including is the chain of files that led to path, to detect include cycles.
+func decodeConfig(path string, c *config, including []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, p := range including {
+		if p == abs {
+			return fmt.Errorf("include cycle %s", strings.Join(append(including[i:], abs), " -> "))
+		}
+	}
+
+	var file config
+	md, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return err
+	}
+	mergeConfig(c, &file, md)
+
+	for _, include := range file.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(abs), include)
+		}
+		if err := decodeConfig(include, c, append(including, abs)); err != nil {
+			return fmt.Errorf("%s: %s", include, err)
+		}
+	}
+
+	return nil
+}
+
+// mergeConfig sets the settings that are defined in a decoded file on c
+func mergeConfig(c, file *config, md toml.MetaData) {
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(file).Elem()
+
+	for _, key := range md.Keys() {
+		if len(key) != 1 || strings.EqualFold(key[0], "include") {
+			continue
+		}
+
+		// settings are matched to fields like the decoder matches them
+		for i := 0; i < dst.NumField(); i++ {
+			if !dst.Type().Field(i).IsExported() || !strings.EqualFold(dst.Type().Field(i).Name, key[0]) {
+				continue
+			}
+
+			to, from := dst.Field(i), src.Field(i)
+			switch to.Kind() {
+			case reflect.Slice:
+				to.Set(reflect.AppendSlice(to, from))
+			case reflect.Map:
+				if to.IsNil() {
+					to.Set(reflect.MakeMap(to.Type()))
+				}
+				for _, k := range from.MapKeys() {
+					to.SetMapIndex(k, from.MapIndex(k))
+				}
+			default:
+				to.Set(from)
+			}
+			break
+		}
+	}
+}
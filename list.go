@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+)
+
+// the formats of a blocklist, formatAuto detects the format of every line
+const (
+	formatAuto    = ""
+	formatHosts   = "hosts"
+	formatDomains = "domains"
+	formatABP     = "abp"
+)
+
+// ListStats counts the lines of a list and the domains it added to a block
+// cache, duplicates are the domains that were already blocked by an earlier
+// line or list
+type ListStats struct {
+	Lines      int `json:"lines"`
+	Domains    int `json:"domains"`
+	Duplicates int `json:"duplicates"`
+}
+
+// add adds the counts of another list
+func (s *ListStats) add(other ListStats) {
+	s.Lines += other.Lines
+	s.Domains += other.Domains
+	s.Duplicates += other.Duplicates
+}
+
+// block adds a domain to a block cache and counts it
+func (s *ListStats) block(block *MemoryBlockCache, domain string) {
+	if block.Exists(domain) {
+		s.Duplicates++
+		return
+	}
+	block.Set(domain, true)
+	s.Domains++
+}
+
+// parseList reads a blocklist into block, lists can be in hosts format, a
+// plain list of domains or Adblock Plus filter syntax. Domains that an
+// Adblock Plus exception rule allows are added to allow. When hosts is set,
+// hosts entries with an address other than a null or loopback address are
+// added to hosts instead of being blocked. Lines that don't match the format
+// of the list are skipped.
+func parseList(r io.Reader, format string, block, allow *MemoryBlockCache, hosts *MemoryHostsCache) (ListStats, error) {
+	var stats ListStats
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		stats.Lines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if format == formatABP || (format == formatAuto && isABPRule(line)) {
+			domain, exception, ok := parseABPRule(line)
+			if !ok {
+				continue
+			}
+
+			// an exception covers the subdomains its block rule would
+			if exception {
+				allow.Set(domain, true)
+				allow.Set("*."+domain, true)
+			} else {
+				stats.block(block, domain)
+				block.Set("*."+domain, true)
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := len(fields) > 1 && !strings.HasPrefix(fields[1], "#")
+		switch format {
+		case formatHosts:
+			if !entry || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+		case formatDomains:
+			entry = false
+		}
+
+		if entry {
+			line = fields[1]
+
+			if ip := net.ParseIP(fields[0]); hosts != nil && ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+				for _, domain := range fields[1:] {
+					if strings.HasPrefix(domain, "#") {
+						break
+					}
+					hosts.Add(domain, ip)
+				}
+				continue
+			}
+		} else {
+			line = fields[0]
+		}
+
+		// whitelisted domains are kept so that removing them from
+		// the whitelist at runtime blocks them again
+		stats.block(block, line)
+	}
+
+	return stats, scanner.Err()
+}
+
+// isABPRule returns whether or not a line of a list is written in Adblock Plus
+// filter syntax rather than hosts format
+func isABPRule(line string) bool {
+	switch {
+	case strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["):
+		return true
+	case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"):
+		return true
+	case strings.Contains(line, "##"), strings.Contains(line, "#@#"), strings.Contains(line, "#?#"):
+		return true
+	}
+
+	return false
+}
+
+// parseABPRule parses the subset of Adblock Plus filter syntax that applies to
+// whole domains. ||example.com^ blocks example.com and all of its subdomains
+// and @@||example.com^ is an exception that allows example.com and all of its
+// subdomains. Comments
+// starting with !, the [Adblock Plus] header, element hiding rules and rules
+// with a path or $options are skipped, since they can't be enforced by a DNS
+// server.
+func parseABPRule(line string) (domain string, exception bool, ok bool) {
+	if strings.HasPrefix(line, "@@") {
+		exception = true
+		line = line[2:]
+	}
+
+	if !strings.HasPrefix(line, "||") {
+		return "", false, false
+	}
+	line = line[2:]
+
+	end := strings.IndexByte(line, '^')
+	if end <= 0 {
+		return "", false, false
+	}
+
+	// a separator may be followed by the end of address anchor, anything
+	// else restricts the rule to some requests of the domain
+	if rest := line[end+1:]; rest != "" && rest != "|" {
+		return "", false, false
+	}
+
+	domain = line[:end]
+	if strings.ContainsAny(domain, "/*:|$") {
+		return "", false, false
+	}
+
+	return domain, exception, true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testABPList = `[Adblock Plus 2.0]
+! Title: test list
+! comment lines are ignored
+||ads.example.com^
+||tracker.example.net^|
+@@||allowed.example.com^
+||cdn.allowed.example.com^
+||thirdparty.example.com^$third-party
+||example.org/banner.gif
+example.com##.advert
+example.com#@#.sponsored
+`
+
+func TestParseABPRule(t *testing.T) {
+	tests := []struct {
+		line      string
+		domain    string
+		exception bool
+		ok        bool
+	}{
+		{"||ads.example.com^", "ads.example.com", false, true},
+		{"||ads.example.com^|", "ads.example.com", false, true},
+		{"@@||allowed.example.com^", "allowed.example.com", true, true},
+		{"||ads.example.com^$third-party", "", false, false},
+		{"||example.org/banner.gif", "", false, false},
+		{"||*.example.org^", "", false, false},
+		{"||^", "", false, false},
+		{"|http://example.com/|", "", false, false},
+		{"! ||commented.example.com^", "", false, false},
+		{"example.com##.advert", "", false, false},
+	}
+
+	for _, test := range tests {
+		domain, exception, ok := parseABPRule(test.line)
+		if domain != test.domain || exception != test.exception || ok != test.ok {
+			t.Errorf("parseABPRule(%q) = %q, %v, %v, expected %q, %v, %v", test.line, domain, exception, ok, test.domain, test.exception, test.ok)
+		}
+	}
+}
+
+func TestParseListABP(t *testing.T) {
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	allow := &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	if _, err := parseList(strings.NewReader(testABPList), formatAuto, block, allow, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"ads.example.com", "tracker.example.net"} {
+		if !block.Exists(domain) {
+			t.Errorf("%s is not blocked", domain)
+		}
+		if !block.MatchWildcard("sub." + domain) {
+			t.Errorf("subdomains of %s are not blocked", domain)
+		}
+	}
+
+	if block.Length() != 6 {
+		t.Errorf("expected 6 block cache entries, got %d", block.Length())
+	}
+
+	if !allow.Exists("allowed.example.com") || allow.Length() != 2 {
+		t.Errorf("expected only allowed.example.com and its subdomains to be allowed, got %d entries", allow.Length())
+	}
+	// the exception allows the subdomains that are blocked by a rule of their own
+	if !allow.Match("cdn.allowed.example.com") || !allow.Match("img.cdn.allowed.example.com") {
+		t.Error("expected the exception to allow the subdomains of allowed.example.com")
+	}
+}
+
+func TestParseListHosts(t *testing.T) {
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	allow := &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	list := "# hosts file\n0.0.0.0 hosts.example.com # comment\nplain.example.com\n\n127.0.0.1\tlocal.example.com\n"
+	stats, err := parseList(strings.NewReader(list+"plain.example.com\n"), formatAuto, block, allow, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := (ListStats{Lines: 6, Domains: 3, Duplicates: 1}); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	for _, domain := range []string{"hosts.example.com", "plain.example.com", "local.example.com"} {
+		if !block.Exists(domain) {
+			t.Errorf("%s is not blocked", domain)
+		}
+	}
+
+	if block.Length() != 3 {
+		t.Errorf("expected 3 block cache entries, got %d", block.Length())
+	}
+}
+
+func TestParseListHostsAddresses(t *testing.T) {
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	allow := &MemoryBlockCache{Backend: make(map[string]bool)}
+	hosts := &MemoryHostsCache{Backend: make(map[string][]net.IP)}
+
+	list := "192.168.1.10 nas.home NAS # file server\nfd00::10 nas.home\n0.0.0.0 ads.example.com\n127.0.0.1 tracker.example.com\n::1 localhost\n"
+	if _, err := parseList(strings.NewReader(list), formatAuto, block, allow, hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	if ips, ok := hosts.Get("nas.home"); !ok || len(ips) != 2 {
+		t.Errorf("expected nas.home to have 2 addresses, got %v", ips)
+	}
+	if _, ok := hosts.Get("nas"); !ok {
+		t.Error("alias of a hosts entry has no address")
+	}
+	if hosts.Length() != 2 || block.Exists("nas.home") {
+		t.Errorf("expected only the entries with real addresses to have addresses, got %v", hosts.Backend)
+	}
+
+	for _, domain := range []string{"ads.example.com", "tracker.example.com", "localhost"} {
+		if !block.Exists(domain) {
+			t.Errorf("%s is not blocked", domain)
+		}
+	}
+}
+
+func TestParseListFormat(t *testing.T) {
+	list := "0.0.0.0 hosts.example.com\nplain.example.com # comment\n||abp.example.com^\n"
+
+	// Adblock Plus rules block the subdomains with a wildcard entry as well
+	tests := []struct {
+		format  string
+		blocked []string
+		length  int
+	}{
+		{formatAuto, []string{"hosts.example.com", "plain.example.com", "abp.example.com"}, 4},
+		{formatHosts, []string{"hosts.example.com"}, 1},
+		{formatDomains, []string{"0.0.0.0", "plain.example.com", "||abp.example.com^"}, 3},
+		{formatABP, []string{"abp.example.com"}, 2},
+	}
+
+	for _, test := range tests {
+		block := &MemoryBlockCache{Backend: make(map[string]bool)}
+		allow := &MemoryBlockCache{Backend: make(map[string]bool)}
+		if _, err := parseList(strings.NewReader(list), test.format, block, allow, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, domain := range test.blocked {
+			if !block.Exists(domain) {
+				t.Errorf("%q: %s is not blocked", test.format, domain)
+			}
+		}
+		if block.Length() != test.length {
+			t.Errorf("%q: expected %d block cache entries, got %d", test.format, test.length, block.Length())
+		}
+	}
+}
@@ -1,29 +1,219 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
-// LoggerInit Initializes the logger
-func LoggerInit(logFile string) (*os.File, error) {
-	if _, err := os.Stat(logFile); os.IsNotExist(err) {
-		if _, err := os.Create(logFile); err != nil {
-			return nil, fmt.Errorf("error creating log file: %s", err)
+// LoggerInit Initializes the logger, logFile is the path of the log file or a
+// syslog target, the returned closer closes the file or the syslog connection
+func LoggerInit(logFile string) (io.Closer, error) {
+	var output io.WriteCloser
+
+	if network, addr, ok, err := syslogTarget(logFile); ok {
+		if err != nil {
+			return nil, err
+		}
+		if output, err = openSyslog(network, addr); err != nil {
+			return nil, fmt.Errorf("error connecting to syslog: %s", err)
+		}
+	} else {
+		if _, err := os.Stat(logFile); os.IsNotExist(err) {
+			if _, err := os.Create(logFile); err != nil {
+				return nil, fmt.Errorf("error creating log file: %s", err)
+			}
 		}
-	}
 
-	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		return nil, fmt.Errorf("error opening log file: %s", err)
+		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("error opening log file: %s", err)
+		}
+		output = file
+
+		if Config().LogMaxSizeMB > 0 {
+			if output, err = newRotatingFile(file, int64(Config().LogMaxSizeMB)<<20, Config().LogMaxBackups, Config().LogCompress); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("error opening log file: %s", err)
+			}
+		}
 	}
 
-	logWriter := io.MultiWriter(os.Stdout, file)
+	logWriter := io.MultiWriter(os.Stdout, output)
 
 	log.SetOutput(logWriter)
 	log.SetFlags(log.Ldate | log.Ltime)
 
-	return file, nil
+	return output, nil
+}
+
+// syslogTarget parses a log setting that starts with syslog:, which is
+// syslog:local for the local syslog daemon or syslog://host:port and
+// syslog+tcp://host:port for a remote one over udp or tcp, the port defaults
+// to 514. ok is false for the path of a log file.
+func syslogTarget(logFile string) (network, addr string, ok bool, err error) {
+	if !strings.HasPrefix(logFile, "syslog") {
+		return "", "", false, nil
+	}
+
+	if logFile == "syslog:local" {
+		return "", "", true, nil
+	}
+
+	for _, scheme := range []string{"syslog", "syslog+udp", "syslog+tcp"} {
+		if !strings.HasPrefix(logFile, scheme+"://") {
+			continue
+		}
+
+		network, addr = "udp", strings.TrimPrefix(logFile, scheme+"://")
+		if scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "514")
+		}
+		return network, addr, true, nil
+	}
+
+	// a file that happens to be called syslog
+	if !strings.Contains(logFile, ":") {
+		return "", "", false, nil
+	}
+
+	return "", "", true, fmt.Errorf("invalid syslog target %s", logFile)
+}
+
+// Event describes a step in handling a query, it is written as a structured
+// record when the log format is json and as the formatted message otherwise
+type Event struct {
+	Client   string   `json:"client,omitempty"`
+	Qname    string   `json:"qname,omitempty"`
+	Qtype    string   `json:"qtype,omitempty"`
+	Action   string   `json:"action"`
+	Upstream string   `json:"upstream,omitempty"`
+	Latency  float64  `json:"latency_ms,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Answers  []string `json:"answers,omitempty"`
+}
+
+type jsonEvent struct {
+	Time string `json:"ts"`
+	Event
+}
+
+// NewEvent returns an event for a query from a client
+func NewEvent(remote net.IP, q Question, action string) Event {
+	e := Event{Qname: q.Qname, Qtype: q.Qtype, Action: action}
+	if remote != nil {
+		e.Client = remote.String()
+	}
+	return e
+}
+
+// WithError returns a copy of the event with the error set
+func (e Event) WithError(err error) Event {
+	e.Error = err.Error()
+	return e
+}
+
+// WithAnswers returns a copy of the event with the values of the answer
+// records of msg, the address of an A or AAAA record, the target of a CNAME
+// and the data of the other records
+func (e Event) WithAnswers(msg *dns.Msg) Event {
+	e.Answers = make([]string, 0, len(msg.Answer))
+	for _, rr := range msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			e.Answers = append(e.Answers, rr.A.String())
+		case *dns.AAAA:
+			e.Answers = append(e.Answers, rr.AAAA.String())
+		case *dns.CNAME:
+			e.Answers = append(e.Answers, rr.Target)
+		default:
+			e.Answers = append(e.Answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+	}
+	return e
+}
+
+// logCategories maps the actions of events to the log category they are
+// logged in, actions without a category are only logged with every category
+var logCategories = map[string]string{
+	"lookup":                "queries",
+	"refused":               "queries",
+	"qtype_disallowed":      "queries",
+	"static":                "queries",
+	"reverse":               "queries",
+	"ipv6_disabled":         "queries",
+	"blocked":               "blocked",
+	"cname_blocked":         "blocked",
+	"would_block":           "blocked",
+	"rebind_blocked":        "blocked",
+	"not_blocked":           "allowed",
+	"cache_miss":            "misses",
+	"cache_hit":             "cache",
+	"block_cache_hit":       "cache",
+	"cache_insert":          "cache",
+	"negative_cache_hit":    "cache",
+	"stale_answer":          "cache",
+	"negative_cache_insert": "cache",
+	"prefetch":              "cache",
+	"resolved":              "upstream",
+	"upstream_failure":      "upstream",
+	"truncated_retry":       "upstream",
+	"upstream_retry":        "upstream",
+	"upstream_fallback":     "upstream",
+	"rewritten":             "upstream",
+	"answer":                "answers",
+}
+
+// logCategoryNames are the log categories of the logcategories setting, the
+// ones that are false are only logged when they are in the setting
+var logCategoryNames = map[string]bool{"queries": true, "blocked": true, "allowed": true, "misses": true, "cache": true, "upstream": true, "errors": true, "answers": false}
+
+// LogEnabled returns whether an event with action is logged at level, so that
+// expensive events can be skipped before they're made
+func LogEnabled(level int, action string) bool {
+	cfg := Config()
+	if cfg.LogLevel < level {
+		return false
+	}
+	if level == 0 {
+		return true
+	}
+
+	category := logCategories[action]
+	if cfg.logCategories == nil {
+		return category == "" || logCategoryNames[category]
+	}
+	return cfg.logCategories[category]
+}
+
+// LogEvent logs an event if the log level is at least level, events above
+// level 0 are only logged if they are in one of the configured log categories
+func LogEvent(level int, e Event, format string, v ...interface{}) {
+	if !LogEnabled(level, e.Action) {
+		return
+	}
+
+	if Config().LogFormat != "json" {
+		log.Printf(format, v...)
+		return
+	}
+
+	line, err := json.Marshal(jsonEvent{time.Now().UTC().Format(time.RFC3339Nano), e})
+	if err != nil {
+		log.Printf(format, v...)
+		return
+	}
+
+	// written to the output of the standard logger directly, bypassing its prefix
+	log.Writer().Write(append(line, '\n'))
 }
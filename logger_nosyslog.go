@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// openSyslog fails, syslog isn't available on this platform
+func openSyslog(network, addr string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
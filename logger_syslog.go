@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to a syslog daemon, the local one if network is empty
+func openSyslog(network, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "grimd")
+}
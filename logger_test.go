@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSyslogTarget(t *testing.T) {
+	tests := []struct {
+		log, network, addr string
+		ok, err            bool
+	}{
+		{"grimd.log", "", "", false, false},
+		{"syslog", "", "", false, false},
+		{"syslog:local", "", "", true, false},
+		{"syslog://192.0.2.1:1514", "udp", "192.0.2.1:1514", true, false},
+		{"syslog://logs.example.com", "udp", "logs.example.com:514", true, false},
+		{"syslog+tcp://192.0.2.1", "tcp", "192.0.2.1:514", true, false},
+		{"syslog:remote", "", "", true, true},
+	}
+
+	for _, test := range tests {
+		network, addr, ok, err := syslogTarget(test.log)
+		if network != test.network || addr != test.addr || ok != test.ok || (err != nil) != test.err {
+			t.Errorf("%s: got %q, %q, %t, %v", test.log, network, addr, ok, err)
+		}
+	}
+}
+
+func TestEventWithAnswers(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Answer = append(msg.Answer,
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "cdn.example.net."},
+		testA("cdn.example.net.", "192.0.2.1"),
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")},
+		&dns.MX{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60}, Preference: 10, Mx: "mail.example.net."},
+	)
+
+	e := NewEvent(nil, Question{"www.example.com", "A", "IN"}, "answer").WithAnswers(msg)
+	if expected := []string{"cdn.example.net.", "192.0.2.1", "2001:db8::1", "10 mail.example.net."}; !reflect.DeepEqual(e.Answers, expected) {
+		t.Errorf("expected %v, got %v", expected, e.Answers)
+	}
+}
+
+func TestLogEventCategories(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	Q := Question{testDomain, "A", "IN"}
+	events := func() {
+		LogEvent(1, NewEvent(nil, Q, "lookup"), "lookup\n")
+		LogEvent(1, NewEvent(nil, Q, "blocked"), "blocked\n")
+		LogEvent(1, NewEvent(nil, Q, "cache_miss"), "cache_miss\n")
+		LogEvent(0, NewEvent(nil, Q, "resolve_error"), "resolve_error\n")
+		LogEvent(2, NewEvent(nil, Q, "answer"), "answer\n")
+	}
+
+	tests := []struct {
+		categories []string
+		expected   []string
+	}{
+		{nil, []string{"lookup", "blocked", "cache_miss", "resolve_error"}},
+		{[]string{"blocked"}, []string{"blocked", "resolve_error"}},
+		{[]string{"misses", "blocked"}, []string{"blocked", "cache_miss", "resolve_error"}},
+		{[]string{"errors"}, []string{"resolve_error"}},
+		{[]string{"answers"}, []string{"resolve_error", "answer"}},
+	}
+
+	for _, test := range tests {
+		withParsedConfig(t, &config{LogLevel: 2, LogCategories: test.categories})
+		buf.Reset()
+		events()
+
+		var logged []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			fields := strings.Fields(line)
+			logged = append(logged, fields[len(fields)-1])
+		}
+		if !reflect.DeepEqual(logged, test.expected) {
+			t.Errorf("%v: expected %v to be logged, got %v", test.categories, test.expected, logged)
+		}
+	}
+
+	withParsedConfig(t, &config{LogLevel: 1, LogCategories: []string{"answers"}})
+	if LogEnabled(2, "answer") {
+		t.Error("answers were logged below loglevel 2")
+	}
+
+	if err := (&config{LogCategories: []string{"everything"}}).parse(); err == nil {
+		t.Error("expected an error for an unknown log category")
+	}
+}
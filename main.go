@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout is how long queries in flight are waited for on shutdown
+const shutdownTimeout = 5 * time.Second
+
 var (
 	configPath  string
 	forceUpdate bool
@@ -16,8 +24,38 @@ var (
 	// BlockCache contains all blocked domains
 	BlockCache = &MemoryBlockCache{Backend: make(map[string]bool)}
 
+	// WhitelistCache contains all domains that are never blocked
+	WhitelistCache = &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	// ManualBlockCache contains the domains blocked through the API
+	ManualBlockCache = &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	// ManualWhitelistCache contains the domains whitelisted through the API
+	ManualWhitelistCache = &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	// ExceptionCache contains the domains allowed by exception rules in the lists
+	ExceptionCache = &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	// HostsCache contains the addresses that local hosts files point domains at
+	HostsCache = &MemoryHostsCache{Backend: make(map[string][]net.IP)}
+
+	// BlockGroups contains the blocked domains of each blocklist group
+	BlockGroups = &BlockGroupCache{Backend: make(map[string]*BlockGroup)}
+
+	// RegexBlockCache contains the patterns of blocked domains
+	RegexBlockCache = &MemoryRegexBlockCache{}
+
 	// QuestionCache contains all queries to the dns server
 	QuestionCache = &MemoryQuestionCache{Backend: make([]QuestionCacheEntry, 0), Maxcount: 1000}
+
+	// QuestionFeed sends the questions to the streams of the gRPC API
+	QuestionFeed = &questionFeed{}
+
+	// TopQueried counts the most queried domains
+	TopQueried = NewTopDomains(topCapacity)
+
+	// TopBlocked counts the most blocked domains
+	TopBlocked = NewTopDomains(topCapacity)
 )
 
 func main() {
@@ -27,47 +65,214 @@ func main() {
 		log.Fatal(err)
 	}
 
-	QuestionCache.Maxcount = Config.QuestionCacheCap
+	resizeQuestionCache()
 
-	logFile, err := LoggerInit(Config.Log)
+	logFile, err := LoggerInit(Config().Log)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer logFile.Close()
+	defer func() {
+		logFile.Close()
+	}()
+
+	if err := OpenQueryLog(); err != nil {
+		log.Fatal(err)
+	}
+	defer CloseQueryLog()
 
 	if _, err := os.Stat("lists"); os.IsNotExist(err) || forceUpdate {
-		if err := Update(); err != nil {
+		if _, err := Update(); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	if err := UpdateBlockCache(); err != nil {
-		log.Fatal(err)
+	handler := NewHandler()
+
+	// answers cached before a rebuild may be blocked or allowed by it
+	flush := func() {
+		log.Printf("%d cached answers flushed after the block cache was rebuilt\n", handler.Flush())
+	}
+
+	if Config().CachePersistPath != "" {
+		if err := LoadCache(Config().CachePersistPath, handler); err != nil {
+			log.Printf("starting with empty caches: %s\n", err)
+		}
+	}
+
+	// a restored block cache is only rebuilt when an update was forced, the
+	// queries are served while it's built and readyz waits for it
+	if BlockCache.Length() == 0 || forceUpdate {
+		RebuildBlockCache(flush)
+	} else {
+		// the manual blocklist of the config may have changed since
+		addManualBlocks(BlockCache)
+		if err := UpdateRuleCaches(ExceptionCache); err != nil {
+			log.Fatal(err)
+		}
+		if err := UpdateGroupCaches(); err != nil {
+			log.Fatal(err)
+		}
+		atomic.StoreInt32(&blockCacheReady, 1)
+	}
+
+	// the scheduled updates are stopped before the caches are persisted
+	updateCtx, stopUpdates := context.WithCancel(context.Background())
+	defer stopUpdates()
+	updating := make(chan struct{})
+	if Config().updateInterval > 0 {
+		go func() {
+			ScheduleUpdates(updateCtx, Config().updateInterval, flush)
+			close(updating)
+		}()
+	} else {
+		close(updating)
+	}
+
+	if Config().healthCheckInterval > 0 {
+		go handler.resolver.CheckHealth(Config().healthCheckInterval, Config().HealthCheckDomain)
+	} else {
+		// readiness still waits for a nameserver to answer
+		domain := Config().HealthCheckDomain
+		if domain == "" {
+			domain = "."
+		}
+		go handler.resolver.ProbeReady(5*time.Second, domain)
 	}
 
 	server := &Server{
-		host:     Config.Bind,
+		udpHosts: Config().listenAddrs("udp"),
+		tcpHosts: Config().listenAddrs("tcp"),
 		rTimeout: 5 * time.Second,
 		wTimeout: 5 * time.Second,
+		handler:  handler,
+	}
+
+	if err := server.Run(); err != nil {
+		log.Fatal(err)
+	}
+
+	api, err := StartAPIServer(handler)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	server.Run()
+	blockPage, err := StartBlockPageServer()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := StartAPIServer(); err != nil {
+	control, err := StartGRPCServer(handler)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGHUP)
 
 forever:
 	for {
 		select {
-		case <-sig:
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				log.Printf("hangup received, reloading\n")
+				logFile = reload(logFile, flush)
+				continue
+			}
+
 			log.Printf("signal received, stopping\n")
 			break forever
 		}
 	}
+
+	// queries still in flight after the timeout are cut off
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	stopUpdates()
+
+	if err := server.Stop(ctx); err != nil {
+		log.Printf("could not drain queries: %s\n", err)
+	}
+	if err := api.Shutdown(ctx); err != nil {
+		log.Printf("could not stop API server: %s\n", err)
+	}
+	if blockPage != nil {
+		if err := blockPage.Shutdown(ctx); err != nil {
+			log.Printf("could not stop block page server: %s\n", err)
+		}
+	}
+	if control != nil {
+		// the streams only end once their questions stop
+		QuestionFeed.Close()
+		stopped := make(chan struct{})
+		go func() {
+			control.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			log.Printf("could not stop gRPC server: %s\n", ctx.Err())
+			control.Stop()
+		}
+	}
+
+	// an update that was already running finishes before the caches are saved
+	select {
+	case <-updating:
+	case <-ctx.Done():
+		log.Printf("could not stop blocklist update: %s\n", ctx.Err())
+	}
+
+	if Config().CachePersistPath != "" {
+		if err := SaveCache(Config().CachePersistPath, handler); err != nil {
+			log.Printf("could not persist caches: %s\n", err)
+		}
+	}
+}
+
+// reload reloads the config, reopens the log files and rebuilds the block
+// cache in the background while the servers keep running, flush is called
+// once it was swapped in. It returns the log file in use.
+func reload(logFile io.Closer, flush func()) io.Closer {
+	if err := ReloadConfig(configPath); err != nil {
+		log.Printf("could not reload config: %s\n", err)
+		return logFile
+	}
+
+	resizeQuestionCache()
+
+	if file, err := LoggerInit(Config().Log); err != nil {
+		log.Printf("could not reopen log file: %s\n", err)
+	} else {
+		logFile.Close()
+		logFile = file
+	}
+
+	if err := OpenQueryLog(); err != nil {
+		log.Printf("could not reopen query log: %s\n", err)
+	}
+
+	if err := ReloadAPICertificate(); err != nil {
+		log.Printf("could not reload API certificate: %s\n", err)
+	}
+
+	RebuildBlockCache(flush)
+
+	return logFile
+}
+
+// resizeQuestionCache applies the question cache capacity of the config, the
+// questions are dropped when the question cache is disabled
+func resizeQuestionCache() {
+	switch cap := Config().QuestionCacheCap; {
+	case cap == 0:
+		QuestionCache.Clear()
+	case cap < 0:
+		QuestionCache.SetMaxcount(0)
+	default:
+		QuestionCache.SetMaxcount(cap)
+	}
 }
 
 func init() {
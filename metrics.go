@@ -0,0 +1,107 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultMetricsPath = "/metrics"
+
+var (
+	// metricsRegistry holds the metrics exposed by the API server
+	metricsRegistry = prometheus.NewRegistry()
+
+	queriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "grimd",
+		Name:      "queries_total",
+		Help:      "Total number of queries received.",
+	})
+
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "grimd",
+		Name:      "cache_hits_total",
+		Help:      "Total number of queries answered from the cache.",
+	})
+
+	cacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "grimd",
+		Name:      "cache_misses_total",
+		Help:      "Total number of queries that were not found in the cache.",
+	})
+
+	queriesInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "grimd",
+		Name:      "queries_inflight",
+		Help:      "Number of queries being handled.",
+	})
+
+	queriesQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "grimd",
+		Name:      "queries_queued",
+		Help:      "Number of queries waiting to be handled once maxconcurrentqueries queries are handled at once.",
+	})
+
+	overloadedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "grimd",
+		Name:      "overloaded_queries_total",
+		Help:      "Total number of queries refused or dropped because too many queries were waiting.",
+	})
+
+	blockedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "grimd",
+		Name:      "blocked_queries_total",
+		Help:      "Total number of queries answered from the blocklist.",
+	})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grimd",
+		Name:      "upstream_errors_total",
+		Help:      "Total number of failed queries to each upstream nameserver.",
+	}, []string{"upstream"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grimd",
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of queries to each upstream nameserver.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"upstream"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grimd",
+		Name:      "query_duration_seconds",
+		Help:      "Latency from receiving a query to writing its answer, by result: cached, blocked, forwarded, static, refused or error.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+	}, []string{"result"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		queriesTotal,
+		queriesInflight,
+		queriesQueued,
+		overloadedTotal,
+		cacheHitsTotal,
+		cacheMissesTotal,
+		blockedTotal,
+		upstreamErrorsTotal,
+		upstreamDuration,
+		queryDuration,
+	)
+}
+
+// timedWriter observes the time from the start of a query until its answer
+// is written in queryDuration, labeled with the result of the query
+type timedWriter struct {
+	dns.ResponseWriter
+	start  time.Time
+	result string
+}
+
+// WriteMsg writes the answer and observes how long the query took
+func (w *timedWriter) WriteMsg(m *dns.Msg) error {
+	err := w.ResponseWriter.WriteMsg(m)
+	queryDuration.WithLabelValues(w.result).Observe(time.Since(w.start).Seconds())
+	return err
+}
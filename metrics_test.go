@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withParsedConfig(t, &config{Metrics: true, MetricsPath: "/stats/prometheus", StaticRecords: map[string][]string{"nas.home": {"A 192.168.1.2"}}, TTL: 600})
+	h := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("nas.home.", dns.TypeA)
+	h.do("udp", &testWriter{}, req)
+
+	w := serveAPI(apiRouter(h), http.MethodGet, "/stats/prometheus", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the metrics on the metrics path, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, metric := range []string{
+		"grimd_queries_total",
+		"grimd_queries_inflight",
+		"grimd_queries_queued",
+		"grimd_overloaded_queries_total",
+		"grimd_cache_hits_total",
+		"grimd_cache_misses_total",
+		"grimd_blocked_queries_total",
+		`grimd_query_duration_seconds_count{result="static"}`,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("expected %s to be served", metric)
+		}
+	}
+
+	withParsedConfig(t, &config{Metrics: true})
+	if w := serveAPI(apiRouter(h), http.MethodGet, defaultMetricsPath, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the metrics on %s by default, got %d", defaultMetricsPath, w.Code)
+	}
+
+	withParsedConfig(t, &config{})
+	if w := serveAPI(apiRouter(h), http.MethodGet, defaultMetricsPath, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected no metrics when they are disabled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "github.com/miekg/dns"
+
+// paddingBlockSize is the size queries to encrypted nameservers are padded to
+// a multiple of, the block size RFC 8467 recommends for queries
+const paddingBlockSize = 128
+
+// padQuery returns a copy of a query with EDNS0 padding, so that its length
+// is a multiple of paddingBlockSize and doesn't give away the name it's for
+func padQuery(req *dns.Msg) *dns.Msg {
+	req = req.Copy()
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+
+	stripPadding(req)
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+
+	// the length already counts the header of the padding option
+	if n := req.Len() % paddingBlockSize; n != 0 {
+		padding.Padding = make([]byte, paddingBlockSize-n)
+	}
+
+	return req
+}
+
+// stripPadding removes the EDNS0 padding from a message
+func stripPadding(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadQuery(t *testing.T) {
+	for _, name := range []string{"a.example.com.", "a-much-longer-name.subdomain.example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		padded := padQuery(req)
+		if padded.Len()%paddingBlockSize != 0 {
+			t.Errorf("%s: expected a multiple of %d bytes, got %d", name, paddingBlockSize, padded.Len())
+		}
+		if req.IsEdns0() != nil {
+			t.Errorf("%s: the query was changed", name)
+		}
+
+		// padding a padded query replaces its padding
+		again := padQuery(padded)
+		if again.Len() != padded.Len() || len(again.IsEdns0().Option) != 1 {
+			t.Errorf("%s: expected the padding to be replaced, got %v", name, again.IsEdns0())
+		}
+	}
+}
+
+func TestResolverPadding(t *testing.T) {
+	var length int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if req.Unpack(body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		length = len(body)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, testA(req.Question[0].Name, "192.0.2.1"))
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+		buf, _ := m.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(buf)
+	}))
+	defer server.Close()
+
+	for _, padding := range []bool{true, false} {
+		withConfig(t, &config{
+			Nameservers: []string{server.URL + "/dns-query?proxy=none"},
+			TLSInsecure: true,
+			EDNSPadding: padding,
+			Interval:    200,
+			Timeout:     5,
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		resp, err := NewResolver().Lookup("udp", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if padded := length%paddingBlockSize == 0; padded != padding {
+			t.Errorf("ednspadding %v: got a query of %d bytes", padding, length)
+		}
+		if padding && resp.IsEdns0() != nil {
+			t.Errorf("expected the padding to be removed from the answer to a query without edns, got %v", resp.IsEdns0())
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// persistVersion is bumped whenever persistedState changes in a way that old
+// files can't be read, gob leaves out the fields that were added or removed
+// since. Files written with another version are ignored.
+const persistVersion = 1
+
+type persistedState struct {
+	Version    int
+	Saved      time.Time
+	Cache      []persistedMesg
+	NegCache   []persistedMesg
+	Block      []string
+	Exceptions []string
+	Manual     []string
+	Allowed    []string
+	Hosts      map[string][]net.IP
+	Questions  []QuestionCacheEntry
+}
+
+// persistedMesg is a cache entry with the message in wire format, Msg is
+// empty for entries that cache a failure
+type persistedMesg struct {
+	Key    string
+	Msg    []byte
+	Stored time.Time
+	Expire time.Time
+}
+
+// SaveCache writes the dns caches of the handler and the block cache to path
+func SaveCache(path string, h *DNSHandler) error {
+	state := persistedState{
+		Version:  persistVersion,
+		Saved:    time.Now(),
+		Cache:    dumpMemoryCache(h.cache),
+		NegCache: dumpMemoryCache(h.negCache),
+	}
+
+	state.Block = BlockCache.Keys()
+	state.Exceptions = ExceptionCache.Keys()
+	state.Manual = ManualBlockCache.Keys()
+	state.Allowed = ManualWhitelistCache.Keys()
+
+	HostsCache.mu.RLock()
+	state.Hosts = HostsCache.Backend
+	HostsCache.mu.RUnlock()
+
+	// the questions name the clients, so they are only kept when asked to
+	if Config().PersistQuestions {
+		state.Questions = QuestionCache.Entries()
+	}
+
+	// write to a temporary file first so that a crash never leaves a partial file behind
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating cache file: %s", err)
+	}
+
+	if err := gob.NewEncoder(file).Encode(&state); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error encoding cache file: %s", err)
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing cache file: %s", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error replacing cache file: %s", err)
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		log.Printf("%d cache and %d block cache entries saved to %s\n", len(state.Cache)+len(state.NegCache), len(state.Block), abs)
+	}
+
+	return nil
+}
+
+// LoadCache restores the dns caches of the handler and the block cache from
+// path, nothing is restored if the file is missing, corrupt or was written by
+// another version
+func LoadCache(path string, h *DNSHandler) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening cache file: %s", err)
+	}
+	defer file.Close()
+
+	var state persistedState
+	if err := gob.NewDecoder(file).Decode(&state); err != nil {
+		return fmt.Errorf("error decoding cache file: %s", err)
+	}
+
+	if state.Version != persistVersion {
+		return fmt.Errorf("cache file has version %d, expected %d", state.Version, persistVersion)
+	}
+
+	loaded := restoreMemoryCache(h.cache, state.Cache) + restoreMemoryCache(h.negCache, state.NegCache)
+
+	for _, key := range state.Block {
+		BlockCache.Set(key, true)
+	}
+	for _, key := range state.Exceptions {
+		ExceptionCache.Set(key, true)
+	}
+	for _, key := range state.Manual {
+		ManualBlockCache.Set(key, true)
+	}
+	for _, key := range state.Allowed {
+		ManualWhitelistCache.Set(key, true)
+	}
+	for domain, ips := range state.Hosts {
+		for _, ip := range ips {
+			HostsCache.Add(domain, ip)
+		}
+	}
+	if Config().PersistQuestions && Config().QuestionCacheCap != 0 {
+		for _, entry := range state.Questions {
+			QuestionCache.Add(entry)
+		}
+	}
+
+	log.Printf("%d cache and %d block cache entries restored from %s\n", loaded, len(state.Block), path)
+
+	return nil
+}
+
+func dumpMemoryCache(cache Cache) []persistedMesg {
+	c, ok := cache.(*MemoryCache)
+	if !ok {
+		return nil
+	}
+
+	cached := c.entries()
+	entries := make([]persistedMesg, 0, len(cached))
+	for key, mesg := range cached {
+		entry := persistedMesg{Key: key, Stored: mesg.Stored, Expire: mesg.Expire}
+		if mesg.Msg != nil {
+			buf, err := mesg.Msg.Pack()
+			if err != nil {
+				continue
+			}
+			entry.Msg = buf
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// restoreMemoryCache adds the entries that haven't expired yet to the cache
+// and returns how many were added
+func restoreMemoryCache(cache Cache, entries []persistedMesg) int {
+	c, ok := cache.(*MemoryCache)
+	if !ok {
+		return 0
+	}
+
+	now := time.Now()
+	loaded := 0
+
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range entries {
+		if entry.Expire.Before(now) {
+			continue
+		}
+
+		mesg := Mesg{Stored: entry.Stored, Expire: entry.Expire}
+		if len(entry.Msg) > 0 {
+			mesg.Msg = new(dns.Msg)
+			if err := mesg.Msg.Unpack(entry.Msg); err != nil {
+				continue
+			}
+		}
+
+		c.insert(entry.Key, mesg)
+		loaded++
+	}
+
+	return loaded
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// emptyGlobalCaches swaps in empty block, hosts and question caches for the
+// rest of the test
+func emptyGlobalCaches(t *testing.T) {
+	caches := []*MemoryBlockCache{BlockCache, ExceptionCache, ManualBlockCache, ManualWhitelistCache}
+	old := make([]map[string]bool, len(caches))
+	for i, c := range caches {
+		old[i] = c.Items()
+		c.Replace(&MemoryBlockCache{Backend: make(map[string]bool)})
+	}
+	hosts := HostsCache.Backend
+	HostsCache.Replace(&MemoryHostsCache{Backend: make(map[string][]net.IP)})
+	QuestionCache.Clear()
+
+	t.Cleanup(func() {
+		for i, c := range caches {
+			c.Replace(&MemoryBlockCache{Backend: make(map[string]bool)})
+			for key := range old[i] {
+				c.Set(key, true)
+			}
+		}
+		HostsCache.Replace(&MemoryHostsCache{Backend: hosts})
+		QuestionCache.Clear()
+	})
+}
+
+func TestPersistCache(t *testing.T) {
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10, PersistQuestions: true, QuestionCacheCap: 10})
+	emptyGlobalCaches(t)
+	path := filepath.Join(t.TempDir(), "cache.gob")
+
+	h := NewHandler()
+	answer := new(dns.Msg)
+	answer.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	answer.Answer = []dns.RR{testRR(dns.Fqdn(testDomain), 300)}
+	answerKey := KeyGen(Question{testDomain, "A", "IN"})
+	h.cache.Set(answerKey, answer)
+
+	expired := new(dns.Msg)
+	expired.SetQuestion("expired.example.com.", dns.TypeA)
+	expired.Answer = []dns.RR{testRR("expired.example.com.", 300)}
+	expiredKey := KeyGen(Question{"expired.example.com", "A", "IN"})
+	setTestEntry(h.cache.(*MemoryCache), expiredKey, Mesg{Msg: expired, Stored: time.Now().Add(-time.Hour), Expire: time.Now().Add(-time.Minute)})
+
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("missing.example.com.", dns.TypeA)
+	nxdomain.SetRcode(nxdomain, dns.RcodeNameError)
+	nxdomain.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Ns: "ns.example.com.", Mbox: "hostmaster.example.com.", Minttl: 300}}
+	negativeKey := KeyGen(Question{"missing.example.com", "A", "IN"})
+	h.negCache.Set(negativeKey, nxdomain)
+	failureKey := KeyGen(Question{"broken.example.com", "A", "IN"})
+	h.negCache.Set(failureKey, nil)
+
+	BlockCache.Set("listed.example.com", true)
+	ExceptionCache.Set("excepted.example.com", true)
+	BlockDomain("manual.example.com")
+	WhitelistDomain("allowed.example.com")
+	HostsCache.Add("nas.home", net.ParseIP("192.168.1.2"))
+	QuestionCache.Add(QuestionCacheEntry{Date: time.Now().Unix(), Remote: "192.168.1.10", Query: Question{testDomain, "A", "IN"}})
+
+	stored, _ := h.cache.(*MemoryCache).entry(answerKey)
+	if err := SaveCache(path, h); err != nil {
+		t.Fatal(err)
+	}
+
+	emptyGlobalCaches(t)
+	restored := NewHandler()
+	if err := LoadCache(path, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	mesg, ok := restored.cache.(*MemoryCache).entry(answerKey)
+	if !ok || len(mesg.Msg.Answer) != 1 || !mesg.Expire.Equal(stored.Expire) {
+		t.Errorf("expected the answer to be restored with its expiry %s, got %+v", stored.Expire, mesg)
+	}
+	if restored.cache.Exists(expiredKey) {
+		t.Error("expected the expired answer to be left out")
+	}
+	if m, err := restored.negCache.Get(negativeKey); err != nil || m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 {
+		t.Errorf("expected the negative answer to be restored, got %v, %v", m, err)
+	}
+	if !restored.negCache.Exists(failureKey) {
+		t.Error("expected the cached failure to be restored")
+	}
+
+	if !BlockCache.Exists("listed.example.com") || !BlockCache.Exists("manual.example.com") || !ExceptionCache.Exists("excepted.example.com") {
+		t.Error("expected the block and exception caches to be restored")
+	}
+	if !ManualBlockCache.Exists("manual.example.com") || !ManualWhitelistCache.Exists("allowed.example.com") {
+		t.Error("expected the domains blocked and whitelisted through the api to be restored")
+	}
+	if ips, ok := HostsCache.Get("nas.home"); !ok || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.1.2")) {
+		t.Errorf("expected the hosts to be restored, got %v", ips)
+	}
+	if entries := QuestionCache.Entries(); len(entries) != 1 || entries[0].Remote != "192.168.1.10" {
+		t.Errorf("expected the questions to be restored, got %+v", entries)
+	}
+}
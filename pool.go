@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const maxIdleConns = 4
+
+// connPool keeps idle connections to a single upstream so that connection
+// oriented transports don't pay for a new handshake on every query. Idle
+// connections are closed once they were idle for longer than maxIdle or are
+// older than maxLifetime, since upstreams close them on their own after a
+// while, a zero duration keeps them forever.
+type connPool struct {
+	client      *dns.Client
+	addr        string
+	maxIdle     time.Duration
+	maxLifetime time.Duration
+	idle        []*pooledConn
+	mu          sync.Mutex
+}
+
+// pooledConn is a connection with the times used to expire it
+type pooledConn struct {
+	*dns.Conn
+	created time.Time
+	used    time.Time
+}
+
+func newConnPool(client *dns.Client, addr string, maxIdle, maxLifetime time.Duration) *connPool {
+	return &connPool{client: client, addr: addr, maxIdle: maxIdle, maxLifetime: maxLifetime}
+}
+
+// get returns an idle connection if there is one, otherwise it dials a new
+// connection, reused reports whether the connection came from the pool
+func (p *connPool) get() (conn *pooledConn, reused bool, err error) {
+	now := time.Now()
+
+	var expired []*pooledConn
+	p.mu.Lock()
+	for n := len(p.idle); n > 0 && conn == nil; n = len(p.idle) {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		if p.expired(c, now) {
+			expired = append(expired, c)
+			continue
+		}
+		conn = c
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		c.Close()
+	}
+
+	if conn != nil {
+		return conn, true, nil
+	}
+
+	conn, err = p.dial()
+	return conn, false, err
+}
+
+func (p *connPool) dial() (*pooledConn, error) {
+	conn, err := p.client.Dial(p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &pooledConn{Conn: conn, created: now, used: now}, nil
+}
+
+// expired returns whether or not an idle connection should no longer be used
+func (p *connPool) expired(conn *pooledConn, now time.Time) bool {
+	if p.maxIdle > 0 && now.Sub(conn.used) > p.maxIdle {
+		return true
+	}
+	return p.maxLifetime > 0 && now.Sub(conn.created) > p.maxLifetime
+}
+
+// put returns a healthy connection to the pool
+func (p *connPool) put(conn *pooledConn) {
+	conn.used = time.Now()
+
+	p.mu.Lock()
+	if len(p.idle) < maxIdleConns && !p.expired(conn, conn.used) {
+		p.idle = append(p.idle, conn)
+		conn = nil
+	}
+	p.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Exchange performs a query on a pooled connection, if a reused connection
+// fails it was most likely closed by the upstream while idle, so the query
+// is retried once on a freshly dialed connection
+func (p *connPool) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := p.client.ExchangeWithConnContext(ctx, req, conn.Conn)
+	if err != nil {
+		conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+
+		if conn, err = p.dial(); err != nil {
+			return nil, err
+		}
+		if resp, _, err = p.client.ExchangeWithConnContext(ctx, req, conn.Conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	p.put(conn)
+
+	return resp, nil
+}
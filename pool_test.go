@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestUpstream starts a tcp nameserver that answers every query with an
+// empty reply and returns its address
+func startTestUpstream(tb testing.TB) string {
+	return startUpstream(tb, "tcp", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+}
+
+func testPoolQuery() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	return m
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	addr := startTestUpstream(t)
+	p := newConnPool(&dns.Client{Net: "tcp", ReadTimeout: time.Second, WriteTimeout: time.Second}, addr, time.Minute, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Exchange(context.Background(), testPoolQuery()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(p.idle) != 1 {
+		t.Fatalf("expected the connection to be reused, %d are idle", len(p.idle))
+	}
+}
+
+func TestConnPoolExpire(t *testing.T) {
+	addr := startTestUpstream(t)
+	p := newConnPool(&dns.Client{Net: "tcp", ReadTimeout: time.Second, WriteTimeout: time.Second}, addr, time.Minute, time.Hour)
+
+	if _, err := p.Exchange(context.Background(), testPoolQuery()); err != nil {
+		t.Fatal(err)
+	}
+	idle := p.idle[0]
+
+	// pretend the connection has been idle for too long
+	idle.used = idle.used.Add(-2 * time.Minute)
+	if conn, reused, err := p.get(); err != nil || reused || conn == idle {
+		t.Errorf("connection idle for too long was reused")
+	}
+
+	if _, err := p.Exchange(context.Background(), testPoolQuery()); err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend the connection is older than its lifetime
+	p.idle[0].created = p.idle[0].created.Add(-2 * time.Hour)
+	if _, reused, err := p.get(); err != nil || reused {
+		t.Errorf("connection past its lifetime was reused")
+	}
+}
+
+func BenchmarkConnPool(b *testing.B) {
+	addr := startTestUpstream(b)
+	p := newConnPool(&dns.Client{Net: "tcp", ReadTimeout: time.Second, WriteTimeout: time.Second}, addr, 0, 0)
+	m := testPoolQuery()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Exchange(context.Background(), m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDialPerQuery(b *testing.B) {
+	addr := startTestUpstream(b)
+	c := &dns.Client{Net: "tcp", ReadTimeout: time.Second, WriteTimeout: time.Second}
+	m := testPoolQuery()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := c.Exchange(m, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,649 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: grimd.proto
+
+// Control is the gRPC counterpart of the web api, for programs that manage
+// grimd instead of a browser. It mirrors the endpoints of the web api and
+// streams the questions as they are answered instead of having clients poll
+// /questioncache.
+
+package grimdpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type DomainRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Domain        string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DomainRequest) Reset() {
+	*x = DomainRequest{}
+	mi := &file_grimd_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DomainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DomainRequest) ProtoMessage() {}
+
+func (x *DomainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DomainRequest.ProtoReflect.Descriptor instead.
+func (*DomainRequest) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *DomainRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+type BlockResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// false if an unblocked domain wasn't blocked
+	Success       bool `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockResponse) Reset() {
+	*x = BlockResponse{}
+	mi := &file_grimd_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockResponse) ProtoMessage() {}
+
+func (x *BlockResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockResponse.ProtoReflect.Descriptor instead.
+func (*BlockResponse) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BlockResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+type FlushCacheRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// empty flushes every answer
+	Domain        string `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FlushCacheRequest) Reset() {
+	*x = FlushCacheRequest{}
+	mi := &file_grimd_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FlushCacheRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushCacheRequest) ProtoMessage() {}
+
+func (x *FlushCacheRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushCacheRequest.ProtoReflect.Descriptor instead.
+func (*FlushCacheRequest) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *FlushCacheRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+type FlushCacheResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Removed       int64                  `protobuf:"varint,1,opt,name=removed,proto3" json:"removed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FlushCacheResponse) Reset() {
+	*x = FlushCacheResponse{}
+	mi := &file_grimd_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FlushCacheResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushCacheResponse) ProtoMessage() {}
+
+func (x *FlushCacheResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushCacheResponse.ProtoReflect.Descriptor instead.
+func (*FlushCacheResponse) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *FlushCacheResponse) GetRemoved() int64 {
+	if x != nil {
+		return x.Removed
+	}
+	return 0
+}
+
+type StatsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// start the counters over from zero
+	Reset_        bool `protobuf:"varint,1,opt,name=reset,proto3" json:"reset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatsRequest) Reset() {
+	*x = StatsRequest{}
+	mi := &file_grimd_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsRequest) ProtoMessage() {}
+
+func (x *StatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsRequest.ProtoReflect.Descriptor instead.
+func (*StatsRequest) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *StatsRequest) GetReset_() bool {
+	if x != nil {
+		return x.Reset_
+	}
+	return false
+}
+
+type StatsResponse struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Hits      uint64                 `protobuf:"varint,1,opt,name=hits,proto3" json:"hits,omitempty"`
+	Misses    uint64                 `protobuf:"varint,2,opt,name=misses,proto3" json:"misses,omitempty"`
+	Evictions uint64                 `protobuf:"varint,3,opt,name=evictions,proto3" json:"evictions,omitempty"`
+	Size      int64                  `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	// how full the cache is from 0 to 1, 0 when maxcount is 0
+	Fill float64 `protobuf:"fixed64,5,opt,name=fill,proto3" json:"fill,omitempty"`
+	// the sizes of the caches of negative and blocked answers
+	NegativeSize  int64 `protobuf:"varint,6,opt,name=negative_size,json=negativeSize,proto3" json:"negative_size,omitempty"`
+	BlockSize     int64 `protobuf:"varint,7,opt,name=block_size,json=blockSize,proto3" json:"block_size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatsResponse) Reset() {
+	*x = StatsResponse{}
+	mi := &file_grimd_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsResponse) ProtoMessage() {}
+
+func (x *StatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsResponse.ProtoReflect.Descriptor instead.
+func (*StatsResponse) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *StatsResponse) GetHits() uint64 {
+	if x != nil {
+		return x.Hits
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetMisses() uint64 {
+	if x != nil {
+		return x.Misses
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetEvictions() uint64 {
+	if x != nil {
+		return x.Evictions
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetFill() float64 {
+	if x != nil {
+		return x.Fill
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetNegativeSize() int64 {
+	if x != nil {
+		return x.NegativeSize
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetBlockSize() int64 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+type StreamQuestionsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// only stream the questions of a client, empty for every client
+	Client string `protobuf:"bytes,1,opt,name=client,proto3" json:"client,omitempty"`
+	// only stream the blocked questions
+	Blocked       bool `protobuf:"varint,2,opt,name=blocked,proto3" json:"blocked,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamQuestionsRequest) Reset() {
+	*x = StreamQuestionsRequest{}
+	mi := &file_grimd_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamQuestionsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamQuestionsRequest) ProtoMessage() {}
+
+func (x *StreamQuestionsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamQuestionsRequest.ProtoReflect.Descriptor instead.
+func (*StreamQuestionsRequest) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *StreamQuestionsRequest) GetClient() string {
+	if x != nil {
+		return x.Client
+	}
+	return ""
+}
+
+func (x *StreamQuestionsRequest) GetBlocked() bool {
+	if x != nil {
+		return x.Blocked
+	}
+	return false
+}
+
+type Question struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Type          string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Class         string                 `protobuf:"bytes,3,opt,name=class,proto3" json:"class,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Question) Reset() {
+	*x = Question{}
+	mi := &file_grimd_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Question) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Question) ProtoMessage() {}
+
+func (x *Question) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Question.ProtoReflect.Descriptor instead.
+func (*Question) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Question) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Question) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Question) GetClass() string {
+	if x != nil {
+		return x.Class
+	}
+	return ""
+}
+
+type QuestionCacheEntry struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// unix time in seconds
+	Date          int64     `protobuf:"varint,1,opt,name=date,proto3" json:"date,omitempty"`
+	Client        string    `protobuf:"bytes,2,opt,name=client,proto3" json:"client,omitempty"`
+	Blocked       bool      `protobuf:"varint,3,opt,name=blocked,proto3" json:"blocked,omitempty"`
+	Wouldblock    bool      `protobuf:"varint,4,opt,name=wouldblock,proto3" json:"wouldblock,omitempty"`
+	Query         *Question `protobuf:"bytes,5,opt,name=query,proto3" json:"query,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QuestionCacheEntry) Reset() {
+	*x = QuestionCacheEntry{}
+	mi := &file_grimd_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuestionCacheEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuestionCacheEntry) ProtoMessage() {}
+
+func (x *QuestionCacheEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_grimd_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuestionCacheEntry.ProtoReflect.Descriptor instead.
+func (*QuestionCacheEntry) Descriptor() ([]byte, []int) {
+	return file_grimd_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *QuestionCacheEntry) GetDate() int64 {
+	if x != nil {
+		return x.Date
+	}
+	return 0
+}
+
+func (x *QuestionCacheEntry) GetClient() string {
+	if x != nil {
+		return x.Client
+	}
+	return ""
+}
+
+func (x *QuestionCacheEntry) GetBlocked() bool {
+	if x != nil {
+		return x.Blocked
+	}
+	return false
+}
+
+func (x *QuestionCacheEntry) GetWouldblock() bool {
+	if x != nil {
+		return x.Wouldblock
+	}
+	return false
+}
+
+func (x *QuestionCacheEntry) GetQuery() *Question {
+	if x != nil {
+		return x.Query
+	}
+	return nil
+}
+
+var File_grimd_proto protoreflect.FileDescriptor
+
+const file_grimd_proto_rawDesc = "" +
+	"\n" +
+	"\vgrimd.proto\x12\x05grimd\"'\n" +
+	"\rDomainRequest\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\")\n" +
+	"\rBlockResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"+\n" +
+	"\x11FlushCacheRequest\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\".\n" +
+	"\x12FlushCacheResponse\x12\x18\n" +
+	"\aremoved\x18\x01 \x01(\x03R\aremoved\"$\n" +
+	"\fStatsRequest\x12\x14\n" +
+	"\x05reset\x18\x01 \x01(\bR\x05reset\"\xc5\x01\n" +
+	"\rStatsResponse\x12\x12\n" +
+	"\x04hits\x18\x01 \x01(\x04R\x04hits\x12\x16\n" +
+	"\x06misses\x18\x02 \x01(\x04R\x06misses\x12\x1c\n" +
+	"\tevictions\x18\x03 \x01(\x04R\tevictions\x12\x12\n" +
+	"\x04size\x18\x04 \x01(\x03R\x04size\x12\x12\n" +
+	"\x04fill\x18\x05 \x01(\x01R\x04fill\x12#\n" +
+	"\rnegative_size\x18\x06 \x01(\x03R\fnegativeSize\x12\x1d\n" +
+	"\n" +
+	"block_size\x18\a \x01(\x03R\tblockSize\"J\n" +
+	"\x16StreamQuestionsRequest\x12\x16\n" +
+	"\x06client\x18\x01 \x01(\tR\x06client\x12\x18\n" +
+	"\ablocked\x18\x02 \x01(\bR\ablocked\"H\n" +
+	"\bQuestion\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x14\n" +
+	"\x05class\x18\x03 \x01(\tR\x05class\"\xa1\x01\n" +
+	"\x12QuestionCacheEntry\x12\x12\n" +
+	"\x04date\x18\x01 \x01(\x03R\x04date\x12\x16\n" +
+	"\x06client\x18\x02 \x01(\tR\x06client\x12\x18\n" +
+	"\ablocked\x18\x03 \x01(\bR\ablocked\x12\x1e\n" +
+	"\n" +
+	"wouldblock\x18\x04 \x01(\bR\n" +
+	"wouldblock\x12%\n" +
+	"\x05query\x18\x05 \x01(\v2\x0f.grimd.QuestionR\x05query2\xbb\x02\n" +
+	"\aControl\x123\n" +
+	"\x05Block\x12\x14.grimd.DomainRequest\x1a\x14.grimd.BlockResponse\x125\n" +
+	"\aUnblock\x12\x14.grimd.DomainRequest\x1a\x14.grimd.BlockResponse\x12A\n" +
+	"\n" +
+	"FlushCache\x12\x18.grimd.FlushCacheRequest\x1a\x19.grimd.FlushCacheResponse\x122\n" +
+	"\x05Stats\x12\x13.grimd.StatsRequest\x1a\x14.grimd.StatsResponse\x12M\n" +
+	"\x0fStreamQuestions\x12\x1d.grimd.StreamQuestionsRequest\x1a\x19.grimd.QuestionCacheEntry0\x01B(Z&github.com/looterz/grimd/proto;grimdpbb\x06proto3"
+
+var (
+	file_grimd_proto_rawDescOnce sync.Once
+	file_grimd_proto_rawDescData []byte
+)
+
+func file_grimd_proto_rawDescGZIP() []byte {
+	file_grimd_proto_rawDescOnce.Do(func() {
+		file_grimd_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_grimd_proto_rawDesc), len(file_grimd_proto_rawDesc)))
+	})
+	return file_grimd_proto_rawDescData
+}
+
+var file_grimd_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_grimd_proto_goTypes = []any{
+	(*DomainRequest)(nil),          // 0: grimd.DomainRequest
+	(*BlockResponse)(nil),          // 1: grimd.BlockResponse
+	(*FlushCacheRequest)(nil),      // 2: grimd.FlushCacheRequest
+	(*FlushCacheResponse)(nil),     // 3: grimd.FlushCacheResponse
+	(*StatsRequest)(nil),           // 4: grimd.StatsRequest
+	(*StatsResponse)(nil),          // 5: grimd.StatsResponse
+	(*StreamQuestionsRequest)(nil), // 6: grimd.StreamQuestionsRequest
+	(*Question)(nil),               // 7: grimd.Question
+	(*QuestionCacheEntry)(nil),     // 8: grimd.QuestionCacheEntry
+}
+var file_grimd_proto_depIdxs = []int32{
+	7, // 0: grimd.QuestionCacheEntry.query:type_name -> grimd.Question
+	0, // 1: grimd.Control.Block:input_type -> grimd.DomainRequest
+	0, // 2: grimd.Control.Unblock:input_type -> grimd.DomainRequest
+	2, // 3: grimd.Control.FlushCache:input_type -> grimd.FlushCacheRequest
+	4, // 4: grimd.Control.Stats:input_type -> grimd.StatsRequest
+	6, // 5: grimd.Control.StreamQuestions:input_type -> grimd.StreamQuestionsRequest
+	1, // 6: grimd.Control.Block:output_type -> grimd.BlockResponse
+	1, // 7: grimd.Control.Unblock:output_type -> grimd.BlockResponse
+	3, // 8: grimd.Control.FlushCache:output_type -> grimd.FlushCacheResponse
+	5, // 9: grimd.Control.Stats:output_type -> grimd.StatsResponse
+	8, // 10: grimd.Control.StreamQuestions:output_type -> grimd.QuestionCacheEntry
+	6, // [6:11] is the sub-list for method output_type
+	1, // [1:6] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_grimd_proto_init() }
+func file_grimd_proto_init() {
+	if File_grimd_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_grimd_proto_rawDesc), len(file_grimd_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_grimd_proto_goTypes,
+		DependencyIndexes: file_grimd_proto_depIdxs,
+		MessageInfos:      file_grimd_proto_msgTypes,
+	}.Build()
+	File_grimd_proto = out.File
+	file_grimd_proto_goTypes = nil
+	file_grimd_proto_depIdxs = nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryLog is the file every query is written to as a line, apart from the
+// log and the question cache, when querylog is set
+var queryLog struct {
+	file     io.WriteCloser
+	w        *bufio.Writer
+	format   string
+	stop     chan struct{}
+	mu       sync.Mutex
+	interval time.Duration
+}
+
+// OpenQueryLog opens the query log of the config, the query log in use is
+// closed first so that a reload can move it
+func OpenQueryLog() error {
+	CloseQueryLog()
+
+	path := Config().QueryLog
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening query log: %s", err)
+	}
+	var output io.WriteCloser = file
+
+	// the query log is rotated with the settings of the log file
+	if Config().LogMaxSizeMB > 0 {
+		if output, err = newRotatingFile(file, int64(Config().LogMaxSizeMB)<<20, Config().LogMaxBackups, Config().LogCompress); err != nil {
+			file.Close()
+			return fmt.Errorf("error opening query log: %s", err)
+		}
+	}
+
+	queryLog.mu.Lock()
+	defer queryLog.mu.Unlock()
+
+	queryLog.file, queryLog.w, queryLog.format = output, bufio.NewWriter(output), Config().QueryLogFormat
+	queryLog.interval = time.Duration(Config().QueryLogFlushInterval) * time.Second
+	if queryLog.interval <= 0 {
+		queryLog.interval = time.Second
+	}
+	queryLog.stop = make(chan struct{})
+	go flushQueryLog(queryLog.stop, queryLog.interval)
+
+	return nil
+}
+
+// CloseQueryLog writes out the buffered queries and closes the query log
+func CloseQueryLog() {
+	queryLog.mu.Lock()
+	defer queryLog.mu.Unlock()
+
+	if queryLog.file == nil {
+		return
+	}
+
+	close(queryLog.stop)
+	if err := queryLog.w.Flush(); err != nil {
+		log.Printf("could not write query log: %s\n", err)
+	}
+	queryLog.file.Close()
+	queryLog.file, queryLog.w = nil, nil
+}
+
+// flushQueryLog writes out the buffered queries every interval until stop is
+// closed
+func flushQueryLog(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		queryLog.mu.Lock()
+		if queryLog.w != nil {
+			if err := queryLog.w.Flush(); err != nil {
+				log.Printf("could not write query log: %s\n", err)
+			}
+		}
+		queryLog.mu.Unlock()
+	}
+}
+
+// writeQueryLog adds a query to the query log, the line is written out with
+// the next flush
+func writeQueryLog(entry QuestionCacheEntry) {
+	queryLog.mu.Lock()
+	defer queryLog.mu.Unlock()
+
+	if queryLog.w == nil {
+		return
+	}
+
+	// the csv writer would flush the buffer of the query log
+	if queryLog.format == "csv" {
+		var line strings.Builder
+		w := csv.NewWriter(&line)
+		w.Write([]string{
+			time.Unix(entry.Date, 0).UTC().Format(time.RFC3339), entry.Remote,
+			entry.Query.Qname, entry.Query.Qtype, entry.Query.Qclass,
+			strconv.FormatBool(entry.Blocked), strconv.FormatBool(entry.WouldBlock),
+		})
+		w.Flush()
+		queryLog.w.WriteString(line.String())
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	queryLog.w.Write(append(line, '\n'))
+}
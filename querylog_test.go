@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	for _, format := range []string{"json", "csv"} {
+		path := filepath.Join(t.TempDir(), "queries.log")
+		withConfig(t, &config{QueryLog: path, QueryLogFormat: format, QueryLogFlushInterval: 60})
+		if err := OpenQueryLog(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(CloseQueryLog)
+
+		logQuestion(net.ParseIP("192.168.1.10"), Question{"ads.example.com", "A", "IN"}, true, false)
+		logQuestion(net.ParseIP("192.168.1.11"), Question{"www.example.com", "AAAA", "IN"}, false, false)
+
+		// the lines are buffered until the next flush
+		if content, _ := ioutil.ReadFile(path); len(content) != 0 {
+			t.Errorf("%s: expected the lines to be buffered, got %q", format, content)
+		}
+		CloseQueryLog()
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("%s: expected a line for every query, got %q", format, content)
+		}
+
+		switch format {
+		case "json":
+			var entry QuestionCacheEntry
+			if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Remote != "192.168.1.10" || entry.Query.Qname != "ads.example.com" || !entry.Blocked {
+				t.Errorf("unexpected entry %+v", entry)
+			}
+		case "csv":
+			if fields := strings.Split(lines[1], ","); len(fields) != 7 || fields[1] != "192.168.1.11" || fields[3] != "AAAA" || fields[5] != "false" {
+				t.Errorf("unexpected line %q", lines[1])
+			}
+		}
+	}
+}
+
+func TestQueryLogFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	withConfig(t, &config{QueryLog: path, QueryLogFlushInterval: 1})
+	if err := OpenQueryLog(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseQueryLog)
+
+	logQuestion(net.ParseIP("192.168.1.10"), Question{"www.example.com", "A", "IN"}, false, false)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if content, _ := ioutil.ReadFile(path); len(content) > 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("the query log wasn't flushed after querylogflushinterval")
+}
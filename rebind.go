@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// localSuffixes are the domains of local networks, names in them are expected
+// to resolve to private addresses
+var localSuffixes = []string{"local", "lan", "home", "internal", "localdomain", "localhost", "home.arpa"}
+
+// rebindingAddress returns the first private address in the answer to a query
+// for a public name, an answer like that lets a site reach the network of the
+// client through the browser. Single label names, local domains, the domains
+// of conditional forwarders and the domains in rebindallowed may resolve to
+// private addresses.
+func rebindingAddress(qname string, msg *dns.Msg) (net.IP, bool) {
+	if !Config().RebindProtection || rebindAllowed(qname) {
+		return nil, false
+	}
+
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		if privateIP(ip) {
+			return ip, true
+		}
+	}
+
+	return nil, false
+}
+
+// rebindAllowed returns whether or not a name may resolve to private addresses
+func rebindAllowed(qname string) bool {
+	cfg := Config()
+	name := normalizeDomain(UnFqdn(qname))
+	if !strings.Contains(name, ".") || cfg.forwardersFor(name) != nil {
+		return true
+	}
+
+	for _, suffix := range localSuffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+
+	for _, allowed := range cfg.RebindAllowed {
+		allowed = normalizeDomain(UnFqdn(allowed))
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(name, allowed[1:]) {
+				return true
+			}
+		} else if name == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// privateIP returns whether or not an address belongs to a private, loopback,
+// link local or unspecified network
+func privateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
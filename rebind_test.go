@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRebindingAddress(t *testing.T) {
+	c := &config{RebindProtection: true, RebindAllowed: []string{"*.plex.direct", "router.example.com"}, ConditionalForwarders: map[string]stringList{"corp.example.com": {"10.0.0.1:53"}}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	tests := []struct {
+		name      string
+		address   string
+		rebinding bool
+	}{
+		{"www.example.com.", "192.168.1.10", true},
+		{"www.example.com.", "127.0.0.1", true},
+		{"www.example.com.", "0.0.0.0", true},
+		{"www.example.com.", "fd00::10", true},
+		{"www.example.com.", "::1", true},
+		{"www.example.com.", "169.254.1.1", true},
+		{"www.example.com.", "198.51.100.1", false},
+		{"www.example.com.", "2001:db8::1", false},
+		{"nas.", "192.168.1.10", false},
+		{"nas.home.", "192.168.1.10", false},
+		{"nas.home.arpa.", "192.168.1.10", false},
+		{"host.corp.example.com.", "10.1.2.3", false},
+		{"abc.plex.direct.", "192.168.1.10", false},
+		{"Router.Example.com.", "192.168.1.1", false},
+	}
+
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, dns.TypeA)
+		if ip := net.ParseIP(test.address); ip.To4() != nil {
+			msg.Answer = append(msg.Answer, testA(test.name, test.address))
+		} else {
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: test.name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300}, AAAA: ip})
+		}
+
+		if _, ok := rebindingAddress(test.name, msg); ok != test.rebinding {
+			t.Errorf("%s %s: expected rebinding %v, got %v", test.name, test.address, test.rebinding, ok)
+		}
+	}
+
+	c.RebindProtection = false
+	msg := new(dns.Msg)
+	msg.Answer = append(msg.Answer, testA("www.example.com.", "192.168.1.10"))
+	if _, ok := rebindingAddress("www.example.com.", msg); ok {
+		t.Error("rebinding was detected without rebindprotection")
+	}
+}
+
+func TestRebindProtection(t *testing.T) {
+	upstream := startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, testA(req.Question[0].Name, "192.168.1.10"))
+		w.WriteMsg(m)
+	})
+
+	withParsedConfig(t, &config{Nameservers: []string{upstream}, Interval: 10, Timeout: 1, RebindProtection: true})
+
+	h := NewHandler()
+	for name, rcode := range map[string]int{"www.example.com.": dns.RcodeNameError, "nas.lan.": dns.RcodeSuccess} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &testWriter{}
+		h.do("udp", w, req)
+
+		if w.msg == nil || w.msg.Rcode != rcode {
+			t.Errorf("%s: expected %s, got %v", name, dns.RcodeToString[rcode], w.msg)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,62 +26,218 @@ func (e ResolvError) Error() string {
 	return errmsg
 }
 
+// upstreamBackoff is how long a nameserver that couldn't be reached is asked
+// last when the nameservers are rotated
+const upstreamBackoff = 30 * time.Second
+
 // Resolver type
 type Resolver struct {
-	config *dns.ClientConfig
+	// next is the rotation counter of the roundrobin mode, it comes first so
+	// that it's 64-bit aligned for atomic access on 32-bit platforms
+	next uint64
+	// ready is set once a nameserver passed a probe
+	ready int32
+
+	config    *dns.ClientConfig
+	pools     map[string]*connPool
+	doh       map[string]*dohClient
+	doq       map[string]*doqClient
+	validator *Validator
+	mu        sync.Mutex
+
+	// down holds until when the nameservers that couldn't be reached are
+	// asked last
+	down map[string]time.Time
+
+	// health holds the results of the last health checks
+	health map[string]UpstreamHealth
+
+	// stats counts the queries to every nameserver
+	stats map[string]*upstreamCounters
+}
+
+// UpstreamHealth is the result of the last health check of a nameserver
+type UpstreamHealth struct {
+	Nameserver string    `json:"nameserver"`
+	Healthy    bool      `json:"healthy"`
+	Checked    time.Time `json:"checked"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// NewResolver returns a new Resolver
+func NewResolver() *Resolver {
+	r := &Resolver{pools: make(map[string]*connPool), doh: make(map[string]*dohClient), doq: make(map[string]*doqClient), down: make(map[string]time.Time), health: make(map[string]UpstreamHealth), stats: make(map[string]*upstreamCounters)}
+	r.validator = NewValidator(Config().trustAnchors, r.lookupRecord)
+	return r
 }
 
 // Lookup will ask each nameserver in top-to-bottom fashion, starting a new request
 // in every second, and return as early as possbile (have an answer).
+// When the resolver mode is race every nameserver is asked at once instead.
 // It returns an error if no request has succeeded.
-func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error) {
-	c := &dns.Client{
-		Net:          net,
-		ReadTimeout:  r.Timeout(),
-		WriteTimeout: r.Timeout(),
+func (r *Resolver) Lookup(Net string, req *dns.Msg, remote net.IP) (message *dns.Msg, err error) {
+	cfg := Config()
+	// forward the client subnet, unless the client already sent one
+	if subnet := ClientSubnet(req, remote); subnet != nil && requestSubnet(req) == nil {
+		clientEdns := req.IsEdns0() != nil
+
+		req = req.Copy()
+		if !clientEdns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
+
+		defer func() {
+			if message == nil {
+				return
+			}
+			if clientEdns {
+				stripSubnet(message)
+			} else {
+				stripEdns(message)
+			}
+		}()
 	}
 
-	qname := req.Question[0].Name
+	// a client that sets the CD bit validates the answer itself
+	// internal domains of conditional forwarders are rarely signed
+	if cfg.DNSSECValidate && !req.CheckingDisabled && cfg.forwardersFor(req.Question[0].Name) == nil {
+		return r.lookupSecure(Net, req, remote)
+	}
+
+	return r.resolve(Net, req, remote)
+}
+
+// lookupSecure resolves a query with the signatures and validates the answer,
+// the signatures are only returned to clients that asked for them
+func (r *Resolver) lookupSecure(Net string, req *dns.Msg, remote net.IP) (*dns.Msg, error) {
+	opt := req.IsEdns0()
+	clientEdns, clientDo := opt != nil, opt != nil && opt.Do()
+
+	// the nameserver is asked not to validate, so that bogus answers are
+	// returned to us instead of a SERVFAIL
+	upstreamReq := req.Copy()
+	if clientEdns {
+		upstreamReq.IsEdns0().SetDo()
+	} else {
+		upstreamReq.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	upstreamReq.CheckingDisabled = true
+
+	msg, err := r.resolve(Net, upstreamReq, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	q := req.Question[0]
+	secure, err := r.validator.Validate(msg)
+	if err != nil {
+		ev := NewEvent(remote, Question{UnFqdn(q.Name), dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]}, "dnssec_bogus")
+		LogEvent(0, ev.WithError(err), "%s\n", err)
+		return nil, err
+	}
+
+	msg.AuthenticatedData = secure
+	msg.CheckingDisabled = false
+
+	if !clientDo {
+		stripDnssec(msg, q.Qtype)
+		if !clientEdns {
+			stripEdns(msg)
+		} else if opt := msg.IsEdns0(); opt != nil {
+			opt.SetDo(false)
+		}
+	}
+
+	return msg, nil
+}
+
+// lookupRecord resolves a record the validator needs, the signatures are
+// fetched without having the nameserver validate them
+func (r *Resolver) lookupRecord(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+
+	msg, err := r.resolve("udp", req, nil)
+	if err == nil && msg.Truncated {
+		msg, err = r.resolve("tcp", req, nil)
+	}
+
+	return msg, err
+}
+
+// resolve sends a query to the nameservers as configured by the resolver mode
+func (r *Resolver) resolve(Net string, req *dns.Msg, remote net.IP) (*dns.Msg, error) {
+	c := r.client(Net)
+
+	// the lookup, and with it the retries of its queries, ends after timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.Timeout() > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), r.Timeout())
+	}
+	defer cancel()
+
+	q := req.Question[0]
+	ev := NewEvent(remote, Question{UnFqdn(q.Name), dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]}, "")
+
+	// the next tier is only asked once every nameserver of a tier failed
+	var asked []string
+	for i, nameservers := range r.tiersFor(q.Name) {
+		if i > 0 {
+			ev.Action = "upstream_fallback"
+			LogEvent(1, ev, "%s falling back to the nameservers of tier %d\n", UnFqdn(q.Name), i+1)
+		}
+
+		var msg *dns.Msg
+		if Config().ResolverMode == "race" {
+			msg = r.race(ctx, c, Net, req, ev, nameservers)
+		} else {
+			msg = r.sequential(ctx, c, Net, req, ev, nameservers)
+		}
+		if msg != nil {
+			return msg, nil
+		}
+
+		asked = append(asked, nameservers...)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, ResolvError{q.Name, Net, asked}
+}
 
+// sequential asks the nameservers top-down, starting the next query every
+// interval, and returns the first usable answer, nil if there is none
+func (r *Resolver) sequential(ctx context.Context, c *dns.Client, Net string, req *dns.Msg, ev Event, nameservers []string) *dns.Msg {
 	res := make(chan *dns.Msg, 1)
 	var wg sync.WaitGroup
 	L := func(nameserver string) {
 		defer wg.Done()
-		r, _, err := c.Exchange(req, nameserver)
-		if err != nil {
-			log.Printf("%s socket error on %s", qname, nameserver)
-			log.Printf("error:%s", err.Error())
+		r := r.query(ctx, c, nameserver, Net, req, ev)
+		if r == nil {
 			return
 		}
-		if r != nil && r.Rcode != dns.RcodeSuccess {
-			if Config.LogLevel > 0 {
-				log.Printf("%s failed to get an valid answer on %s", qname, nameserver)
-			}
-			if r.Rcode == dns.RcodeServerFailure {
-				return
-			}
-		} else {
-			if Config.LogLevel > 0 {
-				log.Printf("%s resolv on %s (%s)\n", UnFqdn(qname), nameserver, net)
-			}
-		}
 		select {
 		case res <- r:
 		default:
 		}
 	}
 
-	ticker := time.NewTicker(time.Duration(Config.Interval) * time.Millisecond)
+	ticker := time.NewTicker(time.Duration(Config().Interval) * time.Millisecond)
 	defer ticker.Stop()
 
 	// Start lookup on each nameserver top-down, in every second
-	for _, nameserver := range r.Nameservers() {
+	for _, nameserver := range nameservers {
 		wg.Add(1)
 		go L(nameserver)
 		// but exit early, if we have an answer
 		select {
 		case r := <-res:
-			return r, nil
+			return r
 		case <-ticker.C:
 			continue
 		}
@@ -87,18 +247,455 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 	wg.Wait()
 	select {
 	case r := <-res:
-		return r, nil
+		return r
 	default:
-		return nil, ResolvError{qname, net, r.Nameservers()}
+		return nil
+	}
+}
+
+// tiersFor returns the tiers of nameservers a query for qname is sent to, the
+// conditional forwarders of the domain in the order they are configured or
+// else the nameservers and the tiers of fallback nameservers, each in the
+// order of the resolver mode
+func (r *Resolver) tiersFor(qname string) [][]string {
+	cfg := Config()
+	if forwarders := cfg.forwardersFor(qname); forwarders != nil {
+		return [][]string{forwarders}
 	}
+
+	var tiers [][]string
+	for _, tier := range cfg.tiers() {
+		if nameservers := r.order(tier); len(nameservers) > 0 {
+			tiers = append(tiers, nameservers)
+		}
+	}
+	return tiers
 }
 
-// Nameservers return the array of nameservers
+// order returns the nameservers of a tier in the order they are asked, the
+// roundrobin and random modes rotate them and ask the nameservers that are
+// down last, nameservers that failed their health check are left out
+func (r *Resolver) order(tier []string) []string {
+	nameservers := r.healthy(tier)
+	if len(nameservers) == 0 {
+		return nameservers
+	}
+
+	var start int
+	switch Config().ResolverMode {
+	case "roundrobin":
+		start = int((atomic.AddUint64(&r.next, 1) - 1) % uint64(len(nameservers)))
+	case "random":
+		start = rand.Intn(len(nameservers))
+	default:
+		return nameservers
+	}
+
+	now := time.Now()
+	ordered := make([]string, 0, len(nameservers))
+	var down []string
+
+	r.mu.Lock()
+	for i := range nameservers {
+		nameserver := nameservers[(start+i)%len(nameservers)]
+		if until, ok := r.down[nameserver]; ok && now.Before(until) {
+			down = append(down, nameserver)
+		} else {
+			ordered = append(ordered, nameserver)
+		}
+	}
+	r.mu.Unlock()
+
+	return append(ordered, down...)
+}
+
+// healthy returns the nameservers of a tier that passed their last health
+// check, or every nameserver of the tier if none did
+func (r *Resolver) healthy(nameservers []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.health) == 0 {
+		return nameservers
+	}
+
+	healthy := make([]string, 0, len(nameservers))
+	for _, nameserver := range nameservers {
+		if health, ok := r.health[nameserver]; !ok || health.Healthy {
+			healthy = append(healthy, nameserver)
+		}
+	}
+	if len(healthy) == 0 {
+		return nameservers
+	}
+
+	return healthy
+}
+
+// ProbeReady probes the nameservers with a query for domain every interval
+// until one of them passes, which makes the resolver ready when health checks
+// are disabled
+func (r *Resolver) ProbeReady(interval time.Duration, domain string) {
+	for {
+		for _, nameserver := range r.Nameservers() {
+			if r.probe(nameserver, domain) == nil {
+				atomic.StoreInt32(&r.ready, 1)
+				return
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Ready returns whether or not a nameserver passed a probe
+func (r *Resolver) Ready() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// CheckHealth probes every nameserver with a query for domain every interval,
+// nameservers that fail are skipped until they pass again
+func (r *Resolver) CheckHealth(interval time.Duration, domain string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, nameserver := range r.Nameservers() {
+			wg.Add(1)
+			go func(nameserver string) {
+				defer wg.Done()
+				r.setHealth(nameserver, r.probe(nameserver, domain))
+			}(nameserver)
+		}
+		wg.Wait()
+
+		<-ticker.C
+	}
+}
+
+// probe sends the query of a health check to a nameserver, it fails if the
+// nameserver can't be reached or answers with SERVFAIL
+func (r *Resolver) probe(nameserver, domain string) error {
+	upstream, err := ParseUpstream(nameserver)
+	if err != nil {
+		return err
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout())
+	defer cancel()
+
+	msg, err := r.exchange(ctx, r.client("udp"), upstream, req)
+	if err != nil {
+		return err
+	}
+	if msg.Rcode == dns.RcodeServerFailure {
+		return fmt.Errorf("answered with SERVFAIL")
+	}
+
+	return nil
+}
+
+// setHealth records the result of a health check, changes are logged
+func (r *Resolver) setHealth(nameserver string, err error) {
+	health := UpstreamHealth{Nameserver: nameserver, Healthy: err == nil, Checked: time.Now()}
+	if err != nil {
+		health.Error = err.Error()
+	} else {
+		atomic.StoreInt32(&r.ready, 1)
+	}
+
+	r.mu.Lock()
+	previous, checked := r.health[nameserver]
+	r.health[nameserver] = health
+	r.mu.Unlock()
+
+	switch {
+	case !health.Healthy && (!checked || previous.Healthy):
+		log.Printf("nameserver %s failed its health check and is skipped: %s\n", nameserver, err)
+	case health.Healthy && checked && !previous.Healthy:
+		log.Printf("nameserver %s passed its health check again\n", nameserver)
+	}
+}
+
+// Health returns the results of the last health checks of the nameservers,
+// nameservers that weren't checked yet are healthy
+func (r *Resolver) Health() []UpstreamHealth {
+	nameservers := r.Nameservers()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	health := make([]UpstreamHealth, 0, len(nameservers))
+	for _, nameserver := range nameservers {
+		h, ok := r.health[nameserver]
+		if !ok {
+			h = UpstreamHealth{Nameserver: nameserver, Healthy: true}
+		}
+		health = append(health, h)
+	}
+
+	return health
+}
+
+// markDown records that a nameserver couldn't be reached
+func (r *Resolver) markDown(nameserver string) {
+	r.mu.Lock()
+	r.down[nameserver] = time.Now().Add(upstreamBackoff)
+	r.mu.Unlock()
+}
+
+// markUp records that a nameserver answered
+func (r *Resolver) markUp(nameserver string) {
+	r.mu.Lock()
+	delete(r.down, nameserver)
+	r.mu.Unlock()
+}
+
+// race sends the query to all nameservers concurrently and returns the first
+// usable answer, nil if there is none, the queries still in flight are
+// cancelled by the caller
+func (r *Resolver) race(ctx context.Context, c *dns.Client, Net string, req *dns.Msg, ev Event, nameservers []string) *dns.Msg {
+	// buffered so that the losing queries never block after we return
+	res := make(chan *dns.Msg, len(nameservers))
+	for _, nameserver := range nameservers {
+		go func(nameserver string) {
+			res <- r.query(ctx, c, nameserver, Net, req, ev)
+		}(nameserver)
+	}
+
+	for range nameservers {
+		if msg := <-res; msg != nil {
+			msg.Id = req.Id
+			return msg
+		}
+	}
+
+	return nil
+}
+
+// query asks a single nameserver, it returns nil if the nameserver could not
+// be reached or its answer should be left to the other nameservers
+func (r *Resolver) query(ctx context.Context, c *dns.Client, nameserver string, Net string, req *dns.Msg, ev Event) *dns.Msg {
+	qname := req.Question[0].Name
+	ev.Upstream = nameserver
+
+	upstream, err := ParseUpstream(nameserver)
+	if err != nil {
+		ev.Action = "upstream_skipped"
+		LogEvent(0, ev.WithError(err), "%s skipping nameserver: %s", qname, err)
+		return nil
+	}
+
+	start := time.Now()
+	msg, err := r.exchange(ctx, c, upstream, req)
+	for retry := 0; err != nil && ctx.Err() == nil && retry < Config().UpstreamRetries; retry++ {
+		backoff := r.retryBackoff(retry)
+		ev.Action = "upstream_retry"
+		LogEvent(1, ev.WithError(err), "%s retrying %s in %s: %s", qname, nameserver, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		start = time.Now()
+		msg, err = r.exchange(ctx, c, upstream, req)
+	}
+	if err != nil {
+		// a cancelled query lost a race or was no longer needed, a query that
+		// ran into the timeout of the lookup did fail
+		if ctx.Err() != context.Canceled {
+			r.markDown(nameserver)
+			r.record(nameserver, 0, err)
+			upstreamErrorsTotal.WithLabelValues(nameserver).Inc()
+			ev.Action = "upstream_error"
+			LogEvent(0, ev.WithError(err), "%s socket error on %s: %s", qname, nameserver, err)
+		}
+		return nil
+	}
+	latency := time.Since(start)
+	r.markUp(nameserver)
+	r.record(nameserver, latency, nil)
+	upstreamDuration.WithLabelValues(nameserver).Observe(latency.Seconds())
+	ev.Latency = float64(latency) / float64(time.Millisecond)
+
+	if msg != nil && msg.Rcode != dns.RcodeSuccess {
+		ev.Action = "upstream_failure"
+		LogEvent(1, ev, "%s failed to get an valid answer on %s", qname, nameserver)
+		if tryNext(msg.Rcode) {
+			return nil
+		}
+	} else {
+		ev.Action = "resolved"
+		LogEvent(1, ev, "%s resolv on %s (%s)\n", UnFqdn(qname), nameserver, Net)
+	}
+
+	return msg
+}
+
+// tryNext returns whether or not an answer with rcode is discarded, so that
+// the query is left to the other nameservers
+func tryNext(rcode int) bool {
+	cfg := Config()
+	switch {
+	case cfg.StrictUpstream:
+		return false
+	case rcode == dns.RcodeServerFailure:
+		return true
+	case rcode == dns.RcodeRefused:
+		return cfg.FallthroughRefused
+	}
+	return false
+}
+
+// exchange sends a query to a single upstream, queries over tcp and tls are
+// served from a pool of reusable connections, queries over quic from a single
+// connection per upstream. Queries to encrypted upstreams are padded when
+// ednspadding is set and the padding is removed from their answers.
+func (r *Resolver) exchange(ctx context.Context, c *dns.Client, upstream *Upstream, req *dns.Msg) (*dns.Msg, error) {
+	if upstream.Net == "" && c.Net == "tcp" {
+		tcp := *upstream
+		tcp.Net = "tcp"
+		upstream = &tcp
+	}
+
+	if !Config().EDNSPadding || !upstream.Encrypted() {
+		return r.send(ctx, c, upstream, req)
+	}
+
+	clientEdns := req.IsEdns0() != nil
+	msg, err := r.send(ctx, c, upstream, padQuery(req))
+	if msg != nil {
+		stripPadding(msg)
+		if !clientEdns {
+			stripEdns(msg)
+		}
+	}
+	return msg, err
+}
+
+// send sends a query to a single upstream over its transport
+func (r *Resolver) send(ctx context.Context, c *dns.Client, upstream *Upstream, req *dns.Msg) (*dns.Msg, error) {
+	switch upstream.Net {
+	case "":
+		resp, _, err := c.ExchangeContext(ctx, req, upstream.Addr)
+		return resp, err
+	case "https":
+		d, err := r.dohClient(upstream)
+		if err != nil {
+			return nil, err
+		}
+		return d.Exchange(ctx, req)
+	case "quic":
+		return r.doqClient(upstream).Exchange(ctx, req)
+	}
+
+	return r.pool(upstream).Exchange(ctx, req)
+}
+
+// client returns a client for queries to the nameservers over Net
+func (r *Resolver) client(Net string) *dns.Client {
+	return &dns.Client{
+		Net:          Net,
+		Timeout:      r.UpstreamTimeout(),
+		ReadTimeout:  r.Timeout(),
+		WriteTimeout: r.Timeout(),
+	}
+}
+
+// pool returns the connection pool for an upstream, creating it on first use
+func (r *Resolver) pool(upstream *Upstream) *connPool {
+	cfg := Config()
+	key := upstream.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.pools[key]
+	if !ok {
+		c := r.client(upstream.Net)
+		if upstream.Net == "tcp-tls" {
+			c.TLSConfig = upstream.TLSConfig()
+		}
+		maxIdle := time.Duration(cfg.PoolMaxIdle) * time.Second
+		maxLifetime := time.Duration(cfg.PoolMaxLifetime) * time.Second
+		p = newConnPool(c, upstream.Addr, maxIdle, maxLifetime)
+		r.pools[key] = p
+	}
+
+	return p
+}
+
+// dohClient returns the client for a DNS-over-HTTPS upstream, creating it on
+// first use
+func (r *Resolver) dohClient(upstream *Upstream) (*dohClient, error) {
+	key := upstream.String() + " " + upstream.Proxy
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.doh[key]
+	if !ok {
+		timeout := r.UpstreamTimeout()
+		if timeout == 0 {
+			timeout = r.Timeout()
+		}
+
+		var err error
+		if d, err = newDoHClient(upstream, timeout, time.Duration(Config().PoolMaxIdle)*time.Second); err != nil {
+			return nil, err
+		}
+		r.doh[key] = d
+	}
+
+	return d, nil
+}
+
+// doqClient returns the client for a DNS-over-QUIC upstream, creating it on
+// first use
+func (r *Resolver) doqClient(upstream *Upstream) *doqClient {
+	key := upstream.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.doq[key]
+	if !ok {
+		d = newDoQClient(upstream, time.Duration(Config().PoolMaxIdle)*time.Second)
+		r.doq[key] = d
+	}
+
+	return d
+}
+
+// Nameservers return the array of nameservers, followed by the fallback
+// nameservers
 func (r *Resolver) Nameservers() (ns []string) {
-	return Config.Nameservers
+	for _, tier := range Config().tiers() {
+		ns = append(ns, tier...)
+	}
+	return ns
 }
 
 // Timeout returns the resolver timeout
 func (r *Resolver) Timeout() time.Duration {
-	return time.Duration(Config.Timeout) * time.Second
+	return time.Duration(Config().Timeout) * time.Second
+}
+
+// UpstreamTimeout returns how long a single nameserver has to answer, zero
+// leaves it to the resolver timeout
+func (r *Resolver) UpstreamTimeout() time.Duration {
+	return time.Duration(Config().UpstreamTimeout) * time.Millisecond
+}
+
+// retryBackoff returns how long to wait before the retry of a query that
+// failed, the backoff doubles with every retry
+func (r *Resolver) retryBackoff(retry int) time.Duration {
+	return time.Duration(Config().UpstreamRetryBackoff) * time.Millisecond << uint(retry)
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream returns the address of a nameserver on localhost that answers
+// the queries over network, udp or tcp, with h until the test ends
+func startUpstream(tb testing.TB, network string, h dns.HandlerFunc) string {
+	server := &dns.Server{Handler: h}
+	var addr string
+	if network == "tcp" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		server.Listener, addr = listener, listener.Addr().String()
+	} else {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		server.PacketConn, addr = conn, conn.LocalAddr().String()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	server.NotifyStartedFunc = wg.Done
+	go server.ActivateAndServe()
+	wg.Wait()
+	tb.Cleanup(func() { server.Shutdown() })
+
+	return addr
+}
+
+// startSilentUpstream returns the address of a udp nameserver that never answers
+func startSilentUpstream(t *testing.T) string {
+	return startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {})
+}
+
+func TestResolverUpstreamTimeout(t *testing.T) {
+	withConfig(t, &config{
+		Nameservers:     []string{startSilentUpstream(t)},
+		Interval:        200,
+		Timeout:         5,
+		UpstreamTimeout: 100,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	start := time.Now()
+	if _, err := NewResolver().Lookup("udp", req, nil); err == nil {
+		t.Fatal("expected the lookup on a silent nameserver to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup took %s, expected it to give up after the upstream timeout", elapsed)
+	}
+}
+
+// startRcodeUpstream returns the address of a udp nameserver that answers
+// every query with rcode
+func startRcodeUpstream(t *testing.T, rcode int) string {
+	return startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		w.WriteMsg(m)
+	})
+}
+
+func TestResolverFallthrough(t *testing.T) {
+	servfail := startRcodeUpstream(t, dns.RcodeServerFailure)
+	refused := startRcodeUpstream(t, dns.RcodeRefused)
+	ok := startRcodeUpstream(t, dns.RcodeSuccess)
+
+	tests := []struct {
+		name     string
+		c        *config
+		expected int
+	}{
+		{"servfail", &config{Nameservers: []string{servfail, ok}}, dns.RcodeSuccess},
+		{"refused", &config{Nameservers: []string{refused, ok}}, dns.RcodeRefused},
+		{"fallthrough refused", &config{Nameservers: []string{refused, ok}, FallthroughRefused: true}, dns.RcodeSuccess},
+		{"strict", &config{Nameservers: []string{servfail, ok}, StrictUpstream: true}, dns.RcodeServerFailure},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	for _, test := range tests {
+		test.c.Interval, test.c.Timeout = 10, 1
+		withConfig(t, test.c)
+
+		msg, err := NewResolver().Lookup("udp", req, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if msg.Rcode != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, dns.RcodeToString[test.expected], dns.RcodeToString[msg.Rcode])
+		}
+	}
+
+	withConfig(t, &config{Nameservers: []string{servfail, servfail}, Interval: 10, Timeout: 1})
+	if _, err := NewResolver().Lookup("udp", req, nil); err == nil {
+		t.Error("expected an error when every nameserver answers with SERVFAIL")
+	}
+}
+
+func TestResolverFlags(t *testing.T) {
+	// the nameserver echoes the flags of the query back in its answer
+	upstream := startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.CheckingDisabled = req.CheckingDisabled
+		if opt := req.IsEdns0(); opt != nil {
+			m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		}
+		w.WriteMsg(m)
+	})
+
+	withConfig(t, &config{Nameservers: []string{upstream}, Interval: 10, Timeout: 1})
+
+	for _, test := range []struct{ rd, cd, do bool }{{true, false, false}, {false, false, false}, {true, true, false}, {true, false, true}, {false, true, true}} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		req.RecursionDesired, req.CheckingDisabled = test.rd, test.cd
+		if test.do {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+
+		msg, err := NewResolver().Lookup("udp", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opt := msg.IsEdns0()
+		if msg.RecursionDesired != test.rd || msg.CheckingDisabled != test.cd || (opt != nil && opt.Do()) != test.do {
+			t.Errorf("query with rd %v, cd %v and do %v got an answer with rd %v, cd %v and do %v", test.rd, test.cd, test.do, msg.RecursionDesired, msg.CheckingDisabled, opt != nil && opt.Do())
+		}
+	}
+}
+
+func TestResolverConditionalForwarders(t *testing.T) {
+	nameserver := startRcodeUpstream(t, dns.RcodeSuccess)
+	corp := startRcodeUpstream(t, dns.RcodeNameError)
+	lab := startRcodeUpstream(t, dns.RcodeRefused)
+
+	c := &config{Nameservers: []string{nameserver}, Interval: 10, Timeout: 1, ConditionalForwarders: map[string]stringList{
+		"corp.local":      {corp},
+		"Lab.Corp.Local.": {lab},
+	}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"www.example.com.", dns.RcodeSuccess},
+		{"corp.local.", dns.RcodeNameError},
+		{"host.CORP.local.", dns.RcodeNameError},
+		{"host.lab.corp.local.", dns.RcodeRefused},
+		{"notcorp.local.", dns.RcodeSuccess},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+
+		msg, err := NewResolver().Lookup("udp", req, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if msg.Rcode != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, dns.RcodeToString[test.expected], dns.RcodeToString[msg.Rcode])
+		}
+	}
+
+	c = &config{ConditionalForwarders: map[string]stringList{"corp.local": {"ftp://10.0.0.1"}}}
+	if err := c.parse(); err == nil {
+		t.Error("expected an error for an invalid conditional forwarder")
+	}
+}
+
+func TestResolverOrder(t *testing.T) {
+	withConfig(t, &config{Nameservers: []string{"a", "b", "c"}, ResolverMode: "roundrobin"})
+	r := NewResolver()
+
+	for _, expected := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		if order := r.order(Config().Nameservers); !reflect.DeepEqual(order, expected) {
+			t.Errorf("expected %v, got %v", expected, order)
+		}
+	}
+
+	r.markDown("b")
+	if order := r.order(Config().Nameservers); !reflect.DeepEqual(order, []string{"c", "a", "b"}) {
+		t.Errorf("expected the nameserver that is down to be asked last, got %v", order)
+	}
+
+	r.markUp("b")
+	if order := r.order(Config().Nameservers); !reflect.DeepEqual(order, []string{"c", "a", "b"}) {
+		t.Errorf("expected the rotation to continue, got %v", order)
+	}
+}
+
+func TestResolverHealth(t *testing.T) {
+	silent := startSilentUpstream(t)
+	ok := startRcodeUpstream(t, dns.RcodeNameError)
+	withConfig(t, &config{Nameservers: []string{silent, ok}, Timeout: 1, UpstreamTimeout: 100})
+	r := NewResolver()
+
+	for _, nameserver := range r.Nameservers() {
+		r.setHealth(nameserver, r.probe(nameserver, testDomain))
+	}
+
+	if order := r.order(Config().Nameservers); !reflect.DeepEqual(order, []string{ok}) {
+		t.Errorf("expected only the healthy nameserver to be asked, got %v", order)
+	}
+
+	health := r.Health()
+	if health[0].Healthy || health[0].Error == "" || !health[1].Healthy {
+		t.Errorf("unexpected health %+v", health)
+	}
+
+	// every nameserver is asked rather than none
+	r.setHealth(ok, fmt.Errorf("down"))
+	if order := r.order(Config().Nameservers); len(order) != 2 {
+		t.Errorf("expected every nameserver to be asked when none are healthy, got %v", order)
+	}
+
+	r.setHealth(silent, nil)
+	if order := r.order(Config().Nameservers); !reflect.DeepEqual(order, []string{silent}) {
+		t.Errorf("expected the recovered nameserver to be asked, got %v", order)
+	}
+}
+
+func TestResolverReady(t *testing.T) {
+	failing := startRcodeUpstream(t, dns.RcodeServerFailure)
+	withConfig(t, &config{Nameservers: []string{failing}, Timeout: 1})
+
+	r := NewResolver()
+	r.setHealth(failing, r.probe(failing, testDomain))
+	if r.Ready() {
+		t.Error("resolver is ready without a nameserver that passed a probe")
+	}
+
+	withConfig(t, &config{Nameservers: []string{failing, startRcodeUpstream(t, dns.RcodeSuccess)}, Timeout: 1})
+
+	done := make(chan struct{})
+	go func() {
+		r.ProbeReady(10*time.Millisecond, testDomain)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProbeReady didn't return once a nameserver answered")
+	}
+	if !r.Ready() {
+		t.Error("resolver isn't ready after a nameserver passed a probe")
+	}
+}
+
+// startFlakyUpstream returns the address of a udp nameserver that ignores the
+// first drops queries and answers the ones after
+func startFlakyUpstream(t *testing.T, drops int32) string {
+	var queries int32
+	return startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		if atomic.AddInt32(&queries, 1) <= drops {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+}
+
+func TestResolverRetries(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	withConfig(t, &config{Nameservers: []string{startFlakyUpstream(t, 1)}, Interval: 10, Timeout: 1, UpstreamTimeout: 100})
+	if _, err := NewResolver().Lookup("udp", req, nil); err == nil {
+		t.Error("expected the lookup to fail without retries")
+	}
+
+	withConfig(t, &config{Nameservers: []string{startFlakyUpstream(t, 2)}, Interval: 10, Timeout: 1, UpstreamTimeout: 100, UpstreamRetries: 2, UpstreamRetryBackoff: 10})
+	if _, err := NewResolver().Lookup("udp", req, nil); err != nil {
+		t.Errorf("expected the retries to get an answer, got %s", err)
+	}
+
+	// the retries stop at the timeout of the lookup
+	withConfig(t, &config{Nameservers: []string{startSilentUpstream(t)}, Interval: 10, Timeout: 1, UpstreamTimeout: 100, UpstreamRetries: 100, UpstreamRetryBackoff: 10})
+	start := time.Now()
+	if _, err := NewResolver().Lookup("udp", req, nil); err == nil {
+		t.Error("expected the lookup on a silent nameserver to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("lookup took %s, expected the retries to stop at the timeout", elapsed)
+	}
+}
+
+func TestResolverTiers(t *testing.T) {
+	servfail := startRcodeUpstream(t, dns.RcodeServerFailure)
+	ok := startRcodeUpstream(t, dns.RcodeSuccess)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	for _, mode := range []string{"sequential", "race", "roundrobin"} {
+		withConfig(t, &config{Nameservers: []string{servfail}, FallbackNameservers: [][]string{{}, {ok}}, ResolverMode: mode, Interval: 10, Timeout: 1})
+		resp, err := NewResolver().Lookup("udp", req, nil)
+		if err != nil || resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected the fallback nameserver to answer, got %v %v", mode, resp, err)
+		}
+	}
+
+	// the fallback nameservers aren't asked while the nameservers answer
+	silent := startSilentUpstream(t)
+	withConfig(t, &config{Nameservers: []string{ok}, FallbackNameservers: [][]string{{silent}}, Interval: 10, Timeout: 1, UpstreamTimeout: 100})
+	r := NewResolver()
+	if _, err := r.Lookup("udp", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, stats := range r.Stats() {
+		if stats.Nameserver == silent && stats.Queries+stats.Errors > 0 {
+			t.Errorf("expected the fallback nameserver not to be asked, got %+v", stats)
+		}
+	}
+}
+
+// startDelayedUpstream returns the address of a udp nameserver that answers
+// with ip after delay
+func startDelayedUpstream(t *testing.T, delay time.Duration, ip string) string {
+	return startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}}
+		w.WriteMsg(m)
+	})
+}
+
+func TestResolverRace(t *testing.T) {
+	// the SERVFAIL arrives first and the slow nameserver last
+	nameservers := []string{
+		startRcodeUpstream(t, dns.RcodeServerFailure),
+		startDelayedUpstream(t, 50*time.Millisecond, "192.0.2.1"),
+		startDelayedUpstream(t, 500*time.Millisecond, "192.0.2.2"),
+	}
+	withConfig(t, &config{Nameservers: nameservers, ResolverMode: "race", Interval: 10, Timeout: 5})
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	start := time.Now()
+	resp, err := NewResolver().Lookup("udp", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("expected the first usable answer to win, got %v", resp)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("lookup took %s, expected it not to wait for the slow nameserver", elapsed)
+	}
+
+	// every nameserver failing fails the lookup
+	withConfig(t, &config{Nameservers: nameservers[:1], ResolverMode: "race", Interval: 10, Timeout: 1})
+	if resp, err := NewResolver().Lookup("udp", req, nil); err == nil && resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected the lookup to fail when every nameserver failed, got %v", resp)
+	}
+}
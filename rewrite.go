@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rewrite is a rule that replaces the addresses in the answers of the
+// nameservers, it applies to the queries for domain, or its subdomains when
+// the domain starts with *., and to the addresses in network. Either may be
+// left empty to match every domain or every address, a matching A or AAAA
+// record is replaced with the addresses of its family in to.
+type rewrite struct {
+	Domain  string
+	Network string
+	To      []string
+
+	network  *net.IPNet
+	to, toV6 []net.IP
+}
+
+// parse checks a rewrite rule and parses its network and its addresses
+func (r *rewrite) parse() error {
+	if r.Domain == "" && r.Network == "" {
+		return fmt.Errorf("a domain or a network is required")
+	}
+	r.Domain = normalizeDomain(UnFqdn(r.Domain))
+
+	r.network = nil
+	if r.Network != "" {
+		network, err := parseNetwork(r.Network)
+		if err != nil {
+			return err
+		}
+		r.network = network
+	}
+
+	r.to, r.toV6 = nil, nil
+	for _, entry := range r.To {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("%s is not an ip address", entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			r.to = append(r.to, ip4)
+		} else {
+			r.toV6 = append(r.toV6, ip)
+		}
+	}
+	if len(r.to) == 0 && len(r.toV6) == 0 {
+		return fmt.Errorf("an address to rewrite to is required")
+	}
+
+	return nil
+}
+
+// matchDomain returns whether or not the rule applies to the queries for name
+func (r *rewrite) matchDomain(name string) bool {
+	switch {
+	case r.Domain == "":
+		return true
+	case strings.HasPrefix(r.Domain, "*."):
+		return strings.HasSuffix(name, r.Domain[1:])
+	}
+	return name == r.Domain
+}
+
+// rewriteAnswer applies the first matching rewrite rule to every address in
+// the answer to a query for qname, the answer is copied if a rule applies
+func rewriteAnswer(qname string, msg *dns.Msg) (*dns.Msg, bool) {
+	rules := Config().Rewrites
+	if len(rules) == 0 || msg == nil {
+		return msg, false
+	}
+
+	name := normalizeDomain(UnFqdn(qname))
+	var matching []rewrite
+	for _, r := range rules {
+		if r.matchDomain(name) {
+			matching = append(matching, r)
+		}
+	}
+	if len(matching) == 0 {
+		return msg, false
+	}
+
+	m := msg.Copy()
+	rewritten := false
+	answer := make([]dns.RR, 0, len(m.Answer))
+	added := make(map[string]bool)
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			answer = append(answer, rr)
+			continue
+		}
+
+		to, ok := rewriteIP(matching, ip, rr.Header().Rrtype == dns.TypeAAAA)
+		if !ok {
+			answer = append(answer, rr)
+			continue
+		}
+
+		// the records of an owner are replaced by the addresses once
+		rewritten = true
+		for _, ip := range to {
+			key := rr.Header().Name + " " + ip.String()
+			if added[key] {
+				continue
+			}
+			added[key] = true
+
+			hdr := *rr.Header()
+			if hdr.Rrtype == dns.TypeAAAA {
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			} else {
+				answer = append(answer, &dns.A{Hdr: hdr, A: ip})
+			}
+		}
+	}
+	if !rewritten {
+		return msg, false
+	}
+
+	m.Answer = answer
+	return m, true
+}
+
+// rewriteIP returns the addresses the first of the rules that matches ip
+// rewrites it to, rules without addresses of its family are skipped
+func rewriteIP(rules []rewrite, ip net.IP, v6 bool) ([]net.IP, bool) {
+	for _, r := range rules {
+		to := r.to
+		if v6 {
+			to = r.toV6
+		}
+		if len(to) == 0 || (r.network != nil && !r.network.Contains(ip)) {
+			continue
+		}
+		return to, true
+	}
+	return nil, false
+}
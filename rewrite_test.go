@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+func TestRewriteAnswer(t *testing.T) {
+	data := `
+[[rewrites]]
+domain = "*.portal.example.com"
+to = ["192.168.1.2", "fd00::2"]
+
+[[rewrites]]
+network = "10.0.0.0/8"
+to = ["192.168.1.10"]
+
+[[rewrites]]
+domain = "lan.example.com"
+network = "203.0.113.0/24"
+to = ["192.168.1.20", "192.168.1.21"]
+`
+	var c config
+	if _, err := toml.Decode(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, &c)
+
+	tests := []struct {
+		name     string
+		answer   []dns.RR
+		expected []string
+	}{
+		{"www.portal.example.com.", []dns.RR{testA("www.portal.example.com.", "198.51.100.1")}, []string{"192.168.1.2"}},
+		{"portal.example.com.", []dns.RR{testA("portal.example.com.", "198.51.100.1")}, []string{"198.51.100.1"}},
+		{"intranet.example.com.", []dns.RR{testA("intranet.example.com.", "10.1.2.3"), testA("intranet.example.com.", "10.1.2.4")}, []string{"192.168.1.10"}},
+		{"www.example.com.", []dns.RR{testA("www.example.com.", "198.51.100.1"), testA("www.example.com.", "10.1.2.3")}, []string{"198.51.100.1", "192.168.1.10"}},
+		{"LAN.example.com.", []dns.RR{testA("lan.example.com.", "203.0.113.5")}, []string{"192.168.1.20", "192.168.1.21"}},
+		{"other.example.com.", []dns.RR{testA("other.example.com.", "203.0.113.5")}, []string{"203.0.113.5"}},
+	}
+
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, dns.TypeA)
+		msg.Answer = test.answer
+
+		rewritten, _ := rewriteAnswer(test.name, msg)
+		var got []string
+		for _, rr := range rewritten.Answer {
+			got = append(got, rr.(*dns.A).A.String())
+		}
+		if len(got) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+				break
+			}
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("intranet.example.com.", dns.TypeA)
+	msg.Answer = []dns.RR{testA("intranet.example.com.", "10.1.2.3")}
+	if _, ok := rewriteAnswer("intranet.example.com.", msg); !ok || msg.Answer[0].(*dns.A).A.String() != "10.1.2.3" {
+		t.Error("expected the answer to be rewritten on a copy")
+	}
+}
+
+func TestRewriteInvalid(t *testing.T) {
+	for _, r := range []rewrite{
+		{To: []string{"192.168.1.2"}},
+		{Domain: "example.com"},
+		{Domain: "example.com", To: []string{"not-an-address"}},
+		{Network: "10.0.0.0/33", To: []string{"192.168.1.2"}},
+	} {
+		c := &config{Rewrites: []rewrite{r}}
+		if err := c.parse(); err == nil {
+			t.Errorf("expected an error for rewrite %+v", r)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated once it would grow past maxSize,
+// the rotated files are kept as path.1 to path.maxBackups from the newest to
+// the oldest, gzipped as path.1.gz and so on when compress is set
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	compress   bool
+	file       *os.File
+	size       int64
+	mu         sync.Mutex
+
+	// compressing is done once the last rotated file was compressed, which
+	// happens outside of the lock, compressErr is the error it failed with
+	compressing sync.WaitGroup
+	compressErr error
+}
+
+// newRotatingFile rotates file, which must be opened for appending
+func newRotatingFile(file *os.File, maxSize int64, maxBackups int, compress bool) (*rotatingFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rotatingFile{
+		path:       file.Name(),
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		compress:   compress,
+		file:       file,
+		size:       info.Size(),
+	}, nil
+}
+
+// Write writes to the log file, rotating it first if the write would make it
+// larger than maxSize, a write that is larger than maxSize on its own still
+// goes to a single file. If the rotation fails the write goes to the current
+// log file and the error is returned with it.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			rotateErr = fmt.Errorf("error rotating log file: %s", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Close closes the log file once the last rotated file was compressed
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	err := f.file.Close()
+	f.mu.Unlock()
+
+	f.compressing.Wait()
+	return err
+}
+
+// rotate moves every rotated file up by one, dropping the oldest, moves the
+// log file to path.1 and opens a new log file, which replaces the current one
+// only once it's open. path.1 is compressed in the background. The caller
+// must hold the lock.
+func (f *rotatingFile) rotate() error {
+	// path.1 must not be moved while it's compressed
+	f.compressing.Wait()
+	compressErr := f.compressErr
+	f.compressErr = nil
+
+	f.remove(f.maxBackups)
+	for i := f.maxBackups - 1; i > 0; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			if _, err := os.Stat(f.backup(i) + ext); err == nil {
+				if err := os.Rename(f.backup(i)+ext, f.backup(i+1)+ext); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// the open log file keeps being written to until the new one is open
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.backup(1)); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		if f.maxBackups > 0 {
+			os.Rename(f.backup(1), f.path)
+		}
+		return err
+	}
+
+	old := f.file
+	f.file, f.size = file, 0
+	if err := old.Close(); err != nil {
+		return err
+	}
+
+	if f.maxBackups > 0 && f.compress {
+		f.compressing.Add(1)
+		go func(path string) {
+			defer f.compressing.Done()
+			f.compressErr = compressFile(path)
+		}(f.backup(1))
+	}
+
+	if compressErr != nil {
+		return fmt.Errorf("error compressing rotated log file: %s", compressErr)
+	}
+	return nil
+}
+
+// backup returns the path of the i-th rotated file without the .gz extension
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// remove removes the i-th rotated file
+func (f *rotatingFile) remove(i int) {
+	if i > 0 {
+		os.Remove(f.backup(i))
+		os.Remove(f.backup(i) + ".gz")
+	}
+}
+
+// compressFile replaces a file with a gzipped copy of it named path.gz
+func compressFile(path string) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(output)
+	if _, err := io.Copy(w, input); err != nil {
+		output.Close()
+		os.Remove(output.Name())
+		return err
+	}
+	if err := w.Close(); err != nil {
+		output.Close()
+		os.Remove(output.Name())
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(output.Name())
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestLog(t *testing.T, maxBackups int, compress bool) (*rotatingFile, string) {
+	path := filepath.Join(t.TempDir(), "grimd.log")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newRotatingFile(file, 10, maxBackups, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f, path
+}
+
+func readTestLog(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestRotatingFile(t *testing.T) {
+	f, path := openTestLog(t, 2, false)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for name, content := range expected {
+		if got := readTestLog(t, name); got != content {
+			t.Errorf("expected %s to hold %q, got %q", filepath.Base(name), content, got)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("more rotated files were kept than maxbackups")
+	}
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	f, path := openTestLog(t, 1, true)
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the rotated file is compressed in the background
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path + ".1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	r, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "first") {
+		t.Errorf("expected the rotated file to hold the first line, got %q", content)
+	}
+
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Error("the uncompressed rotated file was kept")
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	f, path := openTestLog(t, 1, false)
+
+	// a directory that isn't empty can't be replaced by the rotated file
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Write([]byte("second\n")); err == nil || n != len("second\n") {
+		t.Errorf("expected the write to go through with the rotation error, got %d, %v", n, err)
+	}
+	if got := readTestLog(t, path); got != "first\nsecond\n" {
+		t.Errorf("expected the log file to be kept when the rotation failed, got %q", got)
+	}
+
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("third\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestLog(t, path); got != "third\n" {
+		t.Errorf("expected the log file to be rotated once the rotation succeeds, got %q", got)
+	}
+	if got := readTestLog(t, path+".1"); got != "first\nsecond\n" {
+		t.Errorf("expected the rotated file to hold the earlier lines, got %q", got)
+	}
+}
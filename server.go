@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"time"
 
@@ -9,43 +11,95 @@ import (
 
 // Server type
 type Server struct {
-	host     string
+	udpHosts []string
+	tcpHosts []string
 	rTimeout time.Duration
 	wTimeout time.Duration
+	handler  *DNSHandler
+	servers  []*dns.Server
 }
 
-// Run starts the server
-func (s *Server) Run() {
-	Handler := NewHandler()
+// Run starts a udp listener on every udp address and a tcp listener on every
+// tcp address, all of them served by the same handler. It returns an error
+// naming the address that could not be bound once every listener has either
+// started or failed.
+func (s *Server) Run() error {
+	listeners := len(s.udpHosts) + len(s.tcpHosts)
+	if listeners == 0 {
+		return fmt.Errorf("no udp or tcp listener is configured")
+	}
 
 	tcpHandler := dns.NewServeMux()
-	tcpHandler.HandleFunc(".", Handler.DoTCP)
+	tcpHandler.HandleFunc(".", s.handler.DoTCP)
 
 	udpHandler := dns.NewServeMux()
-	udpHandler.HandleFunc(".", Handler.DoUDP)
-
-	tcpServer := &dns.Server{Addr: s.host,
-		Net:          "tcp",
-		Handler:      tcpHandler,
-		ReadTimeout:  s.rTimeout,
-		WriteTimeout: s.wTimeout}
-
-	udpServer := &dns.Server{Addr: s.host,
-		Net:          "udp",
-		Handler:      udpHandler,
-		UDPSize:      65535,
-		ReadTimeout:  s.rTimeout,
-		WriteTimeout: s.wTimeout}
-
-	go s.start(udpServer)
-	go s.start(tcpServer)
+	udpHandler.HandleFunc(".", s.handler.DoUDP)
+
+	started := make(chan error, listeners)
+	notify := func() { started <- nil }
+
+	for _, host := range s.udpHosts {
+		udpServer := &dns.Server{Addr: host,
+			Net:               "udp",
+			Handler:           udpHandler,
+			UDPSize:           65535,
+			ReadTimeout:       s.rTimeout,
+			WriteTimeout:      s.wTimeout,
+			NotifyStartedFunc: notify}
+
+		s.servers = append(s.servers, udpServer)
+		go s.start(udpServer, started)
+	}
+
+	for _, host := range s.tcpHosts {
+		tcpServer := &dns.Server{Addr: host,
+			Net:               "tcp",
+			Handler:           tcpHandler,
+			ReadTimeout:       s.rTimeout,
+			WriteTimeout:      s.wTimeout,
+			NotifyStartedFunc: notify}
+
+		s.servers = append(s.servers, tcpServer)
+		go s.start(tcpServer, started)
+	}
+
+	var err error
+	for i := 0; i < listeners; i++ {
+		if e := <-started; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Stop stops accepting new queries and waits for the queries in flight to be
+// answered before it closes the listeners, which the answers are sent on. It
+// gives up waiting once ctx is done.
+func (s *Server) Stop(ctx context.Context) error {
+	s.handler.Stop()
+	err := s.handler.Wait(ctx)
+
+	for _, ds := range s.servers {
+		if err := ds.ShutdownContext(ctx); err != nil {
+			log.Printf("Stop %s listener on %s failed: %s\n", ds.Net, ds.Addr, err.Error())
+		}
+	}
+
+	return err
 }
 
-func (s *Server) start(ds *dns.Server) {
-	log.Printf("Start %s listener on %s\n", ds.Net, s.host)
+func (s *Server) start(ds *dns.Server, started chan<- error) {
+	log.Printf("Start %s listener on %s\n", ds.Net, ds.Addr)
 
 	err := ds.ListenAndServe()
 	if err != nil {
-		log.Printf("Start %s listener on %s failed: %s\n", ds.Net, s.host, err.Error())
+		log.Printf("Start %s listener on %s failed: %s\n", ds.Net, ds.Addr, err.Error())
+
+		// only a listener that never started is waited for
+		select {
+		case started <- fmt.Errorf("could not start %s listener on %s: %s", ds.Net, ds.Addr, err):
+		default:
+		}
 	}
 }
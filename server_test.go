@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startBlockingUpstream returns the address of a udp nameserver that signals
+// asked for every query and only answers once release is closed
+func startBlockingUpstream(t *testing.T) (addr string, asked <-chan struct{}, release chan<- struct{}) {
+	queries, done := make(chan struct{}, 10), make(chan struct{})
+	addr = startUpstream(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		queries <- struct{}{}
+		<-done
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{testRR(req.Question[0].Name, 300)}
+		w.WriteMsg(m)
+	})
+
+	return addr, queries, done
+}
+
+// waitAsked fails the test unless the upstream is asked within a second
+func waitAsked(t *testing.T, asked <-chan struct{}) {
+	select {
+	case <-asked:
+	case <-time.After(time.Second):
+		t.Fatal("the upstream was never asked")
+	}
+}
+
+func TestServerStopDrains(t *testing.T) {
+	upstream, asked, release := startBlockingUpstream(t)
+	withParsedConfig(t, &config{Nameservers: []string{upstream}, Timeout: 5, Interval: 200, Expire: 600, Maxcount: 10})
+
+	server := &Server{udpHosts: []string{"127.0.0.1:0"}, rTimeout: time.Second, wTimeout: time.Second, handler: NewHandler()}
+	if err := server.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	answered := make(chan *dns.Msg, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		m, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(req, server.servers[0].PacketConn.LocalAddr().String())
+		if err != nil {
+			t.Error(err)
+		}
+		answered <- m
+	}()
+	waitAsked(t, asked)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- server.Stop(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("expected Stop to wait for the query in flight, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Errorf("expected the query in flight to be drained, got %s", err)
+	}
+	if m := <-answered; m == nil || len(m.Answer) != 1 {
+		t.Errorf("expected the query in flight to be answered, got %v", m)
+	}
+}
+
+func TestHandlerWaitTimeout(t *testing.T) {
+	upstream, asked, release := startBlockingUpstream(t)
+	withParsedConfig(t, &config{Nameservers: []string{upstream}, Timeout: 5, Interval: 200, Expire: 600, Maxcount: 10})
+	h := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	h.DoUDP(&testWriter{}, req)
+	waitAsked(t, asked)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected Wait to give up once ctx expired, got %v", err)
+	}
+
+	close(release)
+	if err := h.Wait(context.Background()); err != nil {
+		t.Errorf("expected Wait to return once the query was answered, got %s", err)
+	}
+}
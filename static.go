@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// staticAnswer returns the static records that answer a question, ok is false
+// if the name has no static records. CNAMEs are followed through the static
+// records, when a chain leads to a name without static records that name is
+// returned as target to be resolved.
+func staticAnswer(q dns.Question) (answer []dns.RR, target string, ok bool) {
+	name := strings.ToLower(q.Name)
+
+	if _, ok := staticRecords(name); !ok || q.Qclass != dns.ClassINET {
+		return nil, "", false
+	}
+
+	// a chain visits every name at most once unless it loops, only the
+	// static records in the config have CNAMEs
+	for i := 0; i <= len(Config().staticRecords); i++ {
+		rrs, ok := staticRecords(name)
+		if !ok {
+			return answer, name, true
+		}
+
+		found := false
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				answer = append(answer, dns.Copy(rr))
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+
+		if found || cname == nil {
+			break
+		}
+
+		answer = append(answer, dns.Copy(cname))
+		name = strings.ToLower(cname.Target)
+	}
+
+	return answer, "", true
+}
+
+// staticRecords returns the records of a name from the static records in the
+// config, or else the addresses the hosts files point it at
+func staticRecords(name string) ([]dns.RR, bool) {
+	cfg := Config()
+
+	if rrs, ok := cfg.staticRecords[name]; ok {
+		return rrs, true
+	}
+
+	ips, ok := HostsCache.Get(UnFqdn(name))
+	if !ok {
+		return nil, false
+	}
+
+	rrs := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: cfg.staticTTL()}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	return rrs, true
+}
+
+// staticResponse builds the answer to a query for a name with static records,
+// it returns nil if the name has none
+func (h *DNSHandler) staticResponse(Net string, req *dns.Msg, remote net.IP) *dns.Msg {
+	answer, target, ok := staticAnswer(req.Question[0])
+	if !ok {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = answer
+
+	if target == "" {
+		return withSOA(m)
+	}
+
+	// the end of the chain is answered by the nameservers
+	treq := new(dns.Msg)
+	treq.SetQuestion(target, req.Question[0].Qtype)
+	resp, err := h.resolver.Lookup(Net, treq, remote)
+	if err != nil {
+		q := treq.Question[0]
+		Q := Question{UnFqdn(q.Name), dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]}
+		LogEvent(0, NewEvent(remote, Q, "resolve_error").WithError(err), "resolve static target error %s\n", err)
+		return m
+	}
+
+	m.Authoritative = false
+	m.Rcode = resp.Rcode
+	m.Answer = append(m.Answer, resp.Answer...)
+
+	return m
+}
+
+// reverseResponse answers a reverse lookup of a nullroute address with
+// NXDOMAIN, it returns nil for the other addresses
+func (h *DNSHandler) reverseResponse(req *dns.Msg) *dns.Msg {
+	cfg := Config()
+
+	ip := reverseIP(req.Question[0].Name)
+	if ip == nil {
+		return nil
+	}
+
+	for _, nullroute := range append(cfg.nullroutes, cfg.nullroutesV6...) {
+		if nullroute.Equal(ip) {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			m.Authoritative = true
+			return withSOA(m)
+		}
+	}
+
+	return nil
+}
+
+// reverseIP returns the address of a complete in-addr.arpa or ip6.arpa name,
+// nil for any other name
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(parts) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			// the nibbles are in reverse order, the last one is the highest
+			pos := len(nibbles) - 1 - i
+			ip[pos/2] |= byte(n) << (4 * uint(1-pos%2))
+		}
+		return ip
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticAnswer(t *testing.T) {
+	c := &config{StaticTTL: 600, StaticRecords: map[string][]string{
+		"nas.home":   {"A 192.168.1.10", "A 192.168.1.11", "60 AAAA fd00::10", `TXT "backups"`},
+		"files.home": {"CNAME nas.home"},
+		"mail.home":  {"CNAME mail.example.com."},
+		"loop.home":  {"CNAME loop.home."},
+	}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		types  []uint16
+		target string
+	}{
+		{"nas.home.", dns.TypeA, []uint16{dns.TypeA, dns.TypeA}, ""},
+		{"NAS.home.", dns.TypeAAAA, []uint16{dns.TypeAAAA}, ""},
+		{"nas.home.", dns.TypeMX, nil, ""},
+		{"files.home.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeA}, ""},
+		{"mail.home.", dns.TypeA, []uint16{dns.TypeCNAME}, "mail.example.com."},
+		{"loop.home.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeCNAME, dns.TypeCNAME, dns.TypeCNAME, dns.TypeCNAME}, ""},
+	}
+
+	for _, test := range tests {
+		answer, target, ok := staticAnswer(dns.Question{Name: test.name, Qtype: test.qtype, Qclass: dns.ClassINET})
+		if !ok {
+			t.Errorf("%s has no static records", test.name)
+			continue
+		}
+		if target != test.target {
+			t.Errorf("%s: expected target %q, got %q", test.name, test.target, target)
+		}
+		if len(answer) != len(test.types) {
+			t.Errorf("%s %s: expected %d records, got %v", test.name, dns.TypeToString[test.qtype], len(test.types), answer)
+			continue
+		}
+		for i, rr := range answer {
+			if rr.Header().Rrtype != test.types[i] {
+				t.Errorf("%s: expected %s record, got %s", test.name, dns.TypeToString[test.types[i]], rr)
+			}
+		}
+	}
+
+	answer, _, _ := staticAnswer(dns.Question{Name: "nas.home.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	if ttl := answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("expected the ttl of the record, got %d", ttl)
+	}
+	answer, _, _ = staticAnswer(dns.Question{Name: "nas.home.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if ttl := answer[0].Header().Ttl; ttl != 600 {
+		t.Errorf("expected the static ttl, got %d", ttl)
+	}
+
+	if _, _, ok := staticAnswer(dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); ok {
+		t.Error("name without static records was answered")
+	}
+}
+
+func TestStaticRecordsInvalid(t *testing.T) {
+	for _, value := range []string{"A not-an-address", "CH A 192.168.1.10", ""} {
+		c := &config{StaticRecords: map[string][]string{"nas.home": {value}}}
+		if err := c.parse(); err == nil {
+			t.Errorf("expected an error for static record %q", value)
+		}
+	}
+}
+
+func TestStaticAnswerHosts(t *testing.T) {
+	c := &config{StaticRecords: map[string][]string{"files.home": {"CNAME nas.home."}}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	old := HostsCache.Backend
+	HostsCache.Replace(&MemoryHostsCache{Backend: map[string][]net.IP{"nas.home": {net.ParseIP("192.168.1.10"), net.ParseIP("fd00::10")}}})
+	t.Cleanup(func() { HostsCache.Replace(&MemoryHostsCache{Backend: old}) })
+
+	answer, _, ok := staticAnswer(dns.Question{Name: "nas.home.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	if !ok || len(answer) != 1 || answer[0].(*dns.AAAA).AAAA.String() != "fd00::10" {
+		t.Errorf("expected the address from the hosts file, got %v", answer)
+	}
+	if ttl := answer[0].Header().Ttl; ttl != 3600 {
+		t.Errorf("expected the default static ttl, got %d", ttl)
+	}
+
+	answer, target, _ := staticAnswer(dns.Question{Name: "files.home.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if target != "" || len(answer) != 2 || answer[1].(*dns.A).A.String() != "192.168.1.10" {
+		t.Errorf("expected the CNAME to be followed into the hosts file, got %v", answer)
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := map[string]string{
+		"10.1.168.192.in-addr.arpa.": "192.168.1.10",
+		"10.1.168.192.IN-ADDR.ARPA":  "192.168.1.10",
+		"0.0.0.0.in-addr.arpa.":      "0.0.0.0",
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": "fd00::10",
+		"1.168.192.in-addr.arpa.":   "",
+		"x.1.168.192.in-addr.arpa.": "",
+		"0.1.0.0.ip6.arpa.":         "",
+		"www.example.com.":          "",
+	}
+
+	for name, expected := range tests {
+		ip := reverseIP(name)
+		if expected == "" {
+			if ip != nil {
+				t.Errorf("%s: expected no address, got %s", name, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("%s: expected %s, got %s", name, expected, ip)
+		}
+	}
+}
+
+func TestStaticPTR(t *testing.T) {
+	c := &config{StaticPTR: true, StaticRecords: map[string][]string{
+		"nas.home":                  {"A 192.168.1.10", "AAAA fd00::10"},
+		"files.home":                {"A 192.168.1.10"},
+		"printer.home":              {"A 192.168.1.20"},
+		"20.1.168.192.in-addr.arpa": {"PTR office-printer.home."},
+	}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	tests := map[string][]string{
+		"10.1.168.192.in-addr.arpa.": {"files.home.", "nas.home."},
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": {"nas.home."},
+		"20.1.168.192.in-addr.arpa.": {"office-printer.home."},
+	}
+
+	for name, expected := range tests {
+		answer, _, ok := staticAnswer(dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		if !ok || len(answer) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, answer)
+			continue
+		}
+		for i, rr := range answer {
+			if ptr := rr.(*dns.PTR).Ptr; ptr != expected[i] {
+				t.Errorf("%s: expected %s, got %s", name, expected[i], ptr)
+			}
+		}
+	}
+
+	c = &config{StaticRecords: map[string][]string{"nas.home": {"A 192.168.1.10"}}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+	if _, _, ok := staticAnswer(dns.Question{Name: "10.1.168.192.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}); ok {
+		t.Error("reverse lookup was answered without staticptr")
+	}
+}
+
+func TestReverseResponse(t *testing.T) {
+	c := &config{Nullroute: stringList{"0.0.0.0", "192.168.1.5"}, Nullroutev6: stringList{"::"}}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	h := &DNSHandler{}
+	for name, nxdomain := range map[string]bool{
+		"0.0.0.0.in-addr.arpa.":     true,
+		"5.1.168.192.in-addr.arpa.": true,
+		"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": true,
+		"6.1.168.192.in-addr.arpa.": false,
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypePTR)
+
+		m := h.reverseResponse(req)
+		if !nxdomain {
+			if m != nil {
+				t.Errorf("%s: expected the nameservers to answer, got %v", name, m)
+			}
+			continue
+		}
+		if m == nil || m.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN, got %v", name, m)
+		}
+	}
+}
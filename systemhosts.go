@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// systemHostsPath is the hosts file of the operating system
+var systemHostsPath = defaultSystemHostsPath()
+
+// defaultSystemHostsPath returns where the operating system keeps its hosts
+// file, windows keeps it in the system directory
+func defaultSystemHostsPath() string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// loadSystemHosts reads the hosts file of the operating system into block and
+// hosts, it returns the number of domains with addresses and blocked domains
+func loadSystemHosts(path string, block *MemoryBlockCache, hosts *MemoryHostsCache) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return parseSystemHosts(file, block, hosts)
+}
+
+// parseSystemHosts parses a hosts file of the operating system, unlike hosts
+// files in the sources the loopback addresses are answered like every other
+// address, only the entries with a null address are blocked
+func parseSystemHosts(r io.Reader, block *MemoryBlockCache, hosts *MemoryHostsCache) (int, error) {
+	domains := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, domain := range fields[1:] {
+			if ip.IsUnspecified() {
+				block.Set(strings.ToLower(domain), true)
+			} else {
+				hosts.Add(domain, ip)
+			}
+			domains++
+		}
+	}
+
+	return domains, scanner.Err()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSystemHosts(t *testing.T) {
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	hosts := &MemoryHostsCache{Backend: make(map[string][]net.IP)}
+
+	file := "# system hosts\n127.0.0.1\tlocalhost\n::1 localhost ip6-localhost\n192.168.1.10 nas.home NAS # file server\n0.0.0.0 ads.example.com\n:: tracker.example.com\nnot-an-address example.org\n"
+	n, err := parseSystemHosts(strings.NewReader(file), block, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("expected 7 domains, got %d", n)
+	}
+
+	if ips, ok := hosts.Get("localhost"); !ok || len(ips) != 2 {
+		t.Errorf("expected localhost to answer with its loopback addresses, got %v", ips)
+	}
+	if ips, ok := hosts.Get("nas"); !ok || !ips[0].Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("expected the alias to answer, got %v", ips)
+	}
+
+	for _, domain := range []string{"ads.example.com", "tracker.example.com"} {
+		if !block.Exists(domain) {
+			t.Errorf("%s is not blocked", domain)
+		}
+	}
+	if block.Length() != 2 || block.Exists("localhost") {
+		t.Errorf("expected only the null entries to be blocked, got %v", block.Backend)
+	}
+}
+
+func TestUpdateBlockCacheSystemHosts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("192.168.1.10 nas.home\n0.0.0.0 ads.example.com\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "lists"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	old := systemHostsPath
+	systemHostsPath = path
+	t.Cleanup(func() { systemHostsPath = old })
+	inDir(t, dir)
+
+	for _, useSystemHosts := range []bool{true, false} {
+		withConfig(t, &config{UseSystemHosts: useSystemHosts})
+		if err := UpdateBlockCache(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := HostsCache.Get("nas.home"); ok != useSystemHosts {
+			t.Errorf("usesystemhosts %v: expected the address of nas.home to be %v", useSystemHosts, useSystemHosts)
+		}
+		if BlockCache.Exists("ads.example.com") != useSystemHosts {
+			t.Errorf("usesystemhosts %v: expected ads.example.com to be blocked %v", useSystemHosts, useSystemHosts)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// topCapacity is how many domains a TopDomains counts at most
+const topCapacity = 1000
+
+// topShards is how many shards the counters of a TopDomains are split into at
+// most, a domain is always counted by the same shard so that queries for
+// different domains rarely wait for each other. A shard counts at least
+// topShardMin domains, so small counters aren't split up.
+const (
+	topShards   = 16
+	topShardMin = 64
+)
+
+// TopEntry is a domain with how often it was counted, the count is at most
+// Error higher than the real count
+type TopEntry struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+	Error  uint64 `json:"error"`
+
+	index int
+}
+
+// TopDomains counts the most frequent domains in bounded memory with the
+// space-saving algorithm, once a shard counts its share of capacity domains a
+// new domain takes over the counter of the least frequent one of the shard
+type TopDomains struct {
+	shards []*topShard
+}
+
+// topShard counts the domains that hash to it
+type topShard struct {
+	capacity int
+	entries  map[string]*TopEntry
+	heap     topHeap
+	mu       sync.Mutex
+}
+
+// NewTopDomains returns a TopDomains that counts at most capacity domains
+func NewTopDomains(capacity int) *TopDomains {
+	n := capacity / topShardMin
+	if n > topShards {
+		n = topShards
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	t := &TopDomains{shards: make([]*topShard, n)}
+	for i := range t.shards {
+		// the first shards count the remainder
+		c := capacity / n
+		if i < capacity%n {
+			c++
+		}
+		t.shards[i] = &topShard{capacity: c, entries: make(map[string]*TopEntry)}
+	}
+	return t
+}
+
+// Add counts a domain, whatever its case or encoding
+func (t *TopDomains) Add(domain string) {
+	domain = normalizeDomain(domain)
+	t.shards[fnv1a(domain)%uint32(len(t.shards))].add(domain)
+}
+
+// add counts a normalized domain
+func (t *topShard) add(domain string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.entries[domain]; ok {
+		e.Count++
+		heap.Fix(&t.heap, e.index)
+		return
+	}
+
+	if len(t.heap) < t.capacity {
+		e := &TopEntry{Domain: domain, Count: 1}
+		t.entries[domain] = e
+		heap.Push(&t.heap, e)
+		return
+	}
+
+	// the new domain may have been counted by the evicted counter
+	e := t.heap[0]
+	delete(t.entries, e.Domain)
+	e.Domain, e.Error = domain, e.Count
+	e.Count++
+	t.entries[domain] = e
+	heap.Fix(&t.heap, 0)
+}
+
+// Top returns the n most frequent domains from the most frequent one
+func (t *TopDomains) Top(n int) []TopEntry {
+	top := make([]TopEntry, 0, topShardMin)
+	for _, s := range t.shards {
+		s.mu.Lock()
+		for _, e := range s.heap {
+			top = append(top, *e)
+		}
+		s.mu.Unlock()
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Domain < top[j].Domain
+	})
+	if n < len(top) {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// topHeap is a min-heap of the counted domains by their count
+type topHeap []*TopEntry
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *topHeap) Push(x interface{}) {
+	e := x.(*TopEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTopDomains(t *testing.T) {
+	top := NewTopDomains(3)
+	for domain, count := range map[string]int{"a.example.com": 5, "b.example.com": 3, "c.example.com": 1} {
+		for i := 0; i < count; i++ {
+			top.Add(domain)
+		}
+	}
+	top.Add("A.EXAMPLE.COM")
+
+	entries := top.Top(2)
+	if len(entries) != 2 || entries[0].Domain != "a.example.com" || entries[0].Count != 6 || entries[1].Domain != "b.example.com" {
+		t.Fatalf("expected a.example.com and b.example.com on top, got %+v", entries)
+	}
+
+	// a new domain takes over the counter of the least frequent one
+	top.Add("d.example.com")
+	entries = top.Top(10)
+	if len(entries) != 3 || entries[2].Domain != "d.example.com" || entries[2].Count != 2 || entries[2].Error != 1 {
+		t.Errorf("expected d.example.com to replace c.example.com, got %+v", entries)
+	}
+}
+
+func TestTopDomainsBounded(t *testing.T) {
+	top := NewTopDomains(10)
+	for i := 0; i < 1000; i++ {
+		top.Add("popular.example.com")
+		top.Add(fmt.Sprintf("%d.example.com", i))
+	}
+
+	entries := top.Top(1)
+	if len(entries) != 1 || entries[0].Domain != "popular.example.com" || entries[0].Count < 1000 {
+		t.Errorf("expected popular.example.com to be the most frequent, got %+v", entries)
+	}
+	if len(top.Top(100)) != 10 {
+		t.Errorf("expected at most 10 domains to be counted")
+	}
+}
+
+func TestTopDomainsSharded(t *testing.T) {
+	top := NewTopDomains(topCapacity)
+	if len(top.shards) < 2 {
+		t.Fatalf("expected the counters to be sharded, got %d shards", len(top.shards))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				top.Add(fmt.Sprintf("%d.example.com", i%20))
+				top.Add("popular.example.com")
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries := top.Top(21)
+	if len(entries) != 21 || entries[0].Domain != "popular.example.com" || entries[0].Count != 800 {
+		t.Fatalf("expected the domains of every shard with popular.example.com on top, got %+v", entries)
+	}
+	for _, e := range entries[1:] {
+		if e.Count != 40 {
+			t.Errorf("expected %s to be counted 40 times, got %d", e.Domain, e.Count)
+		}
+	}
+}
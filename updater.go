@@ -2,136 +2,811 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var timesSeen = make(map[string]int)
+// updateMu serializes rebuilds of the block cache, which run on startup, on
+// reload and on the update schedule
+var updateMu sync.Mutex
 
-// Update downloads all of the blocklists and imports them into the database
-func Update() error {
+// manualMu is held while domains are blocked or whitelisted through the API
+// and while rebuilt caches are swapped in, the domains of the API are added
+// to the rebuilt caches under it so that a change made during a rebuild
+// isn't lost
+var manualMu sync.Mutex
+
+// blockStats holds the *BlockStats of the last rebuild of the block cache
+var blockStats atomic.Value
+
+// blockCacheReady is set once the block cache was built or restored
+var blockCacheReady int32
+
+// BlockCacheReady returns whether or not the block cache was built or restored
+func BlockCacheReady() bool {
+	return atomic.LoadInt32(&blockCacheReady) == 1
+}
+
+// SourceStats are the stats of the lists of a source
+type SourceStats struct {
+	Source string `json:"source"`
+	ListStats
+}
+
+// BlockStats describes the block cache built by the last update, domains is
+// the number of unique entries in the block cache and whitelisted the number
+// of them that the whitelist allows
+type BlockStats struct {
+	Updated     time.Time     `json:"updated"`
+	Sources     []SourceStats `json:"sources"`
+	Lines       int           `json:"lines"`
+	Duplicates  int           `json:"duplicates"`
+	Whitelisted int           `json:"whitelisted"`
+	Domains     int           `json:"domains"`
+}
+
+// BlockCacheStats returns the stats of the last rebuild of the block cache,
+// nil if it wasn't built from the lists yet
+func BlockCacheStats() *BlockStats {
+	stats, _ := blockStats.Load().(*BlockStats)
+	return stats
+}
+
+// validatorsExt is the extension of the file the validators of a downloaded
+// list are kept in next to the list
+const validatorsExt = ".validators"
+
+// validators are the ETag and Last-Modified headers a list was downloaded
+// with, which are sent back so that an unchanged list isn't downloaded again
+type validators struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// Update downloads all of the blocklists and imports them into the database,
+// changed is false if every list was unchanged or failed to download
+func Update() (changed bool, err error) {
 	if _, err := os.Stat("lists"); os.IsNotExist(err) {
 		if err := os.Mkdir("lists", 0600); err != nil {
-			return fmt.Errorf("error creating lists directory: %s", err)
+			return false, fmt.Errorf("error creating lists directory: %s", err)
 		}
 	}
 
-	if err := fetchSources(); err != nil {
-		return fmt.Errorf("error fetching sources: %s", err)
+	changed, err = fetchSources()
+	if err != nil {
+		return false, fmt.Errorf("error fetching sources: %s", err)
 	}
 
-	return nil
+	return changed, nil
 }
 
-func downloadFile(uri string, name string) error {
+// downloadFile downloads a source into the lists directory, the previous
+// copy of the list is only replaced once the download has completed. The
+// download is conditional on the validators of the previous copy, changed is
+// false if the server answered that the list wasn't modified.
+func downloadFile(uri string, name string) (changed bool, err error) {
 	filePath := filepath.FromSlash(fmt.Sprintf("lists/%s", name))
 
-	output, err := os.Create(filePath)
+	request, err := http.NewRequest(http.MethodGet, uri, nil)
 	if err != nil {
-		return fmt.Errorf("error creating file: %s", err)
+		return false, fmt.Errorf("error downloading source: %s", err)
+	}
+
+	if saved, ok := loadValidators(filePath, uri); ok {
+		if saved.ETag != "" {
+			request.Header.Set("If-None-Match", saved.ETag)
+		}
+		if saved.LastModified != "" {
+			request.Header.Set("If-Modified-Since", saved.LastModified)
+		}
 	}
-	defer output.Close()
 
-	response, err := http.Get(uri)
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
-		return fmt.Errorf("error downloading source: %s", err)
+		return false, fmt.Errorf("error downloading source: %s", err)
 	}
 	defer response.Body.Close()
 
-	if _, err := io.Copy(output, response.Body); err != nil {
-		return fmt.Errorf("error copying output: %s", err)
+	if response.StatusCode == http.StatusNotModified {
+		log.Printf("source %s not modified\n", uri)
+		return false, nil
 	}
 
-	return nil
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("error downloading source %s: %s", uri, response.Status)
+	}
+
+	output, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		return false, fmt.Errorf("error creating file: %s", err)
+	}
+	defer os.Remove(output.Name())
+
+	body, err := decompress(uri, response)
+	if err != nil {
+		output.Close()
+		return false, fmt.Errorf("error decompressing source %s: %s", uri, err)
+	}
+
+	if _, err := io.Copy(output, body); err != nil {
+		output.Close()
+		return false, fmt.Errorf("error copying output: %s", err)
+	}
+
+	if err := output.Close(); err != nil {
+		return false, fmt.Errorf("error writing file: %s", err)
+	}
+
+	if err := os.Rename(output.Name(), filePath); err != nil {
+		return false, fmt.Errorf("error replacing file: %s", err)
+	}
+
+	saveValidators(filePath, validators{URL: uri, ETag: response.Header.Get("ETag"), LastModified: response.Header.Get("Last-Modified")})
+
+	return true, nil
 }
 
-func fetchSources() error {
-	var wg sync.WaitGroup
+// loadValidators returns the validators of a downloaded list, they are only
+// used while the list exists and is still downloaded from the same url
+func loadValidators(filePath, uri string) (validators, bool) {
+	var saved validators
 
-	for _, uri := range Config.Sources {
-		wg.Add(1)
+	if _, err := os.Stat(filePath); err != nil {
+		return saved, false
+	}
 
-		u, _ := url.Parse(uri)
-		host := u.Host
-		timesSeen[host] = timesSeen[host] + 1
-		fileName := fmt.Sprintf("%s.%d.list", host, timesSeen[host])
+	content, err := ioutil.ReadFile(filePath + validatorsExt)
+	if err != nil {
+		return saved, false
+	}
+	if err := json.Unmarshal(content, &saved); err != nil || saved.URL != uri {
+		return saved, false
+	}
+
+	return saved, true
+}
+
+// saveValidators keeps the validators of a downloaded list next to it, lists
+// that were downloaded without any have their old validators removed
+func saveValidators(filePath string, v validators) {
+	if v.ETag == "" && v.LastModified == "" {
+		os.Remove(filePath + validatorsExt)
+		return
+	}
+
+	content, err := json.Marshal(v)
+	if err == nil {
+		err = ioutil.WriteFile(filePath+validatorsExt, content, 0600)
+	}
+	if err != nil {
+		log.Printf("error saving validators of %s: %s\n", filePath, err)
+	}
+}
+
+// decompress returns the body of a source download, gzipped sources are
+// recognized by their Content-Encoding or a .gz extension and are only
+// decompressed when the content really is gzipped, since the http client
+// already decompresses responses it asked to be compressed
+func decompress(uri string, response *http.Response) (io.Reader, error) {
+	body := bufio.NewReader(response.Body)
+
+	gzipped := strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip")
+	if u, err := url.Parse(uri); err == nil && strings.HasSuffix(u.Path, ".gz") {
+		gzipped = true
+	}
+
+	if !gzipped {
+		return body, nil
+	}
+
+	if magic, err := body.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return body, nil
+	}
+
+	return gzip.NewReader(body)
+}
+
+func fetchSources() (bool, error) {
+	var (
+		wg      sync.WaitGroup
+		changed int32
+	)
+
+	fetchList(&wg, "", Config().Sources, &changed)
+
+	// the lists of a group are kept in a directory of their own
+	for name, g := range Config().Groups {
+		if err := os.MkdirAll(filepath.Join("lists", name), 0700); err != nil {
+			return false, fmt.Errorf("error creating lists directory of group %s: %s", name, err)
+		}
+		fetchList(&wg, name, g.Sources, &changed)
+	}
+
+	wg.Wait()
+
+	return atomic.LoadInt32(&changed) > 0, nil
+}
+
+// fetchList starts the downloads of sources into the directory dir of the
+// lists directory, changed is set once a list was downloaded, disabled sources
+// aren't downloaded
+func fetchList(wg *sync.WaitGroup, dir string, sources []source, changed *int32) {
+	for name, s := range listFiles(sources) {
+		if s.Disabled {
+			continue
+		}
+		wg.Add(1)
 
 		go func(uri string, name string) {
 			log.Printf("fetching source %s\n", uri)
-			if err := downloadFile(uri, name); err != nil {
-				fmt.Println(err)
+			if ok, err := downloadFile(uri, name); err != nil {
+				log.Println(err)
+			} else if ok {
+				atomic.StoreInt32(changed, 1)
 			}
 
 			wg.Done()
-		}(uri, fileName)
+		}(s.URL, path.Join(dir, name))
 	}
+}
 
-	wg.Wait()
+// listFiles returns the sources that are downloaded by the name of the file
+// they are downloaded to, local sources are read directly when the block cache
+// is built. Disabled sources keep their file names, so that disabling a source
+// doesn't rename the files of the others.
+func listFiles(sources []source) map[string]source {
+	// sources are numbered per host in the order they are configured, so
+	// every update overwrites the files of the previous one
+	files := make(map[string]source)
+	timesSeen := make(map[string]int)
 
-	return nil
+	for _, s := range sources {
+		if _, ok := localSource(s.URL); ok {
+			continue
+		}
+
+		u, _ := url.Parse(s.URL)
+		host := u.Host
+		timesSeen[host] = timesSeen[host] + 1
+		files[fmt.Sprintf("%s.%d.list", host, timesSeen[host])] = s
+	}
+
+	return files
 }
 
-// UpdateBlockCache updates the BlockCache
+// UpdateBlockCache rebuilds the BlockCache from the lists, the new cache is
+// swapped in once it is complete so queries never see a partial cache
 func UpdateBlockCache() error {
-	files, err := ioutil.ReadDir("lists")
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	hosts := &MemoryHostsCache{Backend: make(map[string][]net.IP)}
+	block, allow, sources, err := loadSources("lists", Config().Sources, hosts)
 	if err != nil {
-		return fmt.Errorf("could not read directory: %s", err)
+		return err
+	}
+
+	if Config().UseSystemHosts {
+		if n, err := loadSystemHosts(systemHostsPath, block, hosts); err != nil {
+			log.Printf("could not read the system hosts file %s: %s\n", systemHostsPath, err)
+		} else {
+			log.Printf("%d domains loaded from the system hosts file %s\n", n, systemHostsPath)
+		}
 	}
 
+	stats := &BlockStats{Updated: time.Now(), Sources: sources}
+	for _, s := range sources {
+		log.Printf("%d lines read from source %s, %d domains added and %d duplicates removed\n", s.Lines, s.Source, s.Domains, s.Duplicates)
+		stats.Lines += s.Lines
+		stats.Duplicates += s.Duplicates
+	}
+
+	log.Printf("%d domains loaded from sources, %d duplicates removed\n", block.Length(), stats.Duplicates)
+	if hosts.Length() > 0 {
+		log.Printf("%d domains with addresses loaded from hosts files\n", hosts.Length())
+	}
+
+	if err := UpdateRuleCaches(allow); err != nil {
+		return err
+	}
+
+	if err := UpdateGroupCaches(); err != nil {
+		return err
+	}
+
+	manualMu.Lock()
+	addManualBlocks(block)
+	stats.Domains = block.Length()
+	for _, domain := range block.Keys() {
+		if WhitelistCache.Match(domain) {
+			stats.Whitelisted++
+		}
+	}
+
+	ExceptionCache.Replace(allow)
+	HostsCache.Replace(hosts)
+	BlockCache.Replace(block)
+	manualMu.Unlock()
+
+	log.Printf("%d unique domains in the block cache, %d of them whitelisted\n", stats.Domains, stats.Whitelisted)
+	blockStats.Store(stats)
+	atomic.StoreInt32(&blockCacheReady, 1)
+
+	return nil
+}
+
+// UpdateGroupCaches rebuilds the caches of the blocklist groups from their
+// lists, the manual blocklist and the domains blocked through the API are
+// blocked in every group
+func UpdateGroupCaches() error {
+	groups := make(map[string]*BlockGroup, len(Config().Groups))
+
+	for name, g := range Config().Groups {
+		// the lists of a group that was just added haven't been downloaded yet
+		dir := filepath.Join("lists", name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("error creating lists directory of group %s: %s", name, err)
+		}
+
+		block, allow, _, err := loadSources(dir, g.Sources, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%d domains loaded from sources of group %s\n", block.Length(), name)
+
+		groups[name] = &BlockGroup{Block: block, Allow: allow}
+	}
+
+	manualMu.Lock()
+	for _, g := range groups {
+		addManualBlocks(g.Block)
+	}
+	BlockGroups.Replace(groups)
+	manualMu.Unlock()
+
+	return nil
+}
+
+// loadSources loads the lists downloaded into dir and the local sources, the
+// addresses of hosts entries in local sources are added to hosts if it's set,
+// entries of downloaded lists always block since they aren't trusted to point
+// domains elsewhere. Lists that no source is downloaded to anymore are loaded
+// with the format detected and counted by the name of their file. Disabled
+// sources are left out, and the exceptions of a source only allow the domains
+// that no source with a higher priority blocks.
+func loadSources(dir string, sources []source, hosts *MemoryHostsCache) (block, allow *MemoryBlockCache, stats []SourceStats, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not read directory: %s", err)
+	}
+
+	lists := newSourceLists(sources)
+
+	downloaded := listFiles(sources)
 	for _, f := range files {
-		file, err := os.Open(filepath.FromSlash(fmt.Sprintf("lists/%s", f.Name())))
+		// unfinished downloads, validators and the lists of groups are left out
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") || strings.HasSuffix(f.Name(), validatorsExt) {
+			continue
+		}
+
+		s, ok := downloaded[f.Name()]
+		if !ok {
+			s.URL = f.Name()
+		}
+		if s.Disabled {
+			continue
+		}
+
+		err := lists.load(s, func(block, allow *MemoryBlockCache) (ListStats, error) {
+			return loadListFile(filepath.Join(dir, f.Name()), s.Format, block, allow, nil)
+		})
 		if err != nil {
-			return fmt.Errorf("error opening file: %s", err)
+			return nil, nil, nil, err
+		}
+	}
+
+	for _, s := range sources {
+		if path, ok := localSource(s.URL); ok && !s.Disabled {
+			err := lists.load(s, func(block, allow *MemoryBlockCache) (ListStats, error) {
+				return loadLocalSource(path, s.Format, block, allow, hosts)
+			})
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+
+	lists.resolvePriorities()
+
+	return lists.block, lists.allow, lists.stats, nil
+}
+
+// sourceLists merges the lists of the sources into a single block cache and
+// allow cache, the priorities of the entries are only kept if a source has a
+// priority
+type sourceLists struct {
+	block, allow  *MemoryBlockCache
+	stats         []SourceStats
+	blockPriority map[string]int
+	allowPriority map[string]int
+}
+
+func newSourceLists(sources []source) *sourceLists {
+	l := &sourceLists{
+		block: &MemoryBlockCache{Backend: make(map[string]bool)},
+		allow: &MemoryBlockCache{Backend: make(map[string]bool)},
+	}
+
+	for _, s := range sources {
+		if !s.Disabled && s.Priority != 0 {
+			l.blockPriority, l.allowPriority = make(map[string]int), make(map[string]int)
+			break
+		}
+	}
+
+	return l
+}
+
+// load loads the lists of a source with load into caches of its own and adds
+// them to the merged caches, domains that another source blocked already are
+// counted as duplicates
+func (l *sourceLists) load(s source, load func(block, allow *MemoryBlockCache) (ListStats, error)) error {
+	block := &MemoryBlockCache{Backend: make(map[string]bool)}
+	allow := &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	list, err := load(block, allow)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range block.Keys() {
+		if l.block.Exists(key) {
+			list.Duplicates++
+			list.Domains--
+		} else {
+			l.block.Set(key, true)
+		}
+		if p, ok := l.blockPriority[key]; l.blockPriority != nil && (!ok || s.Priority > p) {
+			l.blockPriority[key] = s.Priority
+		}
+	}
+	for _, key := range allow.Keys() {
+		l.allow.Set(key, true)
+		if p, ok := l.allowPriority[key]; l.allowPriority != nil && (!ok || s.Priority > p) {
+			l.allowPriority[key] = s.Priority
+		}
+	}
+
+	l.stats = append(l.stats, SourceStats{Source: s.URL, ListStats: list})
+
+	return nil
+}
+
+// resolvePriorities removes the exceptions for domains that a source with a
+// higher priority than every source allowing them blocks
+func (l *sourceLists) resolvePriorities() {
+	for key, allowed := range l.allowPriority {
+		if blocked, ok := l.blockPriority[key]; ok && blocked > allowed {
+			l.allow.Remove(key)
+		}
+	}
+}
+
+// localSource returns the path of a source that is read from disk, which is
+// written as file:///path or as a plain path
+func localSource(uri string) (string, bool) {
+	if strings.HasPrefix(uri, "file://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", false
+		}
+		return filepath.FromSlash(u.Path), true
+	}
+
+	return uri, !strings.Contains(uri, "://")
+}
+
+// loadLocalSource loads a list file or every .txt and .hosts file in a list
+// directory, a missing source is reported and skipped
+func loadLocalSource(path, format string, block, allow *MemoryBlockCache, hosts *MemoryHostsCache) (ListStats, error) {
+	var stats ListStats
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		log.Printf("skipping missing source %s\n", path)
+		return stats, nil
+	}
+	if err != nil {
+		return stats, fmt.Errorf("error reading source: %s", err)
+	}
+
+	if !info.IsDir() {
+		return loadListFile(path, format, block, allow, hosts)
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return stats, fmt.Errorf("could not read directory: %s", err)
+	}
+
+	for _, f := range files {
+		if ext := filepath.Ext(f.Name()); f.IsDir() || (ext != ".txt" && ext != ".hosts") {
+			continue
+		}
+
+		list, err := loadListFile(filepath.Join(path, f.Name()), format, block, allow, hosts)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(list)
+	}
+
+	return stats, nil
+}
+
+// loadListFile parses a single list file in format into block, allow and hosts
+func loadListFile(path, format string, block, allow *MemoryBlockCache, hosts *MemoryHostsCache) (ListStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ListStats{}, fmt.Errorf("error opening file: %s", err)
+	}
+	defer file.Close()
+
+	stats, err := parseList(file, format, block, allow, hosts)
+	if err != nil {
+		return stats, fmt.Errorf("error scanning file %s: %s", path, err)
+	}
+
+	return stats, nil
+}
+
+// ScheduleUpdates downloads the sources and rebuilds the block cache every
+// interval until ctx is done, a failed update is logged and the current block
+// cache is kept. swapped is called once a rebuilt block cache was swapped in.
+// An update that is running when ctx is done isn't rebuilt into the block cache.
+func ScheduleUpdates(ctx context.Context, interval time.Duration, swapped func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		log.Printf("updating blocklists\n")
+
+		changed, err := Update()
+		if err != nil {
+			log.Printf("could not update blocklists: %s\n", err)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the lists are only parsed again once one of them changed
+		if !changed {
+			log.Printf("blocklists not modified, next update in %s\n", interval)
+			continue
+		}
+
+		if err := UpdateBlockCache(); err != nil {
+			log.Printf("could not rebuild block cache: %s\n", err)
+			continue
+		}
+		if swapped != nil {
+			swapped()
+		}
+
+		log.Printf("blocklists updated, next update in %s\n", interval)
+	}
+}
+
+// RebuildBlockCache rebuilds the block cache in the background, queries keep
+// being answered from the current caches until the new ones are swapped in.
+// swapped is called once the new caches were swapped in, and the returned
+// channel receives the result of the rebuild, which is logged when it fails.
+func RebuildBlockCache(swapped func()) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		start := time.Now()
+		err := UpdateBlockCache()
+		if err != nil {
+			log.Printf("could not rebuild block cache: %s\n", err)
+		} else {
+			log.Printf("block cache rebuilt in %s\n", time.Since(start).Round(time.Millisecond))
+			if swapped != nil {
+				swapped()
+			}
+		}
+		done <- err
+	}()
+	return done
+}
+
+// UpdateRuleCaches rebuilds the whitelist and regex blocklist, which are read
+// from the config rather than the downloaded lists, the whitelist also allows
+// the domains in allow and the domains whitelisted through the API
+func UpdateRuleCaches(allow *MemoryBlockCache) error {
+	whitelist, err := loadWhitelist(allow)
+	if err != nil {
+		return err
+	}
+
+	regex := &MemoryRegexBlockCache{}
+	if Config().RegexBlocklist != "" {
+		if err := loadRegexBlocklist(Config().RegexBlocklist, regex); err != nil {
+			return err
+		}
+	}
+
+	manualMu.Lock()
+	for _, entry := range ManualWhitelistCache.Keys() {
+		whitelist.Set(entry, true)
+	}
+	WhitelistCache.Replace(whitelist)
+	manualMu.Unlock()
+	RegexBlockCache.Replace(regex)
+
+	return nil
+}
+
+// addManualBlocks adds the manual blocklist and the domains blocked through
+// the API to block, a rebuilt cache is swapped in under manualMu right after
+func addManualBlocks(block *MemoryBlockCache) {
+	for _, entry := range Config().Blocklist {
+		block.Set(entry, true)
+	}
+	for _, entry := range ManualBlockCache.Keys() {
+		block.Set(entry, true)
+	}
+}
+
+// BlockDomain blocks domain through the API, in every group and until it's
+// unblocked again
+func BlockDomain(domain string) {
+	manualMu.Lock()
+	defer manualMu.Unlock()
+
+	ManualBlockCache.Set(domain, true)
+	BlockCache.Set(domain, true)
+	BlockGroups.Set(domain)
+}
+
+// UnblockDomain unblocks domain in every group, it returns false if domain
+// isn't blocked. Domains from the lists are blocked again when the block
+// cache is rebuilt.
+func UnblockDomain(domain string) bool {
+	manualMu.Lock()
+	defer manualMu.Unlock()
+
+	if !BlockCache.Has(domain) {
+		return false
+	}
+
+	ManualBlockCache.Remove(domain)
+	BlockCache.Remove(domain)
+	BlockGroups.Remove(domain)
+	return true
+}
+
+// WhitelistDomain whitelists domain through the API until it's removed again
+func WhitelistDomain(domain string) {
+	manualMu.Lock()
+	defer manualMu.Unlock()
+
+	ManualWhitelistCache.Set(domain, true)
+	WhitelistCache.Set(domain, true)
+}
+
+// UnwhitelistDomain removes domain from the whitelist, it returns false if
+// domain isn't whitelisted. Domains from the config and the lists are
+// whitelisted again when the block cache is rebuilt.
+func UnwhitelistDomain(domain string) bool {
+	manualMu.Lock()
+	defer manualMu.Unlock()
+
+	if !WhitelistCache.Has(domain) {
+		return false
+	}
+
+	ManualWhitelistCache.Remove(domain)
+	WhitelistCache.Remove(domain)
+	return true
+}
+
+// loadWhitelist loads the manual whitelist entries and the whitelist file
+// on top of the domains allowed by the lists
+func loadWhitelist(allow *MemoryBlockCache) (*MemoryBlockCache, error) {
+	whitelist := &MemoryBlockCache{Backend: make(map[string]bool)}
+
+	for _, key := range allow.Keys() {
+		whitelist.Set(key, true)
+	}
+
+	for _, entry := range Config().Whitelist {
+		whitelist.Set(entry, true)
+	}
+
+	if Config().WhitelistFile != "" {
+		file, err := os.Open(Config().WhitelistFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening whitelist: %s", err)
 		}
 		defer file.Close()
 
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			line := scanner.Text()
-			line = strings.TrimSpace(line)
-			isComment := strings.HasPrefix(line, "#")
-
-			if !isComment && line != "" {
-				fields := strings.Fields(line)
-
-				if len(fields) > 1 && !strings.HasPrefix(fields[1], "#") {
-					line = fields[1]
-				} else {
-					line = fields[0]
-				}
-
-				// TODO: translate to map[string]bool for better performance
-				whitelisted := false
-				for _, entry := range Config.Whitelist {
-					if entry == line {
-						whitelisted = true
-					}
-				}
-
-				if !BlockCache.Exists(line) && !whitelisted {
-					BlockCache.Set(line, true)
-				}
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
 			}
+
+			whitelist.Set(strings.Fields(line)[0], true)
 		}
 
 		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("error scanning file: %s", err)
+			return nil, fmt.Errorf("error scanning whitelist: %s", err)
+		}
+	}
+
+	log.Printf("%d domains whitelisted\n", whitelist.Length())
+
+	return whitelist, nil
+}
+
+// loadRegexBlocklist compiles the patterns in the regex blocklist file into
+// regex, patterns that don't compile are reported and skipped
+func loadRegexBlocklist(path string, regex *MemoryRegexBlockCache) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening regex blocklist: %s", err)
+	}
+	defer file.Close()
+
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+
+		re, err := regexp.Compile(line)
+		if err != nil {
+			log.Printf("skipping invalid pattern on line %d of %s: %s\n", lineNo, path, err)
+			continue
+		}
+
+		regex.Add(re)
 	}
 
-	for _, entry := range Config.Blocklist {
-		BlockCache.Set(entry, true)
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error scanning regex blocklist: %s", err)
 	}
 
-	log.Printf("%d domains loaded from sources\n", BlockCache.Length())
+	log.Printf("%d patterns loaded from %s\n", regex.Length(), path)
 
 	return nil
 }
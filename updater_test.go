@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpdateGzip(t *testing.T) {
+	fixture, err := ioutil.ReadFile(filepath.FromSlash("testdata/hosts.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/encoded" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Write(fixture)
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/hosts.gz", "/encoded"} {
+		withConfig(t, &config{Sources: []source{{URL: server.URL + path}}})
+		inDir(t, t.TempDir())
+
+		if _, err := Update(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := UpdateBlockCache(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, domain := range []string{"gzip.example.com", "tracker.gzip.example.com"} {
+			if !BlockCache.Exists(domain) {
+				t.Errorf("%s from %s is not in the block cache", domain, path)
+			}
+		}
+	}
+}
+
+func TestUpdateConditional(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/etag" && r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		if r.URL.Path == "/etag" {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		w.Write([]byte("conditional.example.com\n"))
+	}))
+	defer server.Close()
+
+	withConfig(t, &config{Sources: []source{{URL: server.URL + "/etag"}, {URL: server.URL + "/plain"}}})
+	inDir(t, t.TempDir())
+
+	for i, expected := range []bool{true, true} {
+		changed, err := Update()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("update %d: expected changed to be %v", i, expected)
+		}
+	}
+
+	// the list without validators is downloaded every time
+	if downloads := atomic.LoadInt32(&downloads); downloads != 3 {
+		t.Errorf("expected 3 downloads, got %d", downloads)
+	}
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := BlockCacheStats(); len(stats.Sources) != 2 {
+		t.Errorf("expected the validators not to be loaded as lists, got %+v", stats.Sources)
+	}
+
+	withConfig(t, &config{Sources: []source{{URL: server.URL + "/etag"}}})
+	if changed, err := Update(); err != nil || changed {
+		t.Errorf("expected an unchanged list, got %v, %v", changed, err)
+	}
+}
+
+// withConfig makes c the active config for the rest of the test
+func withConfig(t *testing.T, c *config) {
+	old := Config()
+	activeConfig.Store(c)
+	t.Cleanup(func() { activeConfig.Store(old) })
+}
+
+// inDir changes the working directory for the rest of the test
+func inDir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestUpdateLocalSources(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	files := map[string]string{
+		"lists/remote.list":       "remote.example.com\n",
+		"single.list":             "0.0.0.0 single.example.com\n",
+		"curated/ads.txt":         "||ads.example.com^\n",
+		"curated/trackers.hosts":  "0.0.0.0 tracker.example.com\n",
+		"curated/notes.md":        "ignored.example.com\n",
+		"curated/nested/more.txt": "nested.example.com\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withConfig(t, &config{Sources: []source{
+		{URL: "file://" + filepath.ToSlash(filepath.Join(dir, "single.list"))},
+		{URL: "curated"},
+		{URL: filepath.Join(dir, "missing.txt")},
+	}})
+
+	if _, err := Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"remote.example.com", "single.example.com", "ads.example.com", "tracker.example.com"} {
+		if !BlockCache.Exists(domain) {
+			t.Errorf("%s is not in the block cache", domain)
+		}
+	}
+
+	for _, domain := range []string{"ignored.example.com", "nested.example.com"} {
+		if BlockCache.Exists(domain) {
+			t.Errorf("%s should not be loaded", domain)
+		}
+	}
+}
+
+func TestUpdateGroups(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	files := map[string]string{
+		"lists/default.list":    "default.example.com\n",
+		"lists/kids/games.list": "games.example.com\n",
+		"kids.txt":              "||video.example.com^\n@@||edu.video.example.com^\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &config{
+		Blocklist: []string{"manual.example.com"},
+		Groups:    map[string]group{"kids": {Sources: []source{{URL: "kids.txt"}}, Clients: []string{"192.168.1.64/26"}}},
+	}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c)
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain, group string
+		blocked       bool
+	}{
+		{"default.example.com", "", true},
+		{"default.example.com", "kids", false},
+		{"games.example.com", "", false},
+		{"games.example.com", "kids", true},
+		{"www.video.example.com", "kids", true},
+		{"edu.video.example.com", "kids", false},
+		{"manual.example.com", "", true},
+		{"manual.example.com", "kids", true},
+	}
+
+	for _, test := range tests {
+		if blocked := isBlocked(test.domain, test.group); blocked != test.blocked {
+			t.Errorf("%s blocked for group %q is %t, expected %t", test.domain, test.group, blocked, test.blocked)
+		}
+	}
+}
+
+func TestUpdateSourcePriority(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	if err := os.Mkdir("lists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"base.txt":     "||ads.example.com^\n||tracker.example.com^\n",
+		"strict.txt":   "||cdn.example.com^\n",
+		"allow.txt":    "@@||ads.example.com^\n@@||cdn.example.com^\n",
+		"disabled.txt": "||disabled.example.com^\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withParsedConfig(t, &config{Sources: []source{
+		{URL: "base.txt"},
+		{URL: "strict.txt", Priority: 10},
+		{URL: "allow.txt", Priority: 5},
+		{URL: "disabled.txt", Disabled: true},
+	}})
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"ads.example.com":      false,
+		"tracker.example.com":  true,
+		"cdn.example.com":      true,
+		"disabled.example.com": false,
+	}
+	for domain, blocked := range tests {
+		if isBlocked(domain, "") != blocked {
+			t.Errorf("expected %s blocked to be %t", domain, blocked)
+		}
+	}
+
+	if sources := BlockCacheStats().Sources; len(sources) != 3 {
+		t.Errorf("expected the stats of the 3 enabled sources, got %v", sources)
+	}
+}
+
+func TestUpdateBlockStats(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	if err := os.Mkdir("lists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"a.list": "a.example.com\nb.example.com\n", "b.list": "# comment\nb.example.com\nc.example.com\n"} {
+		if err := ioutil.WriteFile(filepath.Join("lists", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withConfig(t, &config{Whitelist: []string{"c.example.com"}})
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := BlockCacheStats()
+	if stats == nil || len(stats.Sources) != 2 {
+		t.Fatalf("expected the stats of 2 sources, got %+v", stats)
+	}
+	if stats.Lines != 5 || stats.Duplicates != 1 || stats.Domains != 3 || stats.Whitelisted != 1 {
+		t.Errorf("expected 5 lines, 1 duplicate, 3 domains and 1 whitelisted domain, got %+v", stats)
+	}
+}
+
+func TestRebuildBlockCache(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "lists"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lists", "new.list"), []byte("new.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, &config{})
+
+	old := BlockCache.Backend
+	BlockCache.Replace(&MemoryBlockCache{Backend: map[string]bool{"old.example.com": true}})
+	t.Cleanup(func() { BlockCache.Replace(&MemoryBlockCache{Backend: old}) })
+
+	// the current cache keeps answering while the new one is built
+	done := RebuildBlockCache(nil)
+	for rebuilding := true; rebuilding; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			rebuilding = false
+		default:
+			// once the old domain is gone the new cache was swapped in
+			if !BlockCache.Exists("old.example.com") && !BlockCache.Exists("new.example.com") {
+				t.Fatal("the block cache was empty during the rebuild")
+			}
+		}
+	}
+
+	if !BlockCache.Exists("new.example.com") || BlockCache.Exists("old.example.com") {
+		t.Error("expected the rebuilt cache to be swapped in")
+	}
+}
+
+func TestUpdateKeepsManualEntries(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	if err := os.Mkdir("lists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("lists", "a.list"), []byte("listed.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, &config{})
+
+	ManualBlockCache.Set("blocked.example.com", true)
+	ManualWhitelistCache.Set("listed.example.com", true)
+	t.Cleanup(func() {
+		ManualBlockCache.Remove("blocked.example.com")
+		ManualWhitelistCache.Remove("listed.example.com")
+	})
+
+	if err := UpdateBlockCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !BlockCache.Exists("blocked.example.com") {
+		t.Error("expected the domain blocked through the api to survive the rebuild")
+	}
+	if !WhitelistCache.Match("listed.example.com") {
+		t.Error("expected the domain whitelisted through the api to survive the rebuild")
+	}
+}
+
+func TestRebuildFlushesAnswers(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	if err := os.Mkdir("lists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("lists", "new.list"), []byte("new.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withParsedConfig(t, &config{Expire: 600, Maxcount: 10})
+
+	// the answer was cached before the domain was on a list
+	h := NewHandler()
+	m := new(dns.Msg)
+	m.SetQuestion("new.example.com.", dns.TypeA)
+	m.Answer = []dns.RR{testRR("new.example.com.", 600)}
+	h.cache.Set(KeyGen(Question{"new.example.com", "A", "IN"}), m)
+
+	if err := <-RebuildBlockCache(func() { h.Flush() }); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.cache.Length() != 0 {
+		t.Error("expected the cached answers to be flushed once the block cache was swapped in")
+	}
+}
+
+func TestScheduleUpdates(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("scheduled.example.com\n"))
+	}))
+	defer server.Close()
+
+	inDir(t, t.TempDir())
+	withConfig(t, &config{Sources: []source{{URL: server.URL + "/list"}}})
+
+	var rebuilds int32
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		ScheduleUpdates(ctx, 10*time.Millisecond, func() { atomic.AddInt32(&rebuilds, 1) })
+		close(stopped)
+	}()
+
+	// the list is only downloaded in full on the first update
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&downloads) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lists to be downloaded every interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+
+	if n := atomic.LoadInt32(&rebuilds); n != 1 {
+		t.Errorf("expected the block cache to be rebuilt only when the list changed, got %d rebuilds", n)
+	}
+	if !BlockCache.Exists("scheduled.example.com") {
+		t.Error("expected the scheduled update to rebuild the block cache")
+	}
+}
+
+func TestScheduleUpdatesStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// shutdown starts while the lists are downloaded
+		cancel()
+		w.Write([]byte("stopped.example.com\n"))
+	}))
+	defer server.Close()
+
+	inDir(t, t.TempDir())
+	withConfig(t, &config{Sources: []source{{URL: server.URL + "/list"}}})
+
+	stopped := make(chan struct{})
+	go func() {
+		ScheduleUpdates(ctx, 10*time.Millisecond, func() { t.Error("expected no rebuild once ctx was done") })
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the updates to stop once ctx was done")
+	}
+	if BlockCache.Exists("stopped.example.com") {
+		t.Error("expected the update to be left out of the block cache")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const defaultTLSPort = "853"
+
+// Upstream represents a nameserver that queries are forwarded to
+type Upstream struct {
+	Addr       string
+	Net        string
+	ServerName string
+
+	// URL and Proxy are the endpoint and the proxy of DNS-over-HTTPS
+	// nameservers, an empty Proxy uses the proxy in the config
+	URL   string
+	Proxy string
+}
+
+// ParseUpstream parses a nameserver entry from the config, plain host:port
+// entries use the same transport as the client while entries written as
+// tls://host:port are forwarded using DNS-over-TLS. The name used for
+// certificate validation defaults to the host and can be set explicitly with
+// tls://1.1.1.1:853?tls-servername=cloudflare-dns.com
+//
+// Entries written as quic://host:port are forwarded using DNS-over-QUIC, the
+// name used for certificate validation is set like for tls:// entries.
+//
+// Entries written as https://host/path are forwarded using DNS-over-HTTPS,
+// through the proxy set with https://host/path?proxy=socks5://127.0.0.1:9050
+// or directly with ?proxy=none.
+func ParseUpstream(s string) (*Upstream, error) {
+	if !strings.Contains(s, "://") {
+		return &Upstream{Addr: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse nameserver %s: %s", s, err)
+	}
+
+	switch u.Scheme {
+	case "tls", "quic":
+		host, port := u.Hostname(), u.Port()
+		if host == "" {
+			return nil, fmt.Errorf("nameserver %s has no host", s)
+		}
+		if port == "" {
+			port = defaultTLSPort
+		}
+
+		serverName := u.Query().Get("tls-servername")
+		if serverName == "" {
+			serverName = host
+		}
+
+		Net := "tcp-tls"
+		if u.Scheme == "quic" {
+			Net = "quic"
+		}
+
+		return &Upstream{Addr: net.JoinHostPort(host, port), Net: Net, ServerName: serverName}, nil
+	case "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("nameserver %s has no host", s)
+		}
+
+		query := u.Query()
+		proxy := query.Get("proxy")
+		if proxy != "" && proxy != "none" {
+			if _, err := parseProxy(proxy); err != nil {
+				return nil, fmt.Errorf("nameserver %s has an invalid proxy: %s", s, err)
+			}
+		}
+		query.Del("proxy")
+		u.RawQuery = query.Encode()
+
+		return &Upstream{Addr: u.Host, Net: "https", URL: u.String(), Proxy: proxy}, nil
+	default:
+		return nil, fmt.Errorf("nameserver %s has unsupported scheme %s", s, u.Scheme)
+	}
+}
+
+// String formats an upstream for logging
+func (u *Upstream) String() string {
+	switch u.Net {
+	case "tcp-tls":
+		return "tls://" + u.Addr + "#" + u.ServerName
+	case "quic":
+		return "quic://" + u.Addr + "#" + u.ServerName
+	case "https":
+		return u.URL
+	}
+	return u.Addr
+}
+
+// Encrypted returns whether or not queries to the upstream are encrypted
+func (u *Upstream) Encrypted() bool {
+	switch u.Net {
+	case "tcp-tls", "https", "quic":
+		return true
+	}
+	return false
+}
+
+// TLSConfig returns the tls configuration used to connect to the upstream
+func (u *Upstream) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: Config().TLSInsecure,
+	}
+}
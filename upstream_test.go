@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseUpstreamTLS(t *testing.T) {
+	tests := []struct {
+		nameserver string
+		addr       string
+		net        string
+		serverName string
+	}{
+		{"1.1.1.1:53", "1.1.1.1:53", "", ""},
+		{"tls://1.1.1.1", "1.1.1.1:853", "tcp-tls", "1.1.1.1"},
+		{"tls://1.1.1.1:8853?tls-servername=cloudflare-dns.com", "1.1.1.1:8853", "tcp-tls", "cloudflare-dns.com"},
+		{"tls://dns.quad9.net", "dns.quad9.net:853", "tcp-tls", "dns.quad9.net"},
+		{"tls://[2606:4700:4700::1111]?tls-servername=one.one.one.one", "[2606:4700:4700::1111]:853", "tcp-tls", "one.one.one.one"},
+	}
+
+	for _, test := range tests {
+		upstream, err := ParseUpstream(test.nameserver)
+		if err != nil {
+			t.Errorf("%s: %s", test.nameserver, err)
+			continue
+		}
+		if upstream.Addr != test.addr || upstream.Net != test.net || upstream.ServerName != test.serverName {
+			t.Errorf("%s: unexpected upstream %+v", test.nameserver, upstream)
+		}
+	}
+
+	for _, nameserver := range []string{"tls://", "tls://:853", "ftp://1.1.1.1"} {
+		if _, err := ParseUpstream(nameserver); err == nil {
+			t.Errorf("%s: expected an error", nameserver)
+		}
+	}
+}
+
+// startDoTUpstream returns the address of a DNS-over-TLS nameserver for
+// localhost, the names the clients asked for in their handshakes are sent to
+// serverNames
+func startDoTUpstream(t *testing.T, serverNames chan<- string) string {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "localhost")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")}}
+		w.WriteMsg(m)
+	})}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	server.NotifyStartedFunc = wg.Done
+	go server.ActivateAndServe()
+	wg.Wait()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return listener.Addr().String()
+}
+
+func TestDoTLookup(t *testing.T) {
+	serverNames := make(chan string, 10)
+	withConfig(t, &config{
+		Nameservers: []string{"tls://" + startDoTUpstream(t, serverNames) + "?tls-servername=localhost"},
+		TLSInsecure: true,
+		Interval:    200,
+		Timeout:     5,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	resp, err := NewResolver().Lookup("udp", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("expected the answer of the DNS-over-TLS nameserver, got %v", resp)
+	}
+
+	if name := <-serverNames; name != "localhost" {
+		t.Errorf("expected the handshake to ask for the tls-servername, got %q", name)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// latencySamples is how many of the latest latencies of a nameserver are kept
+// for its percentiles
+const latencySamples = 1000
+
+// upstreamCounters counts the queries to a nameserver, queries that were
+// cancelled because another nameserver answered first aren't counted
+type upstreamCounters struct {
+	queries     uint64
+	errors      uint64
+	total       time.Duration
+	latencies   []time.Duration
+	next        int
+	lastSuccess time.Time
+	lastError   time.Time
+	lastErr     string
+}
+
+// UpstreamStats holds the health and the query statistics of a nameserver,
+// the latencies are in milliseconds and the percentiles are taken from the
+// latest answers
+type UpstreamStats struct {
+	UpstreamHealth
+	Queries          uint64    `json:"queries"`
+	Errors           uint64    `json:"errors"`
+	AvgLatency       float64   `json:"avg_latency_ms"`
+	P50Latency       float64   `json:"p50_latency_ms"`
+	P90Latency       float64   `json:"p90_latency_ms"`
+	P99Latency       float64   `json:"p99_latency_ms"`
+	LastSuccess      time.Time `json:"last_success"`
+	LastError        time.Time `json:"last_error"`
+	LastErrorMessage string    `json:"last_error_message,omitempty"`
+}
+
+// record counts a query to a nameserver, err is the error of a query that
+// failed and latency how long a query that was answered took
+func (r *Resolver) record(nameserver string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.stats[nameserver]
+	if !ok {
+		c = &upstreamCounters{}
+		r.stats[nameserver] = c
+	}
+
+	c.queries++
+	if err != nil {
+		c.errors++
+		c.lastError, c.lastErr = time.Now(), err.Error()
+		return
+	}
+
+	c.total += latency
+	c.lastSuccess = time.Now()
+	if len(c.latencies) < latencySamples {
+		c.latencies = append(c.latencies, latency)
+	} else {
+		c.latencies[c.next] = latency
+		c.next = (c.next + 1) % latencySamples
+	}
+}
+
+// Stats returns the health and the query statistics of the nameservers
+func (r *Resolver) Stats() []UpstreamStats {
+	health := r.Health()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make([]UpstreamStats, 0, len(health))
+	for _, h := range health {
+		s := UpstreamStats{UpstreamHealth: h}
+		if c, ok := r.stats[h.Nameserver]; ok {
+			s.Queries, s.Errors = c.queries, c.errors
+			s.LastSuccess, s.LastError, s.LastErrorMessage = c.lastSuccess, c.lastError, c.lastErr
+			if answered := c.queries - c.errors; answered > 0 {
+				s.AvgLatency = milliseconds(c.total / time.Duration(answered))
+			}
+
+			latencies := append([]time.Duration(nil), c.latencies...)
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			s.P50Latency = milliseconds(percentile(latencies, 0.5))
+			s.P90Latency = milliseconds(percentile(latencies, 0.9))
+			s.P99Latency = milliseconds(percentile(latencies, 0.99))
+		}
+		stats = append(stats, s)
+	}
+
+	return stats
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// milliseconds returns a duration in milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
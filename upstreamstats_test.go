@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamStats(t *testing.T) {
+	silent := startSilentUpstream(t)
+	ok := startRcodeUpstream(t, dns.RcodeSuccess)
+	withConfig(t, &config{Nameservers: []string{silent}, Interval: 10, Timeout: 1, UpstreamTimeout: 100})
+	r := NewResolver()
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	if _, err := r.Lookup("udp", req, nil); err == nil {
+		t.Fatal("expected the lookup on a silent nameserver to fail")
+	}
+
+	// the queries to the silent nameserver are cancelled once the other one
+	// answers, so they aren't counted
+	withConfig(t, &config{Nameservers: []string{silent, ok}, Interval: 10, Timeout: 1, UpstreamTimeout: 100})
+	for i := 0; i < 3; i++ {
+		if _, err := r.Lookup("udp", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := r.Stats()
+	if len(stats) != 2 || stats[0].Nameserver != silent || stats[1].Nameserver != ok {
+		t.Fatalf("expected the stats of every nameserver in order, got %+v", stats)
+	}
+
+	if s := stats[1]; s.Queries != 3 || s.Errors != 0 || s.LastSuccess.IsZero() || s.AvgLatency <= 0 || s.P99Latency < s.P50Latency {
+		t.Errorf("unexpected stats of the answering nameserver %+v", s)
+	}
+	if s := stats[0]; s.Errors != 1 || s.Queries != 1 || s.LastError.IsZero() || s.LastErrorMessage == "" || !s.LastSuccess.IsZero() {
+		t.Errorf("unexpected stats of the silent nameserver %+v", s)
+	}
+}
+
+func TestUpstreamStatsPercentiles(t *testing.T) {
+	r := NewResolver()
+	withConfig(t, &config{Nameservers: []string{"a"}})
+
+	for i := 1; i <= latencySamples+100; i++ {
+		r.record("a", time.Duration(i)*time.Millisecond, nil)
+	}
+	r.record("a", 0, fmt.Errorf("timeout"))
+
+	s := r.Stats()[0]
+	if s.Queries != latencySamples+101 || s.Errors != 1 || s.LastErrorMessage != "timeout" {
+		t.Errorf("unexpected counters %+v", s)
+	}
+	// only the latest samples are kept, 101ms to 1100ms
+	if s.P50Latency != 600 || s.P99Latency != 1090 {
+		t.Errorf("expected the percentiles of the latest latencies, got p50 %v and p99 %v", s.P50Latency, s.P99Latency)
+	}
+	if s.AvgLatency != 550.5 {
+		t.Errorf("expected the average of every latency, got %v", s.AvgLatency)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// Version is the version of grimd and BuildDate the date it was built, they
+// are set when building with
+// -ldflags "-X main.Version=1.2.3 -X main.BuildDate=2026-01-02"
+var (
+	Version   = "0.0.1"
+	BuildDate = "unknown"
+)
+
+// startTime is when grimd was started
+var startTime = time.Now()
+
+// VersionInfo describes the running grimd and a summary of its config without
+// anything that could hold credentials, like the urls of nameservers
+type VersionInfo struct {
+	Version   string        `json:"version"`
+	GoVersion string        `json:"go_version"`
+	BuildDate string        `json:"build_date"`
+	Started   time.Time     `json:"started"`
+	Uptime    float64       `json:"uptime_seconds"`
+	Config    ConfigSummary `json:"config"`
+}
+
+// ConfigSummary is the summary of the config in the version info
+type ConfigSummary struct {
+	BindUDP            []string `json:"bind_udp"`
+	BindTCP            []string `json:"bind_tcp"`
+	API                string   `json:"api"`
+	Nameservers        int      `json:"nameservers"`
+	ResolverMode       string   `json:"resolver_mode"`
+	Sources            int      `json:"sources"`
+	Groups             int      `json:"groups"`
+	BlockedDomains     int      `json:"blocked_domains"`
+	CacheSize          int      `json:"cache_size"`
+	CacheMaxcount      int      `json:"cache_maxcount"`
+	BlockCacheSize     int      `json:"block_cache_size"`
+	BlockCacheMaxcount int      `json:"block_cache_maxcount"`
+	QuestionCacheCap   int      `json:"question_cache_cap"`
+}
+
+// Info returns the version info of the running grimd
+func (h *DNSHandler) Info() VersionInfo {
+	c := Config()
+	resolverMode := c.ResolverMode
+	if resolverMode == "" {
+		resolverMode = "sequential"
+	}
+
+	return VersionInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		BuildDate: BuildDate,
+		Started:   startTime,
+		Uptime:    time.Since(startTime).Seconds(),
+		Config: ConfigSummary{
+			BindUDP:            c.listenAddrs("udp"),
+			BindTCP:            c.listenAddrs("tcp"),
+			API:                c.API,
+			Nameservers:        len(h.resolver.Nameservers()),
+			ResolverMode:       resolverMode,
+			Sources:            len(c.Sources),
+			Groups:             len(c.Groups),
+			BlockedDomains:     BlockCache.Length(),
+			CacheSize:          h.cache.Length(),
+			CacheMaxcount:      c.Maxcount,
+			BlockCacheSize:     h.blockCache.Length(),
+			BlockCacheMaxcount: c.BlockCacheMaxcount,
+			QuestionCacheCap:   c.QuestionCacheCap,
+		},
+	}
+}